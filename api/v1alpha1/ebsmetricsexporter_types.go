@@ -0,0 +1,342 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EBSMetricsExporterSpec defines the collector DaemonSet deployed by the operator
+type EBSMetricsExporterSpec struct {
+	// Image is the collector image
+	// +kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+
+	// ImagePullPolicy of the collector image
+	// +optional
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// Devices selects the NVMe devices to monitor
+	// +optional
+	Devices DeviceSelection `json:"devices,omitempty"`
+
+	// SampleInterval is the interval between device stats queries
+	// +optional
+	SampleInterval *metav1.Duration `json:"sampleInterval,omitempty"`
+
+	// NodeSelector restricts the nodes the collector runs on. Defaults to
+	// Linux nodes.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Tolerations of the collector pods. Defaults to tolerating every taint.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// Resources of the collector container
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// TLS, if set, serves the collector metrics over HTTPS
+	// +optional
+	TLS *TLSSpec `json:"tls,omitempty"`
+
+	// Outputs configures where the collectors send their metrics
+	// +optional
+	Outputs OutputsSpec `json:"outputs,omitempty"`
+
+	// Alerts configures the PrometheusRule of default EBS alerts and
+	// recording rules
+	// +optional
+	Alerts AlertsSpec `json:"alerts,omitempty"`
+
+	// PodIO attributes the I/O on the monitored volumes to the pods of every
+	// node, read from the pods' cgroup v2 io.stat. Defaults to true.
+	// +optional
+	PodIO *bool `json:"podIO,omitempty"`
+
+	// IOPressure exports the IO pressure of every node and how often high
+	// pressure coincided with volume or instance throttling. Requires PSI to
+	// be enabled in the node kernels. Defaults to true.
+	// +optional
+	IOPressure *bool `json:"ioPressure,omitempty"`
+}
+
+// DeviceSelection selects the NVMe devices monitored on every node
+type DeviceSelection struct {
+	// Paths lists the devices to monitor, e.g. /dev/nvme1n1. If empty,
+	// every EBS volume attached to the node is discovered and monitored.
+	// +optional
+	Paths []string `json:"paths,omitempty"`
+}
+
+// TLSSpec configures the collector's serving certificate
+type TLSSpec struct {
+	// SecretName is a kubernetes.io/tls Secret holding the serving
+	// certificate. If empty, the OpenShift service CA issues one into
+	// <name>-tls.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// OutputsSpec configures the collector outputs
+type OutputsSpec struct {
+	// ServiceMonitor creates a ServiceMonitor so the cluster Prometheus
+	// scrapes the collectors. The recording rules and the alerts built on
+	// the collector series are only created with it. Defaults to true.
+	// +optional
+	ServiceMonitor *bool `json:"serviceMonitor,omitempty"`
+
+	// OTLP pushes metrics to an OpenTelemetry collector
+	// +optional
+	OTLP *OTLPOutput `json:"otlp,omitempty"`
+
+	// StatsD sends metrics to a DogStatsD agent
+	// +optional
+	StatsD *StatsDOutput `json:"statsd,omitempty"`
+
+	// Influx writes metrics to an InfluxDB v2 server
+	// +optional
+	Influx *InfluxOutput `json:"influx,omitempty"`
+
+	// RemoteWrite pushes metrics to a Prometheus remote-write endpoint
+	// +optional
+	RemoteWrite *RemoteWriteOutput `json:"remoteWrite,omitempty"`
+}
+
+// OTLPOutput configures the OTLP output
+type OTLPOutput struct {
+	// Endpoint is host:port for grpc, or a URL for http/protobuf
+	// +kubebuilder:validation:MinLength=1
+	Endpoint string `json:"endpoint"`
+
+	// Protocol is the OTLP transport
+	// +kubebuilder:validation:Enum=grpc;http/protobuf
+	// +optional
+	Protocol string `json:"protocol,omitempty"`
+
+	// Insecure disables TLS for the endpoint
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+
+	// Interval between exports. Defaults to the sample interval.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// StatsDOutput configures the DogStatsD output
+type StatsDOutput struct {
+	// Address is host:port, udp://host:port or unix:///path
+	// +kubebuilder:validation:MinLength=1
+	Address string `json:"address"`
+
+	// Prefix of every metric name
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// Tags added to every metric
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// InfluxOutput configures the InfluxDB output
+type InfluxOutput struct {
+	// URL of the server, http(s)://host:8086 or udp://host:port
+	// +kubebuilder:validation:MinLength=1
+	URL string `json:"url"`
+
+	// Org is the InfluxDB organization
+	// +optional
+	Org string `json:"org,omitempty"`
+
+	// Bucket is the InfluxDB bucket
+	// +optional
+	Bucket string `json:"bucket,omitempty"`
+
+	// TokenSecret selects the key of a Secret holding the API token
+	// +optional
+	TokenSecret *corev1.SecretKeySelector `json:"tokenSecret,omitempty"`
+}
+
+// RemoteWriteOutput configures the Prometheus remote-write output
+type RemoteWriteOutput struct {
+	// URL of the remote-write endpoint
+	// +kubebuilder:validation:MinLength=1
+	URL string `json:"url"`
+
+	// Labels added to every series
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Username for basic auth, with the password in PasswordSecret
+	// +optional
+	Username string `json:"username,omitempty"`
+
+	// PasswordSecret selects the key of a Secret holding the basic auth
+	// password
+	// +optional
+	PasswordSecret *corev1.SecretKeySelector `json:"passwordSecret,omitempty"`
+
+	// BearerTokenSecret selects the key of a Secret holding a bearer token
+	// +optional
+	BearerTokenSecret *corev1.SecretKeySelector `json:"bearerTokenSecret,omitempty"`
+}
+
+// Condition types of an EBSMetricsExporter
+const (
+	// ConditionAvailable is true when collectors are available on every
+	// node they are scheduled to
+	ConditionAvailable = "Available"
+	// ConditionProgressing is true while the collector DaemonSet rolls out
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is true when the objects of the exporter could not
+	// be applied, its alert rules are invalid, or the collectors of some
+	// nodes are not ready or could not be scraped
+	ConditionDegraded = "Degraded"
+)
+
+// AlertsSpec configures the PrometheusRule created for an exporter
+type AlertsSpec struct {
+	// Enabled creates a PrometheusRule with the recording rules and the
+	// enabled alerts. Defaults to true.
+	// +optional
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// VolumeIOPSThrottling fires when a volume exceeded its IOPS limit for
+	// more than Threshold percent of the time. Threshold defaults to 10,
+	// For to 15m and Severity to warning.
+	// +optional
+	VolumeIOPSThrottling AlertRule `json:"volumeIOPSThrottling,omitempty"`
+
+	// InstanceThrottling fires when the I/O of a volume exceeded the IOPS
+	// or throughput limit of its instance for more than Threshold percent
+	// of the time. Threshold defaults to 10, For to 15m and Severity to
+	// warning.
+	// +optional
+	InstanceThrottling AlertRule `json:"instanceThrottling,omitempty"`
+
+	// LatencyRegression fires when the average read or write latency of a
+	// volume exceeds Threshold percent of its latency a day earlier.
+	// Threshold defaults to 200, For to 30m and Severity to warning.
+	// +optional
+	LatencyRegression AlertRule `json:"latencyRegression,omitempty"`
+
+	// ExporterDown fires when more than Threshold nodes are missing an
+	// available collector. Threshold defaults to 0, For to 15m and Severity
+	// to warning.
+	// +optional
+	ExporterDown AlertRule `json:"exporterDown,omitempty"`
+}
+
+// AlertRule configures one of the default alerts
+type AlertRule struct {
+	// Enabled adds the alert to the PrometheusRule. Defaults to true.
+	// +optional
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// Threshold of the alert, whose meaning depends on the alert
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Threshold *int32 `json:"threshold,omitempty"`
+
+	// For is how long the condition must hold before the alert fires
+	// +optional
+	For *metav1.Duration `json:"for,omitempty"`
+
+	// Severity label of the alert
+	// +kubebuilder:validation:Enum=info;warning;critical
+	// +optional
+	Severity string `json:"severity,omitempty"`
+}
+
+// EBSMetricsExporterStatus defines the observed state of EBSMetricsExporter
+type EBSMetricsExporterStatus struct {
+	// ObservedGeneration is the generation of the spec last reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions are the Available, Progressing and Degraded conditions
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// DesiredNodes is the number of nodes the collector is scheduled to
+	DesiredNodes int32 `json:"desiredNodes"`
+
+	// ReadyNodes is the number of nodes with a ready collector pod
+	ReadyNodes int32 `json:"readyNodes"`
+
+	// ReportingNodes is the number of nodes whose ready collector was
+	// scraped successfully, including nodes without EBS volumes
+	ReportingNodes int32 `json:"reportingNodes"`
+
+	// NotReportingNodes lists the nodes whose collector is not ready, or
+	// failed its last scrape
+	// +optional
+	NotReportingNodes []string `json:"notReportingNodes,omitempty"`
+
+	// Nodes summarizes the collector of every node
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+}
+
+// NodeStatus summarizes the collector of a node
+type NodeStatus struct {
+	// Name of the node
+	Name string `json:"name"`
+
+	// Pod is the collector pod running on the node
+	Pod string `json:"pod"`
+
+	// Ready is whether the collector pod is ready
+	Ready bool `json:"ready"`
+
+	// Devices is the number of EBS volumes the collector reported when last
+	// scraped
+	Devices int32 `json:"devices"`
+
+	// LastSampleTime is when the collector last queried one of its EBS
+	// devices successfully
+	// +optional
+	LastSampleTime *metav1.Time `json:"lastSampleTime,omitempty"`
+
+	// LastError is the error of the last scrape of the collector or, if it
+	// succeeded, the errors of the collector's last query of its devices
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=ebsexporter
+// +kubebuilder:printcolumn:name="Desired",type=integer,JSONPath=`.status.desiredNodes`
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyNodes`
+// +kubebuilder:printcolumn:name="Reporting",type=integer,JSONPath=`.status.reportingNodes`
+// +kubebuilder:printcolumn:name="Available",type=string,JSONPath=`.status.conditions[?(@.type=="Available")].status`
+// +kubebuilder:printcolumn:name="Degraded",type=string,JSONPath=`.status.conditions[?(@.type=="Degraded")].status`
+// +kubebuilder:printcolumn:name="Not Reporting",type=string,JSONPath=`.status.notReportingNodes`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// EBSMetricsExporter deploys the EBS metrics collector to the cluster's nodes
+type EBSMetricsExporter struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EBSMetricsExporterSpec   `json:"spec,omitempty"`
+	Status EBSMetricsExporterStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// EBSMetricsExporterList contains a list of EBSMetricsExporter
+type EBSMetricsExporterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EBSMetricsExporter `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EBSMetricsExporter{}, &EBSMetricsExporterList{})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/recording"
+)
+
+// errNoDevices is returned by openDevices when no EBS volume is attached to
+// the host
+var errNoDevices = errors.New("no EBS devices found")
+
+// openDevices opens the comma-separated device paths, or every EBS volume
+// on the host when all is set
+func openDevices(paths string, all bool) ([]*nvme.Device, error) {
+	if all {
+		devices, err := nvme.OpenAllDevices()
+		if err != nil {
+			return nil, err
+		}
+		if len(devices) == 0 {
+			return nil, errNoDevices
+		}
+		return devices, nil
+	}
+
+	var devices []*nvme.Device
+	for _, path := range strings.Split(paths, ",") {
+		device, err := nvme.OpenDevice(strings.TrimSpace(path))
+		if err != nil {
+			closeDevices(devices)
+			return nil, fmt.Errorf("failed to open device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// replayDevices loads a recording and returns devices that serve its
+// samples at the given playback speed, along with the player's clock
+func replayDevices(path string, speed float64, loop bool) ([]*nvme.Device, func() time.Time, error) {
+	rec, err := recording.Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	player, err := recording.NewPlayer(rec, speed, loop)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Replaying %s from %s to %s at %gx speed", path,
+		rec.Start().Format(time.RFC3339), rec.End().Format(time.RFC3339), speed)
+	devices, err := player.Devices()
+	return devices, player.Now, err
+}
+
+// closeDevices closes the device handles, logging any errors
+func closeDevices(devices []*nvme.Device) {
+	for _, device := range devices {
+		if err := device.Close(); err != nil {
+			log.Printf("Error closing device %s: %v", device.Path, err)
+		}
+	}
+}
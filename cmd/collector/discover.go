@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/blockdev"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// discoveredDevice describes an NVMe device found on the host
+type discoveredDevice struct {
+	Path          string          `json:"path"`
+	Kind          nvme.DeviceKind `json:"kind,omitempty"`
+	VolumeID      string          `json:"volumeId,omitempty"`
+	EC2DeviceName string          `json:"ec2DeviceName,omitempty"`
+	Model         string          `json:"model,omitempty"`
+	SerialNumber  string          `json:"serialNumber,omitempty"`
+	Firmware      string          `json:"firmware,omitempty"`
+	Error         string          `json:"error,omitempty"`
+
+	*blockdev.Info `json:",inline"`
+}
+
+// discoveryReport is the output of the discover subcommand
+type discoveryReport struct {
+	Devices []discoveredDevice `json:"devices"`
+}
+
+// runDiscover lists every NVMe device on the host and maps it to its EBS
+// volume, EC2 device name, by-id links, partitions and mountpoints
+func runDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	output := fs.String("output", outputTable, "Output format: table, json or yaml")
+	mountInfo := fs.String("mountinfo", blockdev.DefaultMountInfo, "mountinfo file used to find mountpoints")
+	fs.Parse(args)
+
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+
+	paths, err := nvme.ListNamespaces()
+	if err != nil {
+		return err
+	}
+	byID, err := blockdev.ByIDLinks()
+	if err != nil {
+		return err
+	}
+	mounts, err := blockdev.Mountpoints(*mountInfo)
+	if err != nil {
+		return err
+	}
+
+	report := discoveryReport{Devices: make([]discoveredDevice, 0, len(paths))}
+	for _, path := range paths {
+		report.Devices = append(report.Devices, discoverDevice(path, byID, mounts))
+	}
+
+	return writeOutput(os.Stdout, *output, report, func(w io.Writer) error {
+		return writeDiscoveryTable(w, report.Devices)
+	})
+}
+
+// discoverDevice collects the identify and block device data of a device.
+// Errors are recorded on the device so one unreadable device does not hide
+// the others.
+func discoverDevice(path string, byID, mounts map[string][]string) discoveredDevice {
+	device := discoveredDevice{Path: path}
+	var errs []string
+
+	identity, err := nvme.Identify(path)
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		device.Kind = identity.Kind
+		device.VolumeID = identity.VolumeID
+		device.EC2DeviceName = identity.EC2DeviceName
+		device.Model = identity.Model
+		device.SerialNumber = identity.SerialNumber
+		device.Firmware = identity.Firmware
+	}
+
+	info, err := blockdev.GetInfo(filepath.Base(path), byID, mounts)
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		device.Info = info
+	}
+
+	device.Error = strings.Join(errs, "; ")
+	return device
+}
+
+// writeDiscoveryTable prints one row per device
+func writeDiscoveryTable(w io.Writer, devices []discoveredDevice) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tTYPE\tVOLUME ID\tEC2 NAME\tSIZE\tPARTITIONS\tMOUNTPOINTS\tBY-ID")
+
+	for _, device := range devices {
+		kind := string(device.Kind)
+		if kind == "" {
+			kind = "unknown"
+		}
+
+		size, partitions, mountpoints, links := "-", "-", "-", "-"
+		if device.Info != nil {
+			size = formatBytes(device.SizeBytes)
+			partitions = joinOrDash(partitionNames(device.Partitions))
+			mountpoints = joinOrDash(allMountpoints(device.Info))
+			links = joinOrDash(baseNames(device.ByID))
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			device.Path,
+			kind,
+			dashIfEmpty(device.VolumeID),
+			dashIfEmpty(device.EC2DeviceName),
+			size,
+			partitions,
+			mountpoints,
+			links,
+		)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// Errors are listed after the table to keep the rows readable
+	for i, device := range devices {
+		if device.Error == "" {
+			continue
+		}
+		if i == 0 || devices[i-1].Error == "" {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s: %s\n", device.Path, device.Error)
+	}
+	return nil
+}
+
+// partitionNames returns the names of the partitions
+func partitionNames(partitions []blockdev.Partition) []string {
+	names := make([]string, 0, len(partitions))
+	for _, partition := range partitions {
+		names = append(names, partition.Name)
+	}
+	return names
+}
+
+// allMountpoints returns the mountpoints of the device and its partitions
+func allMountpoints(info *blockdev.Info) []string {
+	mountpoints := append([]string{}, info.Mountpoints...)
+	for _, partition := range info.Partitions {
+		mountpoints = append(mountpoints, partition.Mountpoints...)
+	}
+	return mountpoints
+}
+
+// baseNames strips the directory from each path
+func baseNames(paths []string) []string {
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	return names
+}
+
+// joinOrDash joins the values with commas, or returns "-" if there are none
+func joinOrDash(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	return strings.Join(values, ",")
+}
+
+// dashIfEmpty returns "-" for empty values
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// formatBytes formats a size using binary units
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
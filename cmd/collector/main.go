@@ -1,62 +1,322 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/api"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/cgroup"
 	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/health"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/output"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	devicePath = flag.String("device", "", "NVMe device to monitor (e.g., /dev/nvme1n1)")
-	port       = flag.String("port", "8090", "Port to listen on")
+	devicePath     = flag.String("device", "", "Comma-separated NVMe devices to monitor (e.g., /dev/nvme1n1,/dev/nvme2n1)")
+	allDevices     = flag.Bool("all", false, "Monitor every EBS volume attached to the host")
+	port           = flag.String("port", "8090", "Port to listen on")
+	tlsCertFile    = flag.String("tls-cert-file", "", "Serve HTTPS with this certificate (requires --tls-key-file)")
+	tlsKeyFile     = flag.String("tls-key-file", "", "Private key of --tls-cert-file")
+	sampleInterval = flag.Duration("sample-interval", 10*time.Second, "Interval between device stats queries")
+	readyPolicy    = flag.String("ready-policy", string(health.ReadyPolicyAny), "Devices that must be sampled recently for /readyz to succeed (any or all)")
+	readyMaxAge    = flag.Duration("ready-max-age", time.Minute, "Maximum age of a device's last successful sample for it to count as ready")
+	replayFile     = flag.String("replay", "", "Serve metrics from a recording made with the record subcommand instead of live devices")
+	replaySpeed    = flag.Float64("replay-speed", 1, "Playback speed of --replay relative to real time")
+	replayLoop     = flag.Bool("replay-loop", false, "Restart --replay playback at the end of the recording")
+	textfileDir    = flag.String("textfile-directory", "", "Write metrics to a .prom file in this directory for the node_exporter textfile collector")
+	textfileName   = flag.String("textfile-name", "ebs_metrics.prom", "Name of the file written to --textfile-directory")
+	textfileOnce   = flag.Bool("textfile-once", false, "Write the textfile once and exit instead of on every sampling interval")
+	noHTTP         = flag.Bool("no-http", false, "Do not start the HTTP server, e.g. when only writing a textfile")
+	shutdownGrace  = flag.Duration("shutdown-timeout", 10*time.Second, "Time allowed for in-flight scrapes and output flushes to finish on shutdown")
+	instanceInfo   = flag.Bool("instance-metadata", true, "Look up the EC2 instance ID, type and placement for push outputs")
+	podIO          = flag.Bool("pod-io", false, "Attribute the I/O on the monitored devices to the pods of the node, read from their cgroup v2 io.stat")
+	cgroupRoot     = flag.String("cgroup-root", cgroup.DefaultRoot, "Mountpoint of the host's cgroup v2 hierarchy, used by --pod-io")
+	podLogDir      = flag.String("pod-log-directory", cgroup.DefaultPodLogDirectory, "Host directory of the kubelet pod logs, used by --pod-io to name pods")
+
+	ioPressure          = flag.Bool("io-pressure", false, "Export the node's IO pressure and how often high pressure coincided with volume or instance throttling")
+	ioPressureThreshold = flag.Float64("io-pressure-threshold", 10, "Percentage of a sampling interval tasks must be stalled on IO for --io-pressure to count it as high pressure")
+	ioPressureWindow    = flag.Duration("io-pressure-window", time.Hour, "Period the ratio of throttled high IO pressure intervals is computed over")
+
+	otlpEndpoint = flag.String("otlp-endpoint", "", "Push metrics over OTLP to this endpoint (host:port for grpc, URL for http/protobuf)")
+	otlpProtocol = flag.String("otlp-protocol", output.OTLPProtocolGRPC, "OTLP transport (grpc or http/protobuf)")
+	otlpHeaders  = flag.String("otlp-headers", "", "Comma-separated key=value headers sent with every OTLP export")
+	otlpInsecure = flag.Bool("otlp-insecure", false, "Disable TLS for the OTLP endpoint")
+	otlpCAFile   = flag.String("otlp-ca-file", "", "CA certificate used to verify the OTLP endpoint")
+	otlpCertFile = flag.String("otlp-cert-file", "", "Client certificate for the OTLP endpoint")
+	otlpKeyFile  = flag.String("otlp-key-file", "", "Client key for the OTLP endpoint")
+	otlpInterval = flag.Duration("otlp-interval", 0, "Interval between OTLP exports (default: every --sample-interval)")
+	otlpTimeout  = flag.Duration("otlp-timeout", 10*time.Second, "Timeout for each OTLP export")
+
+	statsdAddress = flag.String("statsd-address", "", "Send metrics to a DogStatsD agent at host:port, udp://host:port or unix:///path")
+	statsdPrefix  = flag.String("statsd-prefix", output.DefaultStatsDPrefix, "Prefix of every StatsD metric name")
+	statsdTags    = flag.String("statsd-tags", "", "Comma-separated key=value tags added to every StatsD metric")
+
+	stdoutFormat      = flag.String("format", "", "Also write metrics to stdout on every sampling interval in this format (influx)")
+	influxURL         = flag.String("influx-url", "", "Write metrics to an InfluxDB v2 server (http(s)://host:8086) or UDP listener (udp://host:port)")
+	influxOrg         = flag.String("influx-org", "", "InfluxDB organization")
+	influxBucket      = flag.String("influx-bucket", "", "InfluxDB bucket")
+	influxToken       = flag.String("influx-token", os.Getenv("INFLUX_TOKEN"), "InfluxDB API token (default: $INFLUX_TOKEN)")
+	influxCAFile      = flag.String("influx-ca-file", "", "CA certificate used to verify the InfluxDB server")
+	influxMeasurement = flag.String("influx-measurement", output.DefaultInfluxMeasurement, "InfluxDB measurement name for --influx-url and --format influx")
+	influxTags        = flag.String("influx-tags", "", "Comma-separated key=value tags added to every InfluxDB line")
+	influxTimeout     = flag.Duration("influx-timeout", 10*time.Second, "Timeout for each InfluxDB write")
+
+	emfOutput     = flag.String("emf-output", "", "Write CloudWatch Embedded Metric Format documents to this file, or - for stdout")
+	emfNamespace  = flag.String("emf-namespace", output.DefaultEMFNamespace, "CloudWatch namespace of the EMF metrics")
+	emfResolution = flag.Int("emf-resolution", output.EMFResolutionStandard, "CloudWatch storage resolution of the EMF metrics in seconds (1 or 60)")
+	emfInterval   = flag.Duration("emf-interval", 0, "Interval between EMF documents (default: every --sample-interval)")
+
+	remoteWriteURL             = flag.String("remote-write-url", "", "Push samples to this Prometheus remote-write endpoint")
+	remoteWriteUsername        = flag.String("remote-write-username", "", "Basic auth username for --remote-write-url")
+	remoteWritePasswordFile    = flag.String("remote-write-password-file", "", "File containing the basic auth password for --remote-write-url")
+	remoteWriteBearerTokenFile = flag.String("remote-write-bearer-token-file", "", "File containing a bearer token for --remote-write-url")
+	remoteWriteCAFile          = flag.String("remote-write-ca-file", "", "CA certificate used to verify the remote-write endpoint")
+	remoteWriteLabels          = flag.String("remote-write-labels", "", "Comma-separated key=value labels added to every remote-write series")
+	remoteWriteShards          = flag.Int("remote-write-shards", output.DefaultRemoteWriteShards, "Number of concurrent remote-write senders")
+	remoteWriteQueueCapacity   = flag.Int("remote-write-queue-capacity", output.DefaultRemoteWriteQueueCapacity, "Samples buffered per shard while the remote-write endpoint is unavailable")
+	remoteWriteMaxSamples      = flag.Int("remote-write-max-samples-per-send", output.DefaultRemoteWriteMaxSamplesPerSend, "Maximum samples in each remote-write request")
+	remoteWriteMaxBackoff      = flag.Duration("remote-write-max-backoff", output.DefaultRemoteWriteMaxBackoff, "Maximum delay between remote-write retries")
+	remoteWriteTimeout         = flag.Duration("remote-write-timeout", output.DefaultRemoteWriteTimeout, "Timeout for each remote-write request")
 )
 
+// commands maps subcommand names to their entry points
+var commands = map[string]func(args []string) error{
+	"discover": runDiscover,
+	"record":   runRecord,
+	"snapshot": runSnapshot,
+	"watch":    runWatch,
+}
+
 func main() {
+	// Subcommands have their own flags; without one the exporter is started
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 
-	if *devicePath == "" {
-		fmt.Fprintf(os.Stderr, "Error: --device flag is required\n")
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		fmt.Fprintf(os.Stderr, "Error: --tls-cert-file and --tls-key-file must be set together\n")
+		os.Exit(1)
+	}
+
+	if *devicePath == "" && !*allDevices && *replayFile == "" {
+		fmt.Fprintf(os.Stderr, "Error: --device, --all or --replay flag is required\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	// Create the EBS collector
-	ebsCollector, err := collector.NewEBSCollector(*devicePath)
+	if err := run(); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// run starts the exporter and blocks until it receives SIGTERM or SIGINT,
+// then drains in-flight scrapes, stops the sampler, flushes a final
+// snapshot to the configured outputs and closes the devices
+func run() error {
+	policy, err := health.ParseReadyPolicy(*readyPolicy)
 	if err != nil {
-		log.Fatalf("Failed to create EBS collector: %v", err)
+		return fmt.Errorf("invalid --ready-policy: %w", err)
+	}
+	if *textfileOnce && *textfileDir == "" {
+		return fmt.Errorf("--textfile-once requires --textfile-directory")
+	}
+	if (*podIO || *ioPressure) && *noHTTP && *textfileDir == "" {
+		return fmt.Errorf("--pod-io and --io-pressure are only served over HTTP or written to --textfile-directory, not with --no-http alone")
 	}
 
-	// Register the collector with Prometheus
-	prometheus.MustRegister(ebsCollector)
+	// Open the devices to monitor, or replay them from a recording
+	var devices []*nvme.Device
+	var replayClock func() time.Time
+	if *replayFile != "" {
+		devices, replayClock, err = replayDevices(*replayFile, *replaySpeed, *replayLoop)
+	} else {
+		devices, err = openDevices(*devicePath, *allDevices)
+	}
+	// A node without EBS volumes still serves empty results, so it is
+	// reported as such rather than restarting until a volume is attached
+	if errors.Is(err, errNoDevices) {
+		log.Printf("No EBS devices found, serving no volume metrics")
+	} else if err != nil {
+		return err
+	}
+	defer closeDevices(devices)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	sampler := collector.NewSampler(devices, *sampleInterval)
+	if replayClock != nil {
+		// Stamp replayed samples with the recording time so that rates
+		// are not scaled by the playback speed
+		sampler.SetClock(replayClock)
+	}
+	defer func() {
+		if err := sampler.Close(); err != nil {
+			log.Printf("Error closing outputs: %v", err)
+		}
+	}()
+
+	// Create the collectors shared by the HTTP endpoint and the textfile
+	// output. The push outputs only send the EBS metrics.
+	collectors := []prometheus.Collector{collector.NewEBSCollector(sampler)}
+
+	// Pod I/O is read from the cgroup v2 io.stat files, nodes still using
+	// cgroup v1 only export the EBS metrics
+	if *podIO {
+		if !cgroup.IsV2(*cgroupRoot) {
+			log.Printf("Not exporting pod I/O, no cgroup v2 hierarchy at %s", *cgroupRoot)
+		} else {
+			collectors = append(collectors, collector.NewPodIOCollector(devices, *cgroupRoot, *podLogDir))
+		}
+	}
+
+	// The IO pressure correlator classifies every sampling interval, so it
+	// must be added as a sink before sampling starts, and before the
+	// textfile output writes its metrics
+	if *ioPressure {
+		if _, err := cgroup.ReadPressure(cgroup.NodeIOPressure); err != nil {
+			log.Printf("Not exporting IO pressure, is PSI enabled in the kernel? %v", err)
+		} else {
+			pressureCorrelator := collector.NewPressureCorrelator(cgroup.NodeIOPressure, *ioPressureThreshold, *ioPressureWindow)
+			sampler.AddSink(pressureCorrelator)
+			collectors = append(collectors, pressureCorrelator)
+		}
+	}
+
+	if err := addOutputs(ctx, sampler, collectors); err != nil {
+		return err
+	}
+
+	if *textfileOnce {
+		return sampler.Flush(ctx)
+	}
+
+	// Sample the devices in the background
+	var wg sync.WaitGroup
+	samplerCtx, stopSampler := context.WithCancel(ctx)
+	defer stopSampler()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sampler.Run(samplerCtx)
+	}()
+
+	if *noHTTP {
+		log.Printf("HTTP server disabled, sampling every %s", *sampleInterval)
+		<-ctx.Done()
+		log.Printf("Received shutdown signal")
+		return shutdown(sampler, stopSampler, &wg, nil)
+	}
+
+	// Register the collectors with Prometheus
+	prometheus.MustRegister(collectors...)
+
+	checker := health.NewChecker(sampler, policy, *readyMaxAge)
 
 	// Set up HTTP handlers
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", checker.HealthzHandler())
+	mux.Handle("/readyz", checker.ReadyzHandler())
+	mux.Handle("/api/v1/", api.NewHandler(sampler))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintf(w, `<html>
+		fmt.Fprint(w, `<html>
 <head><title>EBS Metrics Exporter</title></head>
 <body>
 <h1>EBS Metrics Exporter</h1>
-<p><a href="/metrics">Metrics</a></p>
-<p>Device: %s</p>
-<p>Volume ID: %s</p>
-</body>
-</html>`, ebsCollector.GetDevice(), ebsCollector.GetVolumeID())
+<p><a href="/metrics">Metrics</a> | <a href="/healthz">Health</a> | <a href="/readyz">Readiness</a> | <a href="/api/v1/devices">Devices API</a></p>
+`)
+		for _, device := range devices {
+			fmt.Fprintf(w, "<p>Device: %s<br>Volume ID: %s<br>EC2 Device Name: %s</p>\n",
+				html.EscapeString(device.Path), html.EscapeString(device.VolumeID), html.EscapeString(device.EC2DeviceName))
+		}
+		fmt.Fprint(w, `</body>
+</html>`)
 	})
 
 	addr := ":" + *port
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
 	log.Printf("Starting EBS metrics exporter on %s", addr)
-	log.Printf("Monitoring device: %s", *devicePath)
-	log.Printf("Volume ID: %s", ebsCollector.GetVolumeID())
-	log.Printf("Metrics available at http://localhost:%s/metrics", *port)
+	for _, device := range devices {
+		log.Printf("Monitoring device: %s (volume ID: %s)", device.Path, device.VolumeID)
+	}
+	scheme := "http"
+	if *tlsCertFile != "" {
+		scheme = "https"
+	}
+	log.Printf("Metrics available at %s://localhost:%s/metrics", scheme, *port)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		var err error
+		if *tlsCertFile != "" {
+			err = server.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+		close(serverErr)
+	}()
+
+	select {
+	case err := <-serverErr:
+		stopSampler()
+		wg.Wait()
+		return fmt.Errorf("failed to start server: %w", err)
+	case <-ctx.Done():
+		log.Printf("Received shutdown signal, draining")
+	}
+
+	return shutdown(sampler, stopSampler, &wg, server)
+}
+
+// shutdown drains in-flight scrapes, stops the sampler and flushes a final
+// snapshot to the outputs within the shutdown timeout
+func shutdown(sampler *collector.Sampler, stopSampler context.CancelFunc, wg *sync.WaitGroup, server *http.Server) error {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	defer cancel()
+
+	// Let in-flight scrapes finish before stopping the sampler
+	if server != nil {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down HTTP server: %v", err)
+		}
+	}
+
+	stopSampler()
+	wg.Wait()
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	if err := sampler.Flush(shutdownCtx); err != nil {
+		log.Printf("Error flushing final snapshot: %v", err)
 	}
+
+	log.Printf("Shutdown complete")
+	return nil
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/ec2metadata"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/output"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// addOutputs adds a sink to the sampler for every output enabled by flags.
+// The textfile output writes the metrics of the given collectors.
+func addOutputs(ctx context.Context, sampler *collector.Sampler, collectors []prometheus.Collector) error {
+	if *textfileDir != "" {
+		textfile, err := output.NewTextfileSink(*textfileDir, *textfileName, collectors...)
+		if err != nil {
+			return err
+		}
+		sampler.AddSink(textfile)
+	}
+
+	// Push outputs are tagged with the instance, looked up only if one is enabled
+	if *otlpEndpoint == "" && *statsdAddress == "" && *influxURL == "" && *stdoutFormat == "" && *emfOutput == "" && *remoteWriteURL == "" {
+		return nil
+	}
+	if *stdoutFormat != "" && *emfOutput == "-" {
+		return fmt.Errorf("--format and --emf-output - cannot both write to stdout")
+	}
+	instance := lookupInstance(ctx)
+
+	if *otlpEndpoint != "" {
+		headers, err := parseKeyValues(*otlpHeaders)
+		if err != nil {
+			return fmt.Errorf("invalid --otlp-headers: %w", err)
+		}
+		otlp, err := output.NewOTLPSink(output.OTLPConfig{
+			Endpoint: *otlpEndpoint,
+			Protocol: *otlpProtocol,
+			Headers:  headers,
+			Insecure: *otlpInsecure,
+			TLS: output.TLSConfig{
+				CAFile:   *otlpCAFile,
+				CertFile: *otlpCertFile,
+				KeyFile:  *otlpKeyFile,
+			},
+			Timeout:  *otlpTimeout,
+			Instance: instance,
+		})
+		if err != nil {
+			return err
+		}
+		sampler.AddSink(output.WithInterval(otlp, *otlpInterval))
+		log.Printf("Exporting metrics over OTLP (%s) to %s", *otlpProtocol, *otlpEndpoint)
+	}
+
+	if *statsdAddress != "" {
+		tags, err := parseKeyValues(*statsdTags)
+		if err != nil {
+			return fmt.Errorf("invalid --statsd-tags: %w", err)
+		}
+		statsd, err := output.NewStatsDSink(output.StatsDConfig{
+			Address:  *statsdAddress,
+			Prefix:   *statsdPrefix,
+			Tags:     tags,
+			Instance: instance,
+		})
+		if err != nil {
+			return err
+		}
+		sampler.AddSink(statsd)
+		log.Printf("Sending metrics to StatsD at %s", *statsdAddress)
+	}
+
+	if *influxURL != "" || *stdoutFormat != "" {
+		tags, err := parseKeyValues(*influxTags)
+		if err != nil {
+			return fmt.Errorf("invalid --influx-tags: %w", err)
+		}
+		config := output.InfluxConfig{
+			URL:         *influxURL,
+			Org:         *influxOrg,
+			Bucket:      *influxBucket,
+			Token:       *influxToken,
+			TLS:         output.TLSConfig{CAFile: *influxCAFile},
+			Timeout:     *influxTimeout,
+			Measurement: *influxMeasurement,
+			Tags:        tags,
+			Instance:    instance,
+		}
+
+		if *influxURL != "" {
+			influx, err := output.NewInfluxSink(config)
+			if err != nil {
+				return err
+			}
+			sampler.AddSink(influx)
+			log.Printf("Writing metrics to InfluxDB at %s", *influxURL)
+		}
+
+		switch *stdoutFormat {
+		case "":
+		case "influx":
+			sampler.AddSink(output.NewInfluxStreamSink(os.Stdout, config))
+		default:
+			return fmt.Errorf("unknown --format %q (must be influx)", *stdoutFormat)
+		}
+	}
+
+	if *emfOutput != "" {
+		emf, err := output.NewEMFSink(*emfOutput, output.EMFConfig{
+			Namespace:  *emfNamespace,
+			Resolution: *emfResolution,
+			Instance:   instance,
+		})
+		if err != nil {
+			return err
+		}
+		sampler.AddSink(output.WithInterval(emf, *emfInterval))
+		log.Printf("Writing CloudWatch EMF documents to %s", *emfOutput)
+	}
+
+	if *remoteWriteURL != "" {
+		labels, err := parseKeyValues(*remoteWriteLabels)
+		if err != nil {
+			return fmt.Errorf("invalid --remote-write-labels: %w", err)
+		}
+		password, err := readSecretFile(*remoteWritePasswordFile)
+		if err != nil {
+			return fmt.Errorf("invalid --remote-write-password-file: %w", err)
+		}
+		bearerToken, err := readSecretFile(*remoteWriteBearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("invalid --remote-write-bearer-token-file: %w", err)
+		}
+
+		remoteWrite, err := output.NewRemoteWriteSink(output.RemoteWriteConfig{
+			URL:               *remoteWriteURL,
+			Username:          *remoteWriteUsername,
+			Password:          password,
+			BearerToken:       bearerToken,
+			TLS:               output.TLSConfig{CAFile: *remoteWriteCAFile},
+			Timeout:           *remoteWriteTimeout,
+			Shards:            *remoteWriteShards,
+			QueueCapacity:     *remoteWriteQueueCapacity,
+			MaxSamplesPerSend: *remoteWriteMaxSamples,
+			MaxBackoff:        *remoteWriteMaxBackoff,
+			Labels:            labels,
+			Instance:          instance,
+		})
+		if err != nil {
+			return err
+		}
+		sampler.AddSink(remoteWrite)
+		log.Printf("Pushing samples to remote-write endpoint %s", *remoteWriteURL)
+	}
+
+	return nil
+}
+
+// lookupInstance returns the EC2 instance metadata, or nil if it is
+// disabled or unavailable, e.g. when replaying a recording off EC2
+func lookupInstance(ctx context.Context) *ec2metadata.InstanceMetadata {
+	if !*instanceInfo {
+		return nil
+	}
+	instance, err := ec2metadata.Fetch(ctx, ec2metadata.DefaultEndpoint)
+	if err != nil {
+		log.Printf("Warning: instance metadata unavailable, continuing without it: %v", err)
+		return nil
+	}
+	return instance
+}
+
+// readSecretFile returns the trimmed contents of a secret file, or an
+// empty string if no file is given
+func readSecretFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// parseKeyValues parses comma-separated key=value pairs
+func parseKeyValues(value string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	if value == "" {
+		return pairs, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		pairs[key] = strings.TrimSpace(val)
+	}
+	return pairs, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/recording"
+)
+
+// runRecord captures raw stats log pages and identify data of the chosen
+// devices into a recording file until interrupted or the duration elapses
+func runRecord(args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	devicePath := fs.String("device", "", "Comma-separated NVMe devices to record (e.g., /dev/nvme1n1,/dev/nvme2n1)")
+	all := fs.Bool("all", false, "Record every EBS volume attached to the host")
+	output := fs.String("output", "", "Recording file to write")
+	interval := fs.Duration("interval", time.Second, "Interval between samples")
+	duration := fs.Duration("duration", 0, "How long to record (default: until interrupted)")
+	fs.Parse(args)
+
+	if *devicePath == "" && !*all {
+		return fmt.Errorf("--device or --all flag is required")
+	}
+	if *output == "" {
+		return fmt.Errorf("--output flag is required")
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+
+	devices, err := openDevices(*devicePath, *all)
+	if err != nil {
+		return err
+	}
+	defer closeDevices(devices)
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return fmt.Errorf("failed to create recording: %w", err)
+	}
+	defer file.Close()
+
+	writer, err := recording.NewWriter(file)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]uint16, len(devices))
+	for i, device := range devices {
+		if ids[i], err = writer.AddDevice(device); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	log.Printf("Recording %d devices to %s every %s", len(devices), *output, *interval)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	samples := 0
+	for {
+		for i, device := range devices {
+			page, err := device.ReadStatsPage()
+			now := time.Now()
+			if err != nil {
+				log.Printf("Error querying stats for %s: %v", device.Path, err)
+				err = writer.WriteError(ids[i], now, err)
+			} else {
+				err = writer.WriteSample(ids[i], now, page)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write recording: %w", err)
+			}
+		}
+		samples++
+
+		if err := writer.Flush(); err != nil {
+			return fmt.Errorf("failed to write recording: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := writer.Close(); err != nil {
+				return fmt.Errorf("failed to finish recording: %w", err)
+			}
+			log.Printf("Recorded %d samples per device to %s", samples, *output)
+			return file.Close()
+		case <-ticker.C:
+		}
+	}
+}
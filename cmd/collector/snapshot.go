@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/api"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+)
+
+// Output formats supported by the CLI subcommands
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// runSnapshot queries each device once and prints the decoded stats
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	devicePath := fs.String("device", "", "Comma-separated NVMe devices to query (e.g., /dev/nvme1n1,/dev/nvme2n1)")
+	all := fs.Bool("all", false, "Query every EBS volume attached to the host")
+	output := fs.String("output", outputTable, "Output format: table, json or yaml")
+	fs.Parse(args)
+
+	if *devicePath == "" && !*all {
+		return fmt.Errorf("--device or --all flag is required")
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+
+	devices, err := openDevices(*devicePath, *all)
+	if err != nil {
+		return err
+	}
+	defer closeDevices(devices)
+
+	var failed int
+	snapshot := api.DeviceList{Devices: make([]api.Device, 0, len(devices))}
+	for _, device := range devices {
+		sample := collector.DeviceSample{Device: device}
+		stats, err := device.QueryStats()
+		if err != nil {
+			failed++
+			sample.Err = err
+			sample.ErrTime = time.Now()
+		} else {
+			sample.Stats = stats
+			sample.SampleTime = time.Now()
+		}
+		snapshot.Devices = append(snapshot.Devices, api.NewDevice(sample))
+	}
+
+	if err := writeOutput(os.Stdout, *output, snapshot, func(w io.Writer) error {
+		return writeSnapshotTable(w, snapshot.Devices)
+	}); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to query %d of %d devices", failed, len(devices))
+	}
+	return nil
+}
+
+// validateOutput checks that the output format is supported
+func validateOutput(output string) error {
+	switch output {
+	case outputTable, outputJSON, outputYAML:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q (expected %s, %s or %s)", output, outputTable, outputJSON, outputYAML)
+	}
+}
+
+// writeOutput writes value as JSON or YAML, or calls writeTable for the
+// table format
+func writeOutput(w io.Writer, output string, value interface{}, writeTable func(io.Writer) error) error {
+	switch output {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case outputYAML:
+		data, err := yaml.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to encode YAML: %w", err)
+		}
+		_, err = w.Write(data)
+		return err
+	default:
+		return writeTable(w)
+	}
+}
+
+// writeSnapshotTable prints the counters, queue length and latency
+// histograms of each device
+func writeSnapshotTable(w io.Writer, devices []api.Device) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	for i, device := range devices {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "Device:\t%s\n", device.Path)
+		fmt.Fprintf(tw, "Volume ID:\t%s\n", device.VolumeID)
+		fmt.Fprintf(tw, "EC2 Device Name:\t%s\n", device.EC2DeviceName)
+		fmt.Fprintf(tw, "Model:\t%s\n", device.Model)
+		fmt.Fprintf(tw, "Firmware:\t%s\n", device.Firmware)
+
+		if device.Stats == nil {
+			fmt.Fprintf(tw, "Error:\t%s\n", device.LastError)
+			continue
+		}
+		stats := device.Stats
+
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "COUNTER\tVALUE")
+		fmt.Fprintf(tw, "Total read ops\t%d\n", stats.TotalReadOps)
+		fmt.Fprintf(tw, "Total write ops\t%d\n", stats.TotalWriteOps)
+		fmt.Fprintf(tw, "Total read bytes\t%d\n", stats.TotalReadBytes)
+		fmt.Fprintf(tw, "Total write bytes\t%d\n", stats.TotalWriteBytes)
+		fmt.Fprintf(tw, "Total read time (us)\t%d\n", stats.TotalReadTime)
+		fmt.Fprintf(tw, "Total write time (us)\t%d\n", stats.TotalWriteTime)
+		fmt.Fprintf(tw, "Volume IOPS exceeded (us)\t%d\n", stats.EBSVolumePerformanceExceededIOPS)
+		fmt.Fprintf(tw, "Volume throughput exceeded (us)\t%d\n", stats.EBSVolumePerformanceExceededTP)
+		fmt.Fprintf(tw, "Instance IOPS exceeded (us)\t%d\n", stats.EBSInstancePerformanceExceededIOPS)
+		fmt.Fprintf(tw, "Instance throughput exceeded (us)\t%d\n", stats.EBSInstancePerformanceExceededTP)
+		fmt.Fprintf(tw, "Volume queue length\t%d\n", stats.VolumeQueueLength)
+
+		writeHistogramTable(tw, "Read I/O latency histogram", stats.ReadIOLatencyHistogram)
+		writeHistogramTable(tw, "Write I/O latency histogram", stats.WriteIOLatencyHistogram)
+	}
+
+	return tw.Flush()
+}
+
+// writeHistogramTable prints the bins of a latency histogram
+func writeHistogramTable(w io.Writer, title string, bins []api.HistogramBin) {
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, title)
+	fmt.Fprintln(w, "LOWER (us)\tUPPER (us)\tCOUNT")
+	for _, bin := range bins {
+		fmt.Fprintf(w, "%d\t%d\t%d\n", bin.Lower, bin.Upper, bin.Count)
+	}
+}
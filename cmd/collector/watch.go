@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+)
+
+// ANSI escape sequences used by the watch display
+const (
+	ansiClearScreen = "\033[H\033[2J"
+	ansiRed         = "\033[1;31m"
+	ansiYellow      = "\033[1;33m"
+	ansiReset       = "\033[0m"
+)
+
+// runWatch refreshes a table of per-volume rates and throttling on every
+// interval until interrupted
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	devicePath := fs.String("device", "", "Comma-separated NVMe devices to watch (default: every EBS volume)")
+	interval := fs.Duration("interval", time.Second, "Refresh interval")
+	noColor := fs.Bool("no-color", false, "Do not highlight throttled volumes")
+	fs.Parse(args)
+
+	if *interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+
+	devices, err := openDevices(*devicePath, *devicePath == "")
+	if err != nil {
+		return err
+	}
+	defer closeDevices(devices)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	sampler := collector.NewSampler(devices, *interval)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		sampler.SampleOnce(ctx)
+		fmt.Fprint(os.Stdout, ansiClearScreen)
+		if err := writeWatchTable(os.Stdout, sampler.Samples(), *interval, !*noColor); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeWatchTable prints one row per device with the rates over the last
+// interval. Rows for volumes that exceeded a volume limit are red and rows
+// that only exceeded an instance limit are yellow.
+func writeWatchTable(w io.Writer, samples []collector.DeviceSample, interval time.Duration, color bool) error {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintln(tw, "DEVICE\tVOLUME\tr/s\tw/s\trMB/s\twMB/s\tr_await(ms)\tw_await(ms)\tqueue\tvol_iops_exc(ms)\tvol_tp_exc(ms)\tinst_iops_exc(ms)\tinst_tp_exc(ms)\tTHROTTLED\t")
+
+	highlights := make([]string, 0, len(samples))
+	for _, sample := range samples {
+		rates, ok := sample.Rates()
+		switch {
+		case sample.Err != nil:
+			fmt.Fprintf(tw, "%s\t%s\terror: %v\t\t\t\t\t\t\t\t\t\t\t\t\n", sample.DeviceName(), sample.Device.VolumeID, sample.Err)
+			highlights = append(highlights, ansiRed)
+			continue
+		case !ok:
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\t-\t-\t%d\t-\t-\t-\t-\t\t\n", sample.DeviceName(), sample.Device.VolumeID, sample.Stats.VolumeQueueLength)
+			highlights = append(highlights, "")
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%.1f\t%.1f\t%.2f\t%.2f\t%.2f\t%.2f\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%s\t\n",
+			sample.DeviceName(),
+			sample.Device.VolumeID,
+			rates.ReadIOPS,
+			rates.WriteIOPS,
+			rates.ReadBytesPerSecond/1e6,
+			rates.WriteBytesPerSecond/1e6,
+			rates.AvgReadLatency/1000,
+			rates.AvgWriteLatency/1000,
+			sample.Stats.VolumeQueueLength,
+			rates.VolumeIOPSExceeded/1000,
+			rates.VolumeThroughputExceeded/1000,
+			rates.InstanceIOPSExceeded/1000,
+			rates.InstanceThroughputExceeded/1000,
+			throttledBy(rates),
+		)
+
+		switch {
+		case rates.VolumeThrottled():
+			highlights = append(highlights, ansiRed)
+		case rates.InstanceThrottled():
+			highlights = append(highlights, ansiYellow)
+		default:
+			highlights = append(highlights, "")
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// Colors are applied after alignment since tabwriter counts escape
+	// sequences as printable characters
+	fmt.Fprintf(w, "%s  interval %s\n\n", time.Now().Format(time.RFC3339), interval)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	for i, line := range lines {
+		if color && i > 0 && highlights[i-1] != "" {
+			line = highlights[i-1] + line + ansiReset
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttledBy describes which limits were exceeded during the interval
+func throttledBy(rates collector.Rates) string {
+	var limits []string
+	if rates.VolumeThrottled() {
+		limits = append(limits, "volume")
+	}
+	if rates.InstanceThrottled() {
+		limits = append(limits, "instance")
+	}
+	if len(limits) == 0 {
+		return "-"
+	}
+	return strings.Join(limits, ",")
+}
@@ -6,4 +6,15 @@ const (
 	MetricsPort        = "8383"
 	HealthProbeAddress = ":8081"
 	DaemonSetName      = "ebs-metrics-exporter"
+
+	// Collector pods serve metrics on the container port with this name,
+	// or on CollectorMetricsPort if the port is not named
+	CollectorMetricsPortName = "metrics"
+	CollectorMetricsPort     = "8090"
+	CollectorMetricsPath     = "/metrics"
+
+	// Collector pods created from an EBSMetricsExporter run as this service
+	// account under this SecurityContextConstraints
+	CollectorServiceAccountName = "ebs-metrics-exporter"
+	CollectorSCCName            = "ebs-metrics-exporter"
 )
@@ -2,24 +2,39 @@ package daemonset
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"sort"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
+	operatorConfig "github.com/nephomaniac/ebs-metrics-exporter/config"
+	"github.com/nephomaniac/ebs-metrics-exporter/controllers/exporter"
 	"github.com/nephomaniac/ebs-metrics-exporter/pkg/metrics"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/scraper"
 )
 
 const (
-	logName           = "daemonset-controller"
-	recheckInterval   = 30 * time.Second
+	logName          = "daemonset-controller"
+	recheckInterval  = 30 * time.Second
+	schemeAnnotation = "prometheus.io/scheme"
 )
 
+// MinAggregationInterval is the shortest aggregation interval that can be
+// honored. Collectors are scraped when the DaemonSet is reconciled, which
+// happens at least every recheck interval.
+const MinAggregationInterval = recheckInterval
+
 var log = logf.Log.WithName(logName)
 
 // DaemonSetReconciler reconciles EBS metrics exporter DaemonSet
@@ -27,14 +42,19 @@ type DaemonSetReconciler struct {
 	client.Client
 	Scheme            *runtime.Scheme
 	MetricsAggregator *metrics.EBSMetricsAggregator
+	Scraper           *scraper.Scraper
 	ClusterId         string
+
+	// lastScrape is when the pods of every collector DaemonSet were last
+	// scraped. Reconciles are not concurrent, so it needs no lock.
+	lastScrape map[types.NamespacedName]time.Time
 }
 
 // Reconcile handles DaemonSet state changes
 func (r *DaemonSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	reqLogger := log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
 	reqLogger.Info("Reconciling DaemonSet")
-	
+
 	defer func() {
 		reqLogger.Info("Reconcile Complete")
 	}()
@@ -45,12 +65,20 @@ func (r *DaemonSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	if err != nil {
 		if errors.IsNotFound(err) {
 			reqLogger.Info("DaemonSet not found, may have been deleted")
-			return ctrl.Result{}, nil
+			r.MetricsAggregator.RemoveCollectorFleet(req.Name)
+			delete(r.lastScrape, req.NamespacedName)
+			return ctrl.Result{}, r.removeDeletedCollectors(ctx, req.Namespace)
 		}
 		reqLogger.Error(err, "Failed to get DaemonSet")
 		return ctrl.Result{}, err
 	}
 
+	// Only the collectors created for an exporter are scraped, pod events
+	// of other DaemonSets may still trigger a reconcile
+	if !exporter.IsCollector(daemonSet) {
+		return ctrl.Result{}, nil
+	}
+
 	// Monitor DaemonSet status and expose operational metrics
 	// This can include: number of ready pods, desired pods, available pods, etc.
 	reqLogger.Info("DaemonSet Status",
@@ -66,29 +94,174 @@ func (r *DaemonSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		client.InNamespace(req.Namespace),
 		client.MatchingLabels(daemonSet.Spec.Selector.MatchLabels),
 	}
-	
+
 	if err := r.List(ctx, podList, listOpts...); err != nil {
 		reqLogger.Error(err, "Failed to list pods")
 		return ctrl.Result{RequeueAfter: recheckInterval}, err
 	}
 
 	reqLogger.Info("Found pods", "count", len(podList.Items))
-	
-	// Process each pod - in the future, this could scrape metrics from each pod's endpoint
-	// For now, we just log the pod status
+
+	// Collect the ready pods to scrape
+	var targets []scraper.Target
 	for _, pod := range podList.Items {
+		ready := isPodReady(&pod)
 		reqLogger.Info("Pod status",
 			"name", pod.Name,
 			"node", pod.Spec.NodeName,
 			"phase", pod.Status.Phase,
-			"ready", isPodReady(&pod),
+			"ready", ready,
 		)
+		if ready && pod.Status.PodIP != "" {
+			targets = append(targets, scraper.Target{
+				Pod:  pod.Name,
+				Node: pod.Spec.NodeName,
+				URL:  metricsURL(&pod),
+				// Serving certificates are issued for the Service named
+				// after the DaemonSet
+				ServerName: exporter.ServiceServerName(daemonSet.Name, daemonSet.Namespace),
+			})
+		}
+	}
+
+	// Drop the series of nodes whose collector pod was deleted, e.g. because
+	// the node left the cluster. Pod deletions trigger a reconcile.
+	if err := r.removeDeletedCollectors(ctx, req.Namespace); err != nil {
+		reqLogger.Error(err, "Failed to list collector pods")
+		return ctrl.Result{RequeueAfter: recheckInterval}, err
 	}
 
+	// Scrape every collector DaemonSet once per aggregation interval,
+	// however often pod events trigger a reconcile
+	if r.Scraper != nil && time.Since(r.lastScrape[req.NamespacedName]) >= r.MetricsAggregator.AggregationInterval() {
+		if r.lastScrape == nil {
+			r.lastScrape = make(map[types.NamespacedName]time.Time)
+		}
+		r.lastScrape[req.NamespacedName] = time.Now()
+		volumes, err := r.Scraper.ScrapeAll(ctx, targets)
+		if err != nil {
+			reqLogger.Error(err, "Failed to scrape some collector pods")
+		}
+		reqLogger.Info("Scraped collector pods", "pods", len(targets), "volumes", volumes)
+
+		// Volumes no longer reported, e.g. after being detached, expire
+		// once they have not been seen for the series TTL
+		if expired := r.MetricsAggregator.ExpireStaleSeries(time.Now()); expired > 0 {
+			reqLogger.Info("Expired stale volume series", "volumes", expired)
+		}
+		r.MetricsAggregator.Aggregate()
+	}
+
+	r.MetricsAggregator.SetCollectorFleet(daemonSet.Name, r.collectorFleet(daemonSet, podList.Items))
+
 	// Requeue to continuously monitor the DaemonSet
 	return ctrl.Result{RequeueAfter: recheckInterval}, nil
 }
 
+// removeDeletedCollectors drops the series and scrape results of the nodes
+// and pods that no longer run a collector of any exporter. Exporters may
+// run collectors on different nodes, so a node is only dropped once no
+// collector DaemonSet runs a pod on it.
+func (r *DaemonSetReconciler) removeDeletedCollectors(ctx context.Context, namespace string) error {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(namespace), client.MatchingLabels(exporter.CollectorLabels())); err != nil {
+		return err
+	}
+
+	nodes := make(map[string]bool)
+	pods := make(map[string]bool)
+	for _, pod := range podList.Items {
+		pods[pod.Name] = true
+		if pod.DeletionTimestamp == nil && pod.Spec.NodeName != "" {
+			nodes[pod.Spec.NodeName] = true
+		}
+	}
+	if removed := r.MetricsAggregator.RemoveNodesExcept(nodes); removed > 0 {
+		log.Info("Removed series of nodes without a collector pod", "volumes", removed)
+	}
+	if r.Scraper != nil {
+		r.Scraper.RemoveResultsExcept(pods)
+	}
+	return nil
+}
+
+// collectorFleet returns the state of the DaemonSet and its pods, with the
+// results of the latest scrapes
+func (r *DaemonSetReconciler) collectorFleet(daemonSet *appsv1.DaemonSet, pods []corev1.Pod) metrics.CollectorFleet {
+	fleet := metrics.CollectorFleet{
+		Desired:      daemonSet.Status.DesiredNumberScheduled,
+		Ready:        daemonSet.Status.NumberReady,
+		Available:    daemonSet.Status.NumberAvailable,
+		Misscheduled: daemonSet.Status.NumberMisscheduled,
+	}
+
+	byNode := make(map[string]*metrics.CollectorNode)
+	var nodes []string
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || pod.Spec.NodeName == "" {
+			continue
+		}
+		node, ok := byNode[pod.Spec.NodeName]
+		if !ok {
+			node = &metrics.CollectorNode{Node: pod.Spec.NodeName}
+			byNode[pod.Spec.NodeName] = node
+			nodes = append(nodes, pod.Spec.NodeName)
+		}
+		if !isPodReady(pod) {
+			node.NotReady++
+		}
+		if image, imageID := collectorImage(pod); image != "" {
+			node.Image, node.ImageID = image, imageID
+		}
+		if r.Scraper != nil {
+			if result, ok := r.Scraper.LastResult(pod.Name); ok && result.Err == nil {
+				node.Scraped = true
+				node.NoDevices = result.Volumes == 0
+			}
+		}
+	}
+
+	sort.Strings(nodes)
+	for _, name := range nodes {
+		fleet.Nodes = append(fleet.Nodes, *byNode[name])
+	}
+	return fleet
+}
+
+// collectorImage returns the image of a pod's collector container, and the
+// digest it resolved to once started
+func collectorImage(pod *corev1.Pod) (string, string) {
+	if len(pod.Spec.Containers) == 0 {
+		return "", ""
+	}
+	container := pod.Spec.Containers[0]
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == container.Name {
+			return container.Image, status.ImageID
+		}
+	}
+	return container.Image, ""
+}
+
+// metricsURL returns the metrics endpoint of a collector pod, served over
+// https if its prometheus.io/scheme annotation says so
+func metricsURL(pod *corev1.Pod) string {
+	scheme := "http"
+	if pod.Annotations[schemeAnnotation] == "https" {
+		scheme = "https"
+	}
+	port := operatorConfig.CollectorMetricsPort
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			if containerPort.Name == operatorConfig.CollectorMetricsPortName {
+				port = fmt.Sprint(containerPort.ContainerPort)
+			}
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(pod.Status.PodIP, port) + operatorConfig.CollectorMetricsPath
+}
+
 // isPodReady checks if a pod is ready
 func isPodReady(pod *corev1.Pod) bool {
 	for _, condition := range pod.Status.Conditions {
@@ -102,7 +275,7 @@ func isPodReady(pod *corev1.Pod) bool {
 // SetupWithManager sets up the controller with the Manager
 func (r *DaemonSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&appsv1.DaemonSet{}).
+		For(&appsv1.DaemonSet{}, builder.WithPredicates(predicate.NewPredicateFuncs(exporter.IsCollector))).
 		Owns(&corev1.Pod{}).
 		Complete(r)
 }
@@ -0,0 +1,185 @@
+package exporter
+
+import (
+	"context"
+	"time"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	ebsv1alpha1 "github.com/nephomaniac/ebs-metrics-exporter/api/v1alpha1"
+	operatorConfig "github.com/nephomaniac/ebs-metrics-exporter/config"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/scraper"
+)
+
+const (
+	logName = "exporter-controller"
+
+	// recreateDelay is how long to wait for a DaemonSet deleted because
+	// its immutable selector changed before recreating it
+	recreateDelay = 5 * time.Second
+
+	// statusInterval is how often the status is refreshed with the latest
+	// scrape results
+	statusInterval = 30 * time.Second
+)
+
+var log = logf.Log.WithName(logName)
+
+// EBSMetricsExporterReconciler reconciles the DaemonSet, Service,
+// ServiceMonitor and PrometheusRule of every EBSMetricsExporter. Objects are
+// server-side applied, so changes made to the fields the operator manages are
+// reverted, and they are owned by the exporter, so they are garbage collected
+// with it.
+// The status reports the DaemonSet rollout and the collector of every node,
+// including the results of the latest scrapes.
+type EBSMetricsExporterReconciler struct {
+	client.Client
+	Scheme  *runtime.Scheme
+	Scraper *scraper.Scraper
+}
+
+// Reconcile brings the objects of an EBSMetricsExporter to its spec
+func (r *EBSMetricsExporterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
+	reqLogger.Info("Reconciling EBSMetricsExporter")
+
+	exporter := &ebsv1alpha1.EBSMetricsExporter{}
+	if err := r.Get(ctx, req.NamespacedName, exporter); err != nil {
+		if errors.IsNotFound(err) {
+			reqLogger.Info("EBSMetricsExporter not found, its objects are garbage collected")
+			return ctrl.Result{}, nil
+		}
+		reqLogger.Error(err, "Failed to get EBSMetricsExporter")
+		return ctrl.Result{}, err
+	}
+	if !exporter.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// The collectors need the service account, security context constraints
+	// and Prometheus role of the operator namespace, so exporters elsewhere
+	// are only reported as degraded
+	if exporter.Namespace != operatorConfig.OperatorNamespace {
+		reqLogger.Info("Not deploying EBSMetricsExporter outside the operator namespace",
+			"operatorNamespace", operatorConfig.OperatorNamespace)
+		return ctrl.Result{}, r.rejectNamespace(ctx, exporter)
+	}
+
+	daemonSet := newDaemonSet(exporter)
+	recreating, err := r.deleteIfSelectorChanged(ctx, daemonSet)
+	if err != nil {
+		reqLogger.Error(err, "Failed to replace DaemonSet with a changed selector")
+		return ctrl.Result{}, err
+	}
+	if recreating {
+		reqLogger.Info("Deleted DaemonSet with an outdated selector, recreating it")
+		return ctrl.Result{RequeueAfter: recreateDelay}, nil
+	}
+
+	objects := []client.Object{daemonSet, newService(exporter)}
+	if serviceMonitorEnabled(exporter) {
+		objects = append(objects, newServiceMonitor(exporter))
+	} else if err := r.deleteOwned(ctx, exporter, &monitoringv1.ServiceMonitor{}); err != nil {
+		reqLogger.Error(err, "Failed to delete ServiceMonitor")
+		return ctrl.Result{}, err
+	}
+
+	// Invalid rules keep the PrometheusRule last applied, and degrade the
+	// exporter until its spec is fixed
+	var rulesErr error
+	var rule *monitoringv1.PrometheusRule
+	if alertsEnabled(exporter) {
+		rule, rulesErr = newPrometheusRule(exporter)
+		if rulesErr != nil {
+			reqLogger.Error(rulesErr, "Not applying invalid PrometheusRule")
+		}
+	}
+	switch {
+	case rule != nil:
+		objects = append(objects, rule)
+	case rulesErr == nil:
+		if err := r.deleteOwned(ctx, exporter, &monitoringv1.PrometheusRule{}); err != nil {
+			reqLogger.Error(err, "Failed to delete PrometheusRule")
+			return ctrl.Result{}, err
+		}
+	}
+
+	for _, object := range objects {
+		if err := r.apply(ctx, exporter, object); err != nil {
+			reqLogger.Error(err, "Failed to apply object", "kind", object.GetObjectKind().GroupVersionKind().Kind)
+			if statusErr := r.updateStatus(ctx, exporter, err); statusErr != nil {
+				reqLogger.Error(statusErr, "Failed to update EBSMetricsExporter status")
+			}
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := r.updateStatus(ctx, exporter, rulesErr); err != nil {
+		reqLogger.Error(err, "Failed to update EBSMetricsExporter status")
+		return ctrl.Result{}, err
+	}
+
+	reqLogger.Info("Reconciled EBSMetricsExporter", "image", exporter.Spec.Image,
+		"readyNodes", exporter.Status.ReadyNodes, "reportingNodes", exporter.Status.ReportingNodes)
+	return ctrl.Result{RequeueAfter: statusInterval}, nil
+}
+
+// apply server-side applies an object owned by the exporter
+func (r *EBSMetricsExporterReconciler) apply(ctx context.Context, exporter *ebsv1alpha1.EBSMetricsExporter, object client.Object) error {
+	if err := controllerutil.SetControllerReference(exporter, object, r.Scheme); err != nil {
+		return err
+	}
+	return r.Patch(ctx, object, client.Apply, client.FieldOwner(operatorConfig.OperatorName), client.ForceOwnership)
+}
+
+// deleteIfSelectorChanged deletes the existing DaemonSet if its selector,
+// which cannot be updated, differs from the desired one, e.g. when taking
+// over a DaemonSet deployed from static manifests
+func (r *EBSMetricsExporterReconciler) deleteIfSelectorChanged(ctx context.Context, desired *appsv1.DaemonSet) (bool, error) {
+	existing := &appsv1.DaemonSet{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(desired), existing); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	if equality.Semantic.DeepEqual(existing.Spec.Selector, desired.Spec.Selector) {
+		return false, nil
+	}
+	propagation := metav1.DeletePropagationForeground
+	err := r.Delete(ctx, existing, &client.DeleteOptions{PropagationPolicy: &propagation})
+	return true, client.IgnoreNotFound(err)
+}
+
+// deleteOwned deletes the object named after the exporter if the exporter
+// controls it
+func (r *EBSMetricsExporterReconciler) deleteOwned(ctx context.Context, exporter *ebsv1alpha1.EBSMetricsExporter, object client.Object) error {
+	err := r.Get(ctx, client.ObjectKeyFromObject(exporter), object)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(object, exporter) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, object))
+}
+
+// SetupWithManager sets up the controller with the Manager
+func (r *EBSMetricsExporterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&ebsv1alpha1.EBSMetricsExporter{}).
+		Owns(&appsv1.DaemonSet{}).
+		Owns(&corev1.Service{}).
+		Owns(&monitoringv1.ServiceMonitor{}).
+		Owns(&monitoringv1.PrometheusRule{}).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(podExporter)).
+		Complete(r)
+}
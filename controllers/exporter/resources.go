@@ -0,0 +1,468 @@
+package exporter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ebsv1alpha1 "github.com/nephomaniac/ebs-metrics-exporter/api/v1alpha1"
+	operatorConfig "github.com/nephomaniac/ebs-metrics-exporter/config"
+)
+
+const (
+	containerName = "ebs-metrics-exporter"
+
+	nameLabel      = "app.kubernetes.io/name"
+	instanceLabel  = "app.kubernetes.io/instance"
+	managedByLabel = "app.kubernetes.io/managed-by"
+
+	tlsVolume            = "tls"
+	tlsMountPath         = "/etc/tls"
+	remoteWriteVolume    = "remote-write"
+	remoteWriteMountPath = "/etc/remote-write"
+	cgroupVolume         = "cgroup"
+	cgroupMountPath      = "/host/sys/fs/cgroup"
+	podLogsVolume        = "pod-logs"
+	podLogsMountPath     = "/host/var/log/pods"
+
+	// servingCertAnnotation asks the OpenShift service CA to issue a
+	// serving certificate for a Service into the named Secret
+	servingCertAnnotation = "service.beta.openshift.io/serving-cert-secret-name"
+	// serviceCAFile is the service CA bundle mounted into the cluster
+	// Prometheus
+	serviceCAFile = "/etc/prometheus/configmaps/serving-certs-ca-bundle/service-ca.crt"
+)
+
+// selectorLabels are the labels selecting the collector pods of an exporter
+func selectorLabels(exporter *ebsv1alpha1.EBSMetricsExporter) map[string]string {
+	return map[string]string{
+		nameLabel:     operatorConfig.DaemonSetName,
+		instanceLabel: exporter.Name,
+	}
+}
+
+// objectLabels are the labels of every object created for an exporter
+func objectLabels(exporter *ebsv1alpha1.EBSMetricsExporter) map[string]string {
+	labels := selectorLabels(exporter)
+	labels["app.kubernetes.io/component"] = operatorConfig.DaemonSetName
+	labels[managedByLabel] = operatorConfig.OperatorName
+	return labels
+}
+
+// CollectorLabels are the labels shared by the collector DaemonSets and
+// pods of every exporter
+func CollectorLabels() map[string]string {
+	return map[string]string{
+		nameLabel:      operatorConfig.DaemonSetName,
+		managedByLabel: operatorConfig.OperatorName,
+	}
+}
+
+// IsCollector reports whether an object is a collector DaemonSet or pod
+// created for an exporter, whatever the exporter is named
+func IsCollector(object client.Object) bool {
+	labels := object.GetLabels()
+	for key, value := range CollectorLabels() {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// objectMeta returns the metadata of an object created for an exporter
+func objectMeta(exporter *ebsv1alpha1.EBSMetricsExporter) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      exporter.Name,
+		Namespace: exporter.Namespace,
+		Labels:    objectLabels(exporter),
+	}
+}
+
+// tlsSecretName returns the Secret holding the collector's serving
+// certificate, or an empty string if TLS is disabled
+func tlsSecretName(exporter *ebsv1alpha1.EBSMetricsExporter) string {
+	switch {
+	case exporter.Spec.TLS == nil:
+		return ""
+	case exporter.Spec.TLS.SecretName != "":
+		return exporter.Spec.TLS.SecretName
+	default:
+		return exporter.Name + "-tls"
+	}
+}
+
+// metricsScheme returns the scheme the collector metrics are served with
+func metricsScheme(exporter *ebsv1alpha1.EBSMetricsExporter) string {
+	if exporter.Spec.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// serviceMonitorEnabled reports whether the exporter wants a ServiceMonitor
+func serviceMonitorEnabled(exporter *ebsv1alpha1.EBSMetricsExporter) bool {
+	return exporter.Spec.Outputs.ServiceMonitor == nil || *exporter.Spec.Outputs.ServiceMonitor
+}
+
+// podIOEnabled reports whether the exporter attributes volume I/O to pods
+func podIOEnabled(exporter *ebsv1alpha1.EBSMetricsExporter) bool {
+	return exporter.Spec.PodIO == nil || *exporter.Spec.PodIO
+}
+
+// ioPressureEnabled reports whether the exporter exports IO pressure
+func ioPressureEnabled(exporter *ebsv1alpha1.EBSMetricsExporter) bool {
+	return exporter.Spec.IOPressure == nil || *exporter.Spec.IOPressure
+}
+
+// newDaemonSet returns the collector DaemonSet of an exporter
+func newDaemonSet(exporter *ebsv1alpha1.EBSMetricsExporter) *appsv1.DaemonSet {
+	spec := exporter.Spec
+	port := mustAtoi(operatorConfig.CollectorMetricsPort)
+	scheme := corev1.URISchemeHTTP
+	if spec.TLS != nil {
+		scheme = corev1.URISchemeHTTPS
+	}
+
+	nodeSelector := spec.NodeSelector
+	if len(nodeSelector) == 0 {
+		nodeSelector = map[string]string{corev1.LabelOSStable: "linux"}
+	}
+	tolerations := spec.Tolerations
+	if len(tolerations) == 0 {
+		tolerations = []corev1.Toleration{{Operator: corev1.TolerationOpExists}}
+	}
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("10m"),
+			corev1.ResourceMemory: resource.MustParse("32Mi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("100m"),
+			corev1.ResourceMemory: resource.MustParse("128Mi"),
+		},
+	}
+	if spec.Resources != nil {
+		resources = *spec.Resources
+	}
+
+	container := corev1.Container{
+		Name:            containerName,
+		Image:           spec.Image,
+		ImagePullPolicy: spec.ImagePullPolicy,
+		Command:         []string{"/ebs-metrics-collector"},
+		Args:            collectorArgs(exporter),
+		Env:             collectorEnv(exporter),
+		Ports: []corev1.ContainerPort{{
+			Name:          operatorConfig.CollectorMetricsPortName,
+			ContainerPort: int32(port),
+			Protocol:      corev1.ProtocolTCP,
+		}},
+		LivenessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
+				Path:   "/healthz",
+				Port:   intstr.FromString(operatorConfig.CollectorMetricsPortName),
+				Scheme: scheme,
+			}},
+			InitialDelaySeconds: 10,
+			PeriodSeconds:       30,
+			FailureThreshold:    3,
+		},
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
+				Path:   "/readyz",
+				Port:   intstr.FromString(operatorConfig.CollectorMetricsPortName),
+				Scheme: scheme,
+			}},
+			InitialDelaySeconds: 5,
+			PeriodSeconds:       15,
+			FailureThreshold:    2,
+		},
+		Resources: resources,
+		SecurityContext: &corev1.SecurityContext{
+			Privileged: ptr(true),
+			RunAsUser:  ptr(int64(0)),
+			Capabilities: &corev1.Capabilities{
+				Add: []corev1.Capability{"SYS_ADMIN"},
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{{Name: "dev", MountPath: "/dev", ReadOnly: true}},
+	}
+
+	volumes := []corev1.Volume{{
+		Name: "dev",
+		VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{
+			Path: "/dev",
+			Type: ptr(corev1.HostPathDirectory),
+		}},
+	}}
+	if secret := tlsSecretName(exporter); secret != "" {
+		volumes = append(volumes, corev1.Volume{
+			Name:         tlsVolume,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secret}},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: tlsVolume, MountPath: tlsMountPath, ReadOnly: true})
+	}
+	if podIOEnabled(exporter) {
+		// The host's cgroup hierarchy and pod logs, as the container only
+		// sees its own cgroup
+		for _, mount := range []struct{ name, hostPath, mountPath string }{
+			{cgroupVolume, "/sys/fs/cgroup", cgroupMountPath},
+			{podLogsVolume, "/var/log/pods", podLogsMountPath},
+		} {
+			volumes = append(volumes, corev1.Volume{
+				Name: mount.name,
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{
+					Path: mount.hostPath,
+					Type: ptr(corev1.HostPathDirectory),
+				}},
+			})
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: mount.name, MountPath: mount.mountPath, ReadOnly: true})
+		}
+	}
+	if projections := remoteWriteSecrets(exporter); len(projections) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name:         remoteWriteVolume,
+			VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: projections}},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: remoteWriteVolume, MountPath: remoteWriteMountPath, ReadOnly: true})
+	}
+
+	daemonSet := &appsv1.DaemonSet{
+		TypeMeta:   metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "DaemonSet"},
+		ObjectMeta: objectMeta(exporter),
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: selectorLabels(exporter)},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: objectLabels(exporter),
+					Annotations: map[string]string{
+						"prometheus.io/scrape": "true",
+						"prometheus.io/port":   operatorConfig.CollectorMetricsPort,
+						"prometheus.io/path":   operatorConfig.CollectorMetricsPath,
+						"prometheus.io/scheme": metricsScheme(exporter),
+						// Pin the privileged SCC the collector service account may use
+						"openshift.io/required-scc": operatorConfig.CollectorSCCName,
+					},
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: operatorConfig.CollectorServiceAccountName,
+					HostNetwork:        true,
+					HostPID:            true,
+					NodeSelector:       nodeSelector,
+					Tolerations:        tolerations,
+					Containers:         []corev1.Container{container},
+					Volumes:            volumes,
+				},
+			},
+		},
+	}
+	daemonSet.Annotations = map[string]string{
+		"openshift.io/description": "Provide EBS volume performance metrics via Prometheus",
+	}
+	return daemonSet
+}
+
+// collectorArgs returns the collector flags of an exporter
+func collectorArgs(exporter *ebsv1alpha1.EBSMetricsExporter) []string {
+	spec := exporter.Spec
+	args := []string{"--port=" + operatorConfig.CollectorMetricsPort}
+
+	if len(spec.Devices.Paths) == 0 {
+		args = append(args, "--all")
+	} else {
+		args = append(args, "--device="+strings.Join(spec.Devices.Paths, ","))
+	}
+	if spec.SampleInterval != nil {
+		args = append(args, "--sample-interval="+spec.SampleInterval.Duration.String())
+	}
+	if spec.TLS != nil {
+		args = append(args,
+			"--tls-cert-file="+tlsMountPath+"/"+corev1.TLSCertKey,
+			"--tls-key-file="+tlsMountPath+"/"+corev1.TLSPrivateKeyKey)
+	}
+	if podIOEnabled(exporter) {
+		args = append(args, "--pod-io",
+			"--cgroup-root="+cgroupMountPath,
+			"--pod-log-directory="+podLogsMountPath)
+	}
+	if ioPressureEnabled(exporter) {
+		args = append(args, "--io-pressure")
+	}
+
+	outputs := spec.Outputs
+	if otlp := outputs.OTLP; otlp != nil {
+		args = append(args, "--otlp-endpoint="+otlp.Endpoint)
+		if otlp.Protocol != "" {
+			args = append(args, "--otlp-protocol="+otlp.Protocol)
+		}
+		if otlp.Insecure {
+			args = append(args, "--otlp-insecure")
+		}
+		if otlp.Interval != nil {
+			args = append(args, "--otlp-interval="+otlp.Interval.Duration.String())
+		}
+	}
+	if statsd := outputs.StatsD; statsd != nil {
+		args = append(args, "--statsd-address="+statsd.Address)
+		if statsd.Prefix != "" {
+			args = append(args, "--statsd-prefix="+statsd.Prefix)
+		}
+		if len(statsd.Tags) > 0 {
+			args = append(args, "--statsd-tags="+keyValues(statsd.Tags))
+		}
+	}
+	if influx := outputs.Influx; influx != nil {
+		args = append(args, "--influx-url="+influx.URL)
+		if influx.Org != "" {
+			args = append(args, "--influx-org="+influx.Org)
+		}
+		if influx.Bucket != "" {
+			args = append(args, "--influx-bucket="+influx.Bucket)
+		}
+	}
+	if remoteWrite := outputs.RemoteWrite; remoteWrite != nil {
+		args = append(args, "--remote-write-url="+remoteWrite.URL)
+		if len(remoteWrite.Labels) > 0 {
+			args = append(args, "--remote-write-labels="+keyValues(remoteWrite.Labels))
+		}
+		if remoteWrite.Username != "" {
+			args = append(args, "--remote-write-username="+remoteWrite.Username)
+		}
+		if remoteWrite.PasswordSecret != nil {
+			args = append(args, "--remote-write-password-file="+remoteWriteMountPath+"/password")
+		}
+		if remoteWrite.BearerTokenSecret != nil {
+			args = append(args, "--remote-write-bearer-token-file="+remoteWriteMountPath+"/bearer-token")
+		}
+	}
+	return args
+}
+
+// collectorEnv returns the collector environment of an exporter. The
+// InfluxDB token is read from $INFLUX_TOKEN so it never appears in the
+// pod spec.
+func collectorEnv(exporter *ebsv1alpha1.EBSMetricsExporter) []corev1.EnvVar {
+	influx := exporter.Spec.Outputs.Influx
+	if influx == nil || influx.TokenSecret == nil {
+		return nil
+	}
+	return []corev1.EnvVar{{
+		Name:      "INFLUX_TOKEN",
+		ValueFrom: &corev1.EnvVarSource{SecretKeyRef: influx.TokenSecret.DeepCopy()},
+	}}
+}
+
+// remoteWriteSecrets projects the remote-write credentials into files
+func remoteWriteSecrets(exporter *ebsv1alpha1.EBSMetricsExporter) []corev1.VolumeProjection {
+	remoteWrite := exporter.Spec.Outputs.RemoteWrite
+	if remoteWrite == nil {
+		return nil
+	}
+
+	var projections []corev1.VolumeProjection
+	for path, selector := range map[string]*corev1.SecretKeySelector{
+		"password":     remoteWrite.PasswordSecret,
+		"bearer-token": remoteWrite.BearerTokenSecret,
+	} {
+		if selector == nil {
+			continue
+		}
+		projections = append(projections, corev1.VolumeProjection{Secret: &corev1.SecretProjection{
+			LocalObjectReference: selector.LocalObjectReference,
+			Items:                []corev1.KeyToPath{{Key: selector.Key, Path: path}},
+		}})
+	}
+	// Keep the pod template stable across reconciles
+	sort.Slice(projections, func(i, j int) bool {
+		return projections[i].Secret.Items[0].Path < projections[j].Secret.Items[0].Path
+	})
+	return projections
+}
+
+// newService returns the headless Service of an exporter's collector pods
+func newService(exporter *ebsv1alpha1.EBSMetricsExporter) *corev1.Service {
+	service := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Service"},
+		ObjectMeta: objectMeta(exporter),
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  selectorLabels(exporter),
+			Ports: []corev1.ServicePort{{
+				Name:       operatorConfig.CollectorMetricsPortName,
+				Port:       int32(mustAtoi(operatorConfig.CollectorMetricsPort)),
+				TargetPort: intstr.FromString(operatorConfig.CollectorMetricsPortName),
+				Protocol:   corev1.ProtocolTCP,
+			}},
+		},
+	}
+	if exporter.Spec.TLS != nil && exporter.Spec.TLS.SecretName == "" {
+		service.Annotations = map[string]string{servingCertAnnotation: tlsSecretName(exporter)}
+	}
+	return service
+}
+
+// newServiceMonitor returns the ServiceMonitor of an exporter's Service
+func newServiceMonitor(exporter *ebsv1alpha1.EBSMetricsExporter) *monitoringv1.ServiceMonitor {
+	endpoint := monitoringv1.Endpoint{
+		Port:     operatorConfig.CollectorMetricsPortName,
+		Interval: "30s",
+		Path:     operatorConfig.CollectorMetricsPath,
+		Scheme:   metricsScheme(exporter),
+		// Keep the namespace and pod labels of the pod I/O metrics
+		// rather than the collector pod's
+		HonorLabels: true,
+	}
+	if exporter.Spec.TLS != nil {
+		endpoint.TLSConfig = &monitoringv1.TLSConfig{
+			SafeTLSConfig: monitoringv1.SafeTLSConfig{ServerName: ServiceServerName(exporter.Name, exporter.Namespace)},
+			CAFile:        serviceCAFile,
+		}
+	}
+
+	return &monitoringv1.ServiceMonitor{
+		TypeMeta:   metav1.TypeMeta{APIVersion: monitoringv1.SchemeGroupVersion.String(), Kind: monitoringv1.ServiceMonitorsKind},
+		ObjectMeta: objectMeta(exporter),
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Selector:  metav1.LabelSelector{MatchLabels: selectorLabels(exporter)},
+			Endpoints: []monitoringv1.Endpoint{endpoint},
+		},
+	}
+}
+
+// ServiceServerName returns the DNS name the service CA certificate of a
+// collector Service is issued for
+func ServiceServerName(service, namespace string) string {
+	return fmt.Sprintf("%s.%s.svc", service, namespace)
+}
+
+// keyValues formats a map as sorted comma-separated key=value pairs
+func keyValues(values map[string]string) string {
+	pairs := make([]string, 0, len(values))
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func mustAtoi(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
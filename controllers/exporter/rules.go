@@ -0,0 +1,361 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	ebsv1alpha1 "github.com/nephomaniac/ebs-metrics-exporter/api/v1alpha1"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/metrics"
+)
+
+// Collector metrics the rules are built from. validateRules checks that the
+// collector still emits them.
+const (
+	volumeIOPSExceededMetric         = "ebs_volume_performance_exceeded_iops_total"
+	volumeThroughputExceededMetric   = "ebs_volume_performance_exceeded_throughput_total"
+	instanceIOPSExceededMetric       = "ebs_instance_performance_exceeded_iops_total"
+	instanceThroughputExceededMetric = "ebs_instance_performance_exceeded_throughput_total"
+	readOpsMetric                    = "ebs_total_read_ops_total"
+	writeOpsMetric                   = "ebs_total_write_ops_total"
+	readBytesMetric                  = "ebs_total_read_bytes_total"
+	writeBytesMetric                 = "ebs_total_write_bytes_total"
+	readLatencyMetric                = "ebs_read_io_latency_microseconds"
+	writeLatencyMetric               = "ebs_write_io_latency_microseconds"
+)
+
+// Recording rules
+const (
+	volumeIOPSRecord                 = "ebs:volume_iops:rate5m"
+	volumeThroughputRecord           = "ebs:volume_throughput_bytes:rate5m"
+	volumeReadLatencyRecord          = "ebs:volume_read_latency_microseconds:avg5m"
+	volumeWriteLatencyRecord         = "ebs:volume_write_latency_microseconds:avg5m"
+	volumeIOPSExceededRecord         = "ebs:volume_performance_exceeded_iops:ratio_rate5m"
+	volumeThroughputExceededRecord   = "ebs:volume_performance_exceeded_throughput:ratio_rate5m"
+	instanceIOPSExceededRecord       = "ebs:instance_performance_exceeded_iops:ratio_rate5m"
+	instanceThroughputExceededRecord = "ebs:instance_performance_exceeded_throughput:ratio_rate5m"
+)
+
+const (
+	rateWindow = "5m"
+
+	severityLabel = "severity"
+)
+
+// errInvalidRules is returned when the rules generated for an exporter are
+// invalid
+var errInvalidRules = errors.New("invalid alert rules")
+
+var (
+	ruleNamePattern   = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	metricNamePattern = regexp.MustCompile(`\bebs_[a-zA-Z0-9_]+`)
+	recordNamePattern = regexp.MustCompile(`\bebs:[a-zA-Z0-9_:]+`)
+)
+
+// alertDefinition describes one of the default alerts
+type alertDefinition struct {
+	alert string
+	rule  func(alerts *ebsv1alpha1.AlertsSpec) ebsv1alpha1.AlertRule
+	// threshold, forDuration and severity are the defaults of the alert
+	threshold   int32
+	forDuration time.Duration
+	severity    string
+	// validThreshold returns an error if a threshold makes no sense for the
+	// alert
+	validThreshold func(threshold int32) error
+	// collectorSeries is set for alerts built on the collector series,
+	// which are only in Prometheus if the ServiceMonitor is enabled
+	collectorSeries bool
+	expr            func(exporter *ebsv1alpha1.EBSMetricsExporter, threshold int32) string
+	summary         string
+	description     string
+}
+
+// alertDefinitions lists the default alerts
+var alertDefinitions = []alertDefinition{
+	{
+		alert:           "EBSVolumeIOPSThrottled",
+		rule:            func(alerts *ebsv1alpha1.AlertsSpec) ebsv1alpha1.AlertRule { return alerts.VolumeIOPSThrottling },
+		threshold:       10,
+		forDuration:     15 * time.Minute,
+		severity:        "warning",
+		validThreshold:  percentThreshold,
+		collectorSeries: true,
+		expr: func(_ *ebsv1alpha1.EBSMetricsExporter, threshold int32) string {
+			return fmt.Sprintf("100 * %s > %d", volumeIOPSExceededRecord, threshold)
+		},
+		summary:     "EBS volume is throttled by its IOPS limit",
+		description: "Volume {{ $labels.volume_id }} ({{ $labels.device }}) exceeded its IOPS limit {{ $value | humanize }}% of the time.",
+	},
+	{
+		alert:           "EBSInstanceThrottled",
+		rule:            func(alerts *ebsv1alpha1.AlertsSpec) ebsv1alpha1.AlertRule { return alerts.InstanceThrottling },
+		threshold:       10,
+		forDuration:     15 * time.Minute,
+		severity:        "warning",
+		validThreshold:  percentThreshold,
+		collectorSeries: true,
+		expr: func(_ *ebsv1alpha1.EBSMetricsExporter, threshold int32) string {
+			return fmt.Sprintf("100 * %s > %d or 100 * %s > %d",
+				instanceIOPSExceededRecord, threshold, instanceThroughputExceededRecord, threshold)
+		},
+		summary:     "EC2 instance is throttled by its EBS limits",
+		description: "The I/O of volume {{ $labels.volume_id }} ({{ $labels.device }}) exceeded the EBS IOPS or throughput limit of its instance {{ $value | humanize }}% of the time.",
+	},
+	{
+		alert:       "EBSVolumeLatencyRegression",
+		rule:        func(alerts *ebsv1alpha1.AlertsSpec) ebsv1alpha1.AlertRule { return alerts.LatencyRegression },
+		threshold:   200,
+		forDuration: 30 * time.Minute,
+		severity:    "warning",
+		validThreshold: func(threshold int32) error {
+			if threshold < 100 {
+				return fmt.Errorf("threshold %d is below 100%% of the previous day's latency", threshold)
+			}
+			return nil
+		},
+		collectorSeries: true,
+		expr: func(_ *ebsv1alpha1.EBSMetricsExporter, threshold int32) string {
+			factor := strconv.FormatFloat(float64(threshold)/100, 'g', -1, 64)
+			return fmt.Sprintf("%s > %s * %s offset 1d or %s > %s * %s offset 1d",
+				volumeReadLatencyRecord, factor, volumeReadLatencyRecord,
+				volumeWriteLatencyRecord, factor, volumeWriteLatencyRecord)
+		},
+		summary:     "EBS volume latency regressed",
+		description: "The average I/O latency of volume {{ $labels.volume_id }} ({{ $labels.device }}) is {{ $value | humanize }}us, much higher than a day earlier.",
+	},
+	{
+		alert:       "EBSMetricsExporterDown",
+		rule:        func(alerts *ebsv1alpha1.AlertsSpec) ebsv1alpha1.AlertRule { return alerts.ExporterDown },
+		threshold:   0,
+		forDuration: 15 * time.Minute,
+		severity:    "warning",
+		expr: func(exporter *ebsv1alpha1.EBSMetricsExporter, threshold int32) string {
+			selector := fmt.Sprintf(`{daemonset=%q,namespace=%q}`, exporter.Name, exporter.Namespace)
+			return fmt.Sprintf("%s%s - %s%s > %d",
+				metrics.CollectorPodsDesiredMetric, selector, metrics.CollectorPodsAvailableMetric, selector, threshold)
+		},
+		summary:     "EBS metrics exporter is missing on nodes",
+		description: "The EBS metrics collector {{ $labels.daemonset }} is not available on {{ $value }} nodes.",
+	},
+}
+
+// alertsEnabled reports whether the exporter wants a PrometheusRule
+func alertsEnabled(exporter *ebsv1alpha1.EBSMetricsExporter) bool {
+	return exporter.Spec.Alerts.Enabled == nil || *exporter.Spec.Alerts.Enabled
+}
+
+// newPrometheusRule returns the recording rules and enabled alerts of an
+// exporter, or an error wrapping errInvalidRules if they are invalid. The
+// rules built on the collector series are left out when the ServiceMonitor
+// is disabled, since Prometheus does not scrape the collectors then. It
+// returns nil if no rule is left.
+func newPrometheusRule(exporter *ebsv1alpha1.EBSMetricsExporter) (*monitoringv1.PrometheusRule, error) {
+	scraped := serviceMonitorEnabled(exporter)
+
+	var alerts []monitoringv1.Rule
+	for _, definition := range alertDefinitions {
+		rule := definition.rule(&exporter.Spec.Alerts)
+		if rule.Enabled != nil && !*rule.Enabled {
+			continue
+		}
+		if definition.collectorSeries && !scraped {
+			continue
+		}
+
+		threshold := definition.threshold
+		if rule.Threshold != nil {
+			threshold = *rule.Threshold
+		}
+		if definition.validThreshold != nil {
+			if err := definition.validThreshold(threshold); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", errInvalidRules, definition.alert, err)
+			}
+		}
+		forDuration := definition.forDuration
+		if rule.For != nil {
+			forDuration = rule.For.Duration
+		}
+		severity := definition.severity
+		if rule.Severity != "" {
+			severity = rule.Severity
+		}
+
+		alerts = append(alerts, monitoringv1.Rule{
+			Alert: definition.alert,
+			Expr:  intstr.FromString(definition.expr(exporter, threshold)),
+			For:   model.Duration(forDuration).String(),
+			Labels: map[string]string{
+				severityLabel: severity,
+			},
+			Annotations: map[string]string{
+				"summary":     definition.summary,
+				"description": definition.description,
+			},
+		})
+	}
+
+	var groups []monitoringv1.RuleGroup
+	if scraped {
+		groups = append(groups, monitoringv1.RuleGroup{
+			Name:  exporter.Name + ".rules",
+			Rules: recordingRules(exporter),
+		})
+	}
+	if len(alerts) > 0 {
+		groups = append(groups, monitoringv1.RuleGroup{
+			Name:  exporter.Name + ".alerts",
+			Rules: alerts,
+		})
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	if err := validateRules(groups); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidRules, err)
+	}
+
+	return &monitoringv1.PrometheusRule{
+		TypeMeta:   metav1.TypeMeta{APIVersion: monitoringv1.SchemeGroupVersion.String(), Kind: monitoringv1.PrometheusRuleKind},
+		ObjectMeta: objectMeta(exporter),
+		Spec:       monitoringv1.PrometheusRuleSpec{Groups: groups},
+	}, nil
+}
+
+// recordingRules returns the rates of the exporter's collector series
+// that the alerts are built on
+func recordingRules(exporter *ebsv1alpha1.EBSMetricsExporter) []monitoringv1.Rule {
+	// Collector series are scraped through the exporter's Service
+	selector := fmt.Sprintf(`{job=%q,namespace=%q}`, exporter.Name, exporter.Namespace)
+	rate := func(metric string) string {
+		return fmt.Sprintf("rate(%s%s[%s])", metric, selector, rateWindow)
+	}
+	// The exceeded-time counters are in microseconds, so their rate divided
+	// by a million is the fraction of the time the limit was exceeded
+	ratio := func(metric string) string {
+		return rate(metric) + " / 1e6"
+	}
+	latency := func(histogram string) string {
+		return rate(histogram+"_sum") + " / " + rate(histogram+"_count")
+	}
+
+	record := func(name, expr string) monitoringv1.Rule {
+		return monitoringv1.Rule{Record: name, Expr: intstr.FromString(expr)}
+	}
+	return []monitoringv1.Rule{
+		record(volumeIOPSRecord, rate(readOpsMetric)+" + "+rate(writeOpsMetric)),
+		record(volumeThroughputRecord, rate(readBytesMetric)+" + "+rate(writeBytesMetric)),
+		record(volumeReadLatencyRecord, latency(readLatencyMetric)),
+		record(volumeWriteLatencyRecord, latency(writeLatencyMetric)),
+		record(volumeIOPSExceededRecord, ratio(volumeIOPSExceededMetric)),
+		record(volumeThroughputExceededRecord, ratio(volumeThroughputExceededMetric)),
+		record(instanceIOPSExceededRecord, ratio(instanceIOPSExceededMetric)),
+		record(instanceThroughputExceededRecord, ratio(instanceThroughputExceededMetric)),
+	}
+}
+
+// validateRules checks the rule names, durations and parentheses, and that
+// every metric the rules reference is emitted by the collector or the
+// operator, or recorded by the rules
+func validateRules(groups []monitoringv1.RuleGroup) error {
+	known := knownMetrics()
+	records := make(map[string]bool)
+	for _, group := range groups {
+		for _, rule := range group.Rules {
+			if rule.Record != "" {
+				records[rule.Record] = true
+			}
+		}
+	}
+
+	var errs []error
+	names := make(map[string]bool)
+	for _, group := range groups {
+		for _, rule := range group.Rules {
+			name := rule.Record + rule.Alert
+			if !ruleNamePattern.MatchString(name) {
+				errs = append(errs, fmt.Errorf("invalid rule name %q", name))
+			}
+			if rule.Alert != "" && names[name] {
+				errs = append(errs, fmt.Errorf("duplicate alert %s", name))
+			}
+			names[name] = true
+
+			if rule.For != "" {
+				if _, err := model.ParseDuration(rule.For); err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid for duration: %w", name, err))
+				}
+			}
+
+			expr := rule.Expr.String()
+			if !balanced(expr) {
+				errs = append(errs, fmt.Errorf("%s: unbalanced brackets in %q", name, expr))
+			}
+			for _, metric := range metricNamePattern.FindAllString(expr, -1) {
+				if !known[metric] {
+					errs = append(errs, fmt.Errorf("%s: metric %s is not emitted by the collector or the operator", name, metric))
+				}
+			}
+			for _, record := range recordNamePattern.FindAllString(expr, -1) {
+				if !records[record] {
+					errs = append(errs, fmt.Errorf("%s: recording rule %s is not defined", name, record))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// knownMetrics returns the metrics the rules may reference: the series
+// served by the collector's EBSCollector, and the operator's collector
+// fleet metrics
+func knownMetrics() map[string]bool {
+	known := map[string]bool{
+		metrics.CollectorPodsDesiredMetric:   true,
+		metrics.CollectorPodsAvailableMetric: true,
+	}
+	for _, name := range collector.NewEBSCollector(nil).SeriesNames() {
+		known[name] = true
+	}
+	return known
+}
+
+// balanced reports whether the parentheses, brackets and braces of an
+// expression are balanced, ignoring quoted strings
+func balanced(expr string) bool {
+	closing := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	var stack []rune
+	quoted := false
+	for _, r := range expr {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case strings.ContainsRune("([{", r):
+			stack = append(stack, r)
+		case closing[r] != 0:
+			if len(stack) == 0 || stack[len(stack)-1] != closing[r] {
+				return false
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return len(stack) == 0 && !quoted
+}
+
+// percentThreshold checks that a threshold is a percentage
+func percentThreshold(threshold int32) error {
+	if threshold > 100 {
+		return fmt.Errorf("threshold %d is above 100%%", threshold)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ebsv1alpha1 "github.com/nephomaniac/ebs-metrics-exporter/api/v1alpha1"
+	operatorConfig "github.com/nephomaniac/ebs-metrics-exporter/config"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/scraper"
+)
+
+// Condition reasons
+const (
+	reasonCollectorsAvailable     = "CollectorsAvailable"
+	reasonCollectorsUnavailable   = "CollectorsUnavailable"
+	reasonNoNodesScheduled        = "NoNodesScheduled"
+	reasonRollingOut              = "RollingOut"
+	reasonRolloutComplete         = "RolloutComplete"
+	reasonApplyFailed             = "ApplyFailed"
+	reasonInvalidAlertRules       = "InvalidAlertRules"
+	reasonCollectorsNotReporting  = "CollectorsNotReporting"
+	reasonCollectorsReporting     = "CollectorsReporting"
+	reasonCollectorsNotScraped    = "CollectorsNotYetScraped"
+	reasonDaemonSetNotFound       = "DaemonSetNotFound"
+	reasonDaemonSetNotYetObserved = "DaemonSetNotYetObserved"
+	reasonUnsupportedNamespace    = "UnsupportedNamespace"
+)
+
+// updateStatus reports the rollout of the exporter's DaemonSet and the
+// health of the collector on every node. reconcileErr, if set, is the error
+// generating or applying the exporter's objects.
+func (r *EBSMetricsExporterReconciler) updateStatus(ctx context.Context, exporter *ebsv1alpha1.EBSMetricsExporter, reconcileErr error) error {
+	daemonSet := &appsv1.DaemonSet{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(exporter), daemonSet); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		daemonSet = nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(exporter.Namespace), client.MatchingLabels(selectorLabels(exporter))); err != nil {
+		return err
+	}
+
+	status := exporter.Status.DeepCopy()
+	status.ObservedGeneration = exporter.Generation
+	status.Nodes = r.nodeStatuses(pods.Items)
+	status.DesiredNodes, status.ReadyNodes, status.ReportingNodes = 0, 0, 0
+	status.NotReportingNodes = nil
+	if daemonSet != nil {
+		status.DesiredNodes = daemonSet.Status.DesiredNumberScheduled
+	}
+
+	// Ready nodes whose collector was not scraped yet are neither reporting
+	// nor failing until their first scrape, at most an aggregation interval
+	// after they became ready. A node without EBS volumes reports an empty
+	// result, so only a failed scrape fails a ready node.
+	var failing, pending []string
+	for _, node := range status.Nodes {
+		if node.Ready {
+			status.ReadyNodes++
+		}
+		result, scraped := r.lastResult(node.Pod)
+		switch {
+		case node.Ready && !scraped:
+			pending = append(pending, node.Name)
+		case node.Ready && result.Err == nil:
+			status.ReportingNodes++
+		default:
+			status.NotReportingNodes = append(status.NotReportingNodes, node.Name)
+			failing = append(failing, node.Name)
+		}
+	}
+
+	setAvailable(status, exporter.Generation, daemonSet)
+	setProgressing(status, exporter.Generation, daemonSet)
+	switch {
+	case errors.Is(reconcileErr, errInvalidRules):
+		setCondition(status, exporter.Generation, ebsv1alpha1.ConditionDegraded, metav1.ConditionTrue,
+			reasonInvalidAlertRules, reconcileErr.Error())
+	case reconcileErr != nil:
+		setCondition(status, exporter.Generation, ebsv1alpha1.ConditionDegraded, metav1.ConditionTrue,
+			reasonApplyFailed, reconcileErr.Error())
+	case len(failing) > 0:
+		setCondition(status, exporter.Generation, ebsv1alpha1.ConditionDegraded, metav1.ConditionTrue,
+			reasonCollectorsNotReporting, "Nodes not reporting: "+strings.Join(failing, ", "))
+	case len(pending) > 0:
+		setCondition(status, exporter.Generation, ebsv1alpha1.ConditionDegraded, metav1.ConditionFalse,
+			reasonCollectorsNotScraped, "Waiting for the first scrape of the collectors on nodes: "+strings.Join(pending, ", "))
+	default:
+		setCondition(status, exporter.Generation, ebsv1alpha1.ConditionDegraded, metav1.ConditionFalse,
+			reasonCollectorsReporting, "Every collector is reporting")
+	}
+
+	if equality.Semantic.DeepEqual(&exporter.Status, status) {
+		return nil
+	}
+	exporter.Status = *status
+	return r.Status().Update(ctx, exporter)
+}
+
+// rejectNamespace reports that an exporter outside the operator namespace is
+// not deployed
+func (r *EBSMetricsExporterReconciler) rejectNamespace(ctx context.Context, exporter *ebsv1alpha1.EBSMetricsExporter) error {
+	status := &ebsv1alpha1.EBSMetricsExporterStatus{
+		ObservedGeneration: exporter.Generation,
+		Conditions:         exporter.Status.DeepCopy().Conditions,
+	}
+	message := fmt.Sprintf("EBSMetricsExporters are only deployed in the %s namespace", operatorConfig.OperatorNamespace)
+	setCondition(status, exporter.Generation, ebsv1alpha1.ConditionAvailable, metav1.ConditionFalse,
+		reasonUnsupportedNamespace, message)
+	setCondition(status, exporter.Generation, ebsv1alpha1.ConditionProgressing, metav1.ConditionFalse,
+		reasonUnsupportedNamespace, message)
+	setCondition(status, exporter.Generation, ebsv1alpha1.ConditionDegraded, metav1.ConditionTrue,
+		reasonUnsupportedNamespace, message)
+
+	if equality.Semantic.DeepEqual(&exporter.Status, status) {
+		return nil
+	}
+	exporter.Status = *status
+	return r.Status().Update(ctx, exporter)
+}
+
+// nodeStatuses summarizes the collector pods by node, preferring the ready
+// pod of a node replaced during a rollout
+func (r *EBSMetricsExporterReconciler) nodeStatuses(pods []corev1.Pod) []ebsv1alpha1.NodeStatus {
+	byNode := make(map[string]ebsv1alpha1.NodeStatus)
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || pod.Spec.NodeName == "" {
+			continue
+		}
+		node := ebsv1alpha1.NodeStatus{
+			Name:  pod.Spec.NodeName,
+			Pod:   pod.Name,
+			Ready: isPodReady(pod),
+		}
+		if r.Scraper != nil {
+			if result, ok := r.Scraper.LastResult(pod.Name); ok {
+				node.Devices = int32(result.Volumes)
+				if !result.LastSampleTime.IsZero() {
+					// Status times have a resolution of a second
+					lastSample := metav1.NewTime(result.LastSampleTime.Truncate(time.Second))
+					node.LastSampleTime = &lastSample
+				}
+				// A failed scrape hides the state of the devices, otherwise
+				// the collector's own query errors are reported
+				if result.Err != nil {
+					node.LastError = result.Err.Error()
+				} else {
+					node.LastError = strings.Join(result.QueryErrors, "; ")
+				}
+			}
+		}
+		if existing, ok := byNode[node.Name]; ok && existing.Ready && !node.Ready {
+			continue
+		}
+		byNode[node.Name] = node
+	}
+
+	nodes := make([]ebsv1alpha1.NodeStatus, 0, len(byNode))
+	for _, node := range byNode {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+// lastResult returns the result of the latest scrape of the pod, and false
+// if it has not been scraped
+func (r *EBSMetricsExporterReconciler) lastResult(pod string) (scraper.Result, bool) {
+	if r.Scraper == nil {
+		return scraper.Result{}, false
+	}
+	return r.Scraper.LastResult(pod)
+}
+
+// setAvailable sets the Available condition from the DaemonSet status
+func setAvailable(status *ebsv1alpha1.EBSMetricsExporterStatus, generation int64, daemonSet *appsv1.DaemonSet) {
+	switch {
+	case daemonSet == nil:
+		setCondition(status, generation, ebsv1alpha1.ConditionAvailable, metav1.ConditionFalse,
+			reasonDaemonSetNotFound, "The collector DaemonSet does not exist")
+	case daemonSet.Status.DesiredNumberScheduled == 0:
+		setCondition(status, generation, ebsv1alpha1.ConditionAvailable, metav1.ConditionFalse,
+			reasonNoNodesScheduled, "The collector is not scheduled to any node")
+	case daemonSet.Status.NumberAvailable < daemonSet.Status.DesiredNumberScheduled:
+		setCondition(status, generation, ebsv1alpha1.ConditionAvailable, metav1.ConditionFalse,
+			reasonCollectorsUnavailable, fmt.Sprintf("%d of %d collectors available",
+				daemonSet.Status.NumberAvailable, daemonSet.Status.DesiredNumberScheduled))
+	default:
+		setCondition(status, generation, ebsv1alpha1.ConditionAvailable, metav1.ConditionTrue,
+			reasonCollectorsAvailable, fmt.Sprintf("%d collectors available", daemonSet.Status.NumberAvailable))
+	}
+}
+
+// setProgressing sets the Progressing condition from the DaemonSet status
+func setProgressing(status *ebsv1alpha1.EBSMetricsExporterStatus, generation int64, daemonSet *appsv1.DaemonSet) {
+	switch {
+	case daemonSet == nil:
+		setCondition(status, generation, ebsv1alpha1.ConditionProgressing, metav1.ConditionTrue,
+			reasonDaemonSetNotFound, "Waiting for the collector DaemonSet to be created")
+	case daemonSet.Status.ObservedGeneration < daemonSet.Generation:
+		setCondition(status, generation, ebsv1alpha1.ConditionProgressing, metav1.ConditionTrue,
+			reasonDaemonSetNotYetObserved, "Waiting for the DaemonSet controller to observe the latest spec")
+	case daemonSet.Status.UpdatedNumberScheduled < daemonSet.Status.DesiredNumberScheduled ||
+		daemonSet.Status.NumberAvailable < daemonSet.Status.DesiredNumberScheduled:
+		setCondition(status, generation, ebsv1alpha1.ConditionProgressing, metav1.ConditionTrue,
+			reasonRollingOut, fmt.Sprintf("%d of %d collectors updated, %d available",
+				daemonSet.Status.UpdatedNumberScheduled, daemonSet.Status.DesiredNumberScheduled,
+				daemonSet.Status.NumberAvailable))
+	default:
+		setCondition(status, generation, ebsv1alpha1.ConditionProgressing, metav1.ConditionFalse,
+			reasonRolloutComplete, "Every collector runs the latest spec")
+	}
+}
+
+// setCondition sets a condition, keeping its transition time if its status
+// did not change
+func setCondition(status *ebsv1alpha1.EBSMetricsExporterStatus, generation int64, conditionType string, conditionStatus metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// isPodReady checks if a pod is ready
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podExporter maps a collector pod to the exporter that created it
+func podExporter(_ context.Context, pod client.Object) []reconcile.Request {
+	labels := pod.GetLabels()
+	if labels[nameLabel] != operatorConfig.DaemonSetName || labels[instanceLabel] == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{
+		Namespace: pod.GetNamespace(),
+		Name:      labels[instanceLabel],
+	}}}
+}
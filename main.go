@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -17,13 +20,26 @@ import (
 
 	customMetrics "github.com/openshift/operator-custom-metrics/pkg/metrics"
 
+	ebsv1alpha1 "github.com/nephomaniac/ebs-metrics-exporter/api/v1alpha1"
 	operatorConfig "github.com/nephomaniac/ebs-metrics-exporter/config"
 	"github.com/nephomaniac/ebs-metrics-exporter/controllers/daemonset"
+	"github.com/nephomaniac/ebs-metrics-exporter/controllers/exporter"
 	"github.com/nephomaniac/ebs-metrics-exporter/pkg/metrics"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/scraper"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/volumes"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	configv1 "github.com/openshift/api/config/v1"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+const (
+	// scrapeTimeout bounds each scrape of a collector pod
+	scrapeTimeout = 10 * time.Second
+
+	// serviceCAFile is the OpenShift service CA bundle mounted into every pod
+	serviceCAFile = "/var/run/secrets/kubernetes.io/serviceaccount/service-ca.crt"
 )
 
 var (
@@ -36,18 +52,39 @@ func init() {
 	utilruntime.Must(appsv1.AddToScheme(scheme))
 	utilruntime.Must(corev1.AddToScheme(scheme))
 	utilruntime.Must(configv1.AddToScheme(scheme))
+	utilruntime.Must(monitoringv1.AddToScheme(scheme))
+	utilruntime.Must(ebsv1alpha1.AddToScheme(scheme))
 }
 
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var aggregationInterval time.Duration
+	var seriesTTL time.Duration
+	var topThrottledVolumes int
+	var collectorCAFile string
+	var mapVolumes bool
 	
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":"+operatorConfig.MetricsPort, "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", operatorConfig.HealthProbeAddress, "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&aggregationInterval, "aggregation-interval", metrics.DefaultAggregationInterval,
+		"How often the collectors are scraped and aggregated. "+
+			"The percentages, checks and rollups cover the interval between two scrapes.")
+	flag.DurationVar(&seriesTTL, "series-ttl", 0,
+		"How long a volume's series are kept after it was last scraped. "+
+			"Defaults to three aggregation intervals.")
+	flag.IntVar(&topThrottledVolumes, "top-throttled-volumes", 10,
+		"Number of volumes in the ebs_cluster_top_throttled_volume list.")
+	flag.StringVar(&collectorCAFile, "collector-ca-file", serviceCAFile,
+		"CA bundle used to verify collectors serving metrics over HTTPS. "+
+			"The system roots are used if the file does not exist.")
+	flag.BoolVar(&mapVolumes, "map-volumes", true,
+		"Export ebs_volume_kubernetes_info, mapping EBS volumes to their PersistentVolumes, claims and pods. "+
+			"Caches the PersistentVolumes and pods of every namespace.")
 	
 	opts := zap.Options{
 		Development: true,
@@ -57,6 +94,12 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if aggregationInterval < daemonset.MinAggregationInterval {
+		setupLog.Error(fmt.Errorf("--aggregation-interval must be at least %s", daemonset.MinAggregationInterval),
+			"invalid aggregation interval", "aggregationInterval", aggregationInterval)
+		os.Exit(1)
+	}
+
 	// Get cluster ID from ClusterVersion
 	clusterId := getClusterID()
 	if clusterId == "" {
@@ -80,6 +123,13 @@ func main() {
 		LeaderElectionID:       "ebs-metrics-exporter-lock",
 		Cache: cache.Options{
 			DefaultNamespaces: watchNamespaces,
+			// Exporters are watched in every namespace, so those created
+			// outside the operator namespace are reported as degraded
+			ByObject: map[client.Object]cache.ByObject{
+				&ebsv1alpha1.EBSMetricsExporter{}: {
+					Namespaces: map[string]cache.Config{cache.AllNamespaces: {}},
+				},
+			},
 		},
 	})
 	if err != nil {
@@ -88,26 +138,60 @@ func main() {
 	}
 
 	// Initialize metrics aggregator
-	metricsAggregator := metrics.GetMetricsAggregator(clusterId)
+	metricsAggregator := metrics.GetMetricsAggregator(clusterId, aggregationInterval)
+	if seriesTTL > 0 {
+		metricsAggregator.SetSeriesTTL(seriesTTL)
+	}
+	metricsAggregator.SetTopThrottledVolumes(topThrottledVolumes)
 
-	// Setup DaemonSet controller
+	// Setup DaemonSet controller, scraping the collector pods into the aggregator
+	collectorScraper := scraper.NewScraper(metricsAggregator, scrapeTimeout, loadCollectorCAs(collectorCAFile))
 	if err = (&daemonset.DaemonSetReconciler{
 		Client:            mgr.GetClient(),
 		Scheme:            mgr.GetScheme(),
 		MetricsAggregator: metricsAggregator,
+		Scraper:           collectorScraper,
 		ClusterId:         clusterId,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DaemonSet")
 		os.Exit(1)
 	}
 
+	// Setup EBSMetricsExporter controller, deploying the collectors and
+	// reporting their scrape results in its status
+	if err = (&exporter.EBSMetricsExporterReconciler{
+		Client:  mgr.GetClient(),
+		Scheme:  mgr.GetScheme(),
+		Scraper: collectorScraper,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "EBSMetricsExporter")
+		os.Exit(1)
+	}
+
+	collectors := metricsAggregator.GetMetrics()
+
+	// Map the volumes to Kubernetes objects from a cluster-wide cache, as the
+	// manager's cache is limited to the operator namespace
+	if mapVolumes {
+		volumeCache, err := volumes.NewCache(mgr.GetConfig(), mgr.GetScheme())
+		if err != nil {
+			setupLog.Error(err, "unable to create volume cache")
+			os.Exit(1)
+		}
+		if err := mgr.Add(volumeCache); err != nil {
+			setupLog.Error(err, "unable to add volume cache")
+			os.Exit(1)
+		}
+		collectors = append(collectors, volumes.NewMapper(volumeCache, clusterId))
+	}
+
 	// Configure custom metrics server
 	setupLog.Info("Configuring custom metrics server", "port", operatorConfig.MetricsPort)
 	metricsConfig := customMetrics.NewBuilder(operatorConfig.OperatorNamespace, operatorConfig.OperatorName).
 		WithPath("/metrics").
 		WithPort(operatorConfig.MetricsPort).
 		WithServiceMonitor().
-		WithCollectors(metricsAggregator.GetMetrics()).
+		WithCollectors(collectors).
 		GetConfig()
 
 	if err := customMetrics.ConfigureMetrics(context.TODO(), *metricsConfig); err != nil {
@@ -132,6 +216,25 @@ func main() {
 	}
 }
 
+// loadCollectorCAs returns the CA bundle collector serving certificates
+// are verified against, or nil to use the system roots
+func loadCollectorCAs(path string) *x509.CertPool {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			setupLog.Error(err, "unable to read collector CA bundle, using the system roots", "path", path)
+		}
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		setupLog.Info("Warning: no certificates in collector CA bundle, using the system roots", "path", path)
+		return nil
+	}
+	return pool
+}
+
 // getClusterID retrieves the cluster ID from the ClusterVersion resource
 func getClusterID() string {
 	_, err := ctrl.GetConfig()
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// HistogramBin is a single latency histogram bin. Bounds are in
+// microseconds.
+type HistogramBin struct {
+	Lower uint64 `json:"lower"`
+	Upper uint64 `json:"upper"`
+	Count uint64 `json:"count"`
+}
+
+// Stats is the JSON representation of the decoded EBSNVMEStats
+type Stats struct {
+	TotalReadOps    uint64 `json:"totalReadOps"`
+	TotalWriteOps   uint64 `json:"totalWriteOps"`
+	TotalReadBytes  uint64 `json:"totalReadBytes"`
+	TotalWriteBytes uint64 `json:"totalWriteBytes"`
+
+	// Times are in microseconds
+	TotalReadTime                      uint64 `json:"totalReadTime"`
+	TotalWriteTime                     uint64 `json:"totalWriteTime"`
+	EBSVolumePerformanceExceededIOPS   uint64 `json:"ebsVolumePerformanceExceededIops"`
+	EBSVolumePerformanceExceededTP     uint64 `json:"ebsVolumePerformanceExceededTp"`
+	EBSInstancePerformanceExceededIOPS uint64 `json:"ebsInstancePerformanceExceededIops"`
+	EBSInstancePerformanceExceededTP   uint64 `json:"ebsInstancePerformanceExceededTp"`
+
+	VolumeQueueLength uint64 `json:"volumeQueueLength"`
+
+	ReadIOLatencyHistogram  []HistogramBin `json:"readIoLatencyHistogram"`
+	WriteIOLatencyHistogram []HistogramBin `json:"writeIoLatencyHistogram"`
+}
+
+// Device is the JSON representation of a monitored device
+type Device struct {
+	Device        string           `json:"device"`
+	Path          string           `json:"path"`
+	VolumeID      string           `json:"volumeId"`
+	EC2DeviceName string           `json:"ec2DeviceName,omitempty"`
+	Model         string           `json:"model,omitempty"`
+	Firmware      string           `json:"firmware,omitempty"`
+	LastSample    *time.Time       `json:"lastSample,omitempty"`
+	LastError     string           `json:"lastError,omitempty"`
+	LastErrorTime *time.Time       `json:"lastErrorTime,omitempty"`
+	Stats         *Stats           `json:"stats,omitempty"`
+	Rates         *collector.Rates `json:"rates,omitempty"`
+}
+
+// DeviceList is the response body of the device list endpoint
+type DeviceList struct {
+	Devices []Device `json:"devices"`
+}
+
+// NewStats converts decoded EBS stats into their JSON representation
+func NewStats(stats *nvme.EBSNVMEStats) *Stats {
+	return &Stats{
+		TotalReadOps:                       stats.TotalReadOps,
+		TotalWriteOps:                      stats.TotalWriteOps,
+		TotalReadBytes:                     stats.TotalReadBytes,
+		TotalWriteBytes:                    stats.TotalWriteBytes,
+		TotalReadTime:                      stats.TotalReadTime,
+		TotalWriteTime:                     stats.TotalWriteTime,
+		EBSVolumePerformanceExceededIOPS:   stats.EBSVolumePerformanceExceededIOPS,
+		EBSVolumePerformanceExceededTP:     stats.EBSVolumePerformanceExceededTP,
+		EBSInstancePerformanceExceededIOPS: stats.EBSInstancePerformanceExceededIOPS,
+		EBSInstancePerformanceExceededTP:   stats.EBSInstancePerformanceExceededTP,
+		VolumeQueueLength:                  stats.VolumeQueueLength,
+		ReadIOLatencyHistogram:             newHistogram(stats.ReadIOLatencyHistogram.Buckets()),
+		WriteIOLatencyHistogram:            newHistogram(stats.WriteIOLatencyHistogram.Buckets()),
+	}
+}
+
+// NewDevice converts a sampler result into its JSON representation
+func NewDevice(sample collector.DeviceSample) Device {
+	device := Device{
+		Device:        sample.DeviceName(),
+		Path:          sample.Device.Path,
+		VolumeID:      sample.Device.VolumeID,
+		EC2DeviceName: sample.Device.EC2DeviceName,
+		Model:         sample.Device.Model,
+		Firmware:      sample.Device.Firmware,
+	}
+
+	if !sample.SampleTime.IsZero() {
+		sampleTime := sample.SampleTime
+		device.LastSample = &sampleTime
+	}
+	if sample.Err != nil {
+		errTime := sample.ErrTime
+		device.LastError = sample.Err.Error()
+		device.LastErrorTime = &errTime
+	}
+	if sample.Stats != nil {
+		device.Stats = NewStats(sample.Stats)
+	}
+	if rates, ok := sample.Rates(); ok {
+		device.Rates = &rates
+	}
+
+	return device
+}
+
+// newHistogram converts histogram buckets into their JSON representation
+func newHistogram(buckets []nvme.HistogramBin) []HistogramBin {
+	bins := make([]HistogramBin, 0, len(buckets))
+	for _, bucket := range buckets {
+		bins = append(bins, HistogramBin{
+			Lower: bucket.Lower,
+			Upper: bucket.Upper,
+			Count: bucket.Count,
+		})
+	}
+	return bins
+}
+
+// Handler serves the device JSON API
+type Handler struct {
+	sampler *collector.Sampler
+	mux     *http.ServeMux
+}
+
+// NewHandler creates a handler serving /api/v1/devices and
+// /api/v1/devices/{device} from the sampler state
+func NewHandler(sampler *collector.Sampler) *Handler {
+	h := &Handler{
+		sampler: sampler,
+		mux:     http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /api/v1/devices", h.listDevices)
+	h.mux.HandleFunc("GET /api/v1/devices/{device}", h.getDevice)
+	return h
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// listDevices returns every monitored device
+func (h *Handler) listDevices(w http.ResponseWriter, r *http.Request) {
+	samples := h.sampler.Samples()
+	list := DeviceList{Devices: make([]Device, 0, len(samples))}
+	for _, sample := range samples {
+		list.Devices = append(list.Devices, NewDevice(sample))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getDevice returns a single device, matched by device name, path or
+// volume ID
+func (h *Handler) getDevice(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("device")
+	for _, sample := range h.sampler.Samples() {
+		if sample.DeviceName() == name || sample.Device.Path == name || sample.Device.VolumeID == name {
+			writeJSON(w, http.StatusOK, NewDevice(sample))
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "device " + name + " not found"})
+}
+
+// writeJSON writes the value as a JSON response
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error writing API response: %v", err)
+	}
+}
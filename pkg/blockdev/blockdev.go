@@ -0,0 +1,193 @@
+package blockdev
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	sysClassBlock = "/sys/class/block"
+	diskByID      = "/dev/disk/by-id"
+	sectorSize    = 512
+)
+
+// DefaultMountInfo is the mountinfo file of the host's init process, which
+// shows host mounts when running with hostPID or directly on the host
+const DefaultMountInfo = "/proc/1/mountinfo"
+
+// Partition describes a partition of a block device
+type Partition struct {
+	Name        string   `json:"name"`
+	SizeBytes   uint64   `json:"sizeBytes"`
+	Mountpoints []string `json:"mountpoints,omitempty"`
+}
+
+// Info describes a block device as seen by the kernel
+type Info struct {
+	Name        string      `json:"name"`
+	DevNumber   string      `json:"devNumber"`
+	SizeBytes   uint64      `json:"sizeBytes"`
+	ByID        []string    `json:"byId,omitempty"`
+	Mountpoints []string    `json:"mountpoints,omitempty"`
+	Partitions  []Partition `json:"partitions,omitempty"`
+}
+
+// DevNumber returns the "major:minor" device number of a block device,
+// e.g. "259:0" for nvme1n1
+func DevNumber(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysClassBlock, name, "dev"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read device number of %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Size returns the size of a block device in bytes
+func Size(name string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(sysClassBlock, name, "size"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read size of %s: %w", name, err)
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size of %s: %w", name, err)
+	}
+	return sectors * sectorSize, nil
+}
+
+// Partitions returns the partition names of a block device
+func Partitions(name string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(sysClassBlock, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions of %s: %w", name, err)
+	}
+
+	var partitions []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sysClassBlock, name, entry.Name(), "partition")); err == nil {
+			partitions = append(partitions, entry.Name())
+		}
+	}
+	sort.Strings(partitions)
+	return partitions, nil
+}
+
+// ByIDLinks maps block device names to their /dev/disk/by-id symlinks
+func ByIDLinks() (map[string][]string, error) {
+	entries, err := os.ReadDir(diskByID)
+	if os.IsNotExist(err) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", diskByID, err)
+	}
+
+	links := make(map[string][]string)
+	for _, entry := range entries {
+		link := filepath.Join(diskByID, entry.Name())
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(target)
+		links[name] = append(links[name], link)
+	}
+	return links, nil
+}
+
+// Mountpoints maps "major:minor" device numbers to their mountpoints, read
+// from a mountinfo file
+func Mountpoints(mountInfoPath string) (map[string][]string, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", mountInfoPath, err)
+	}
+	defer file.Close()
+
+	mounts := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Fields: mount ID, parent ID, major:minor, root, mount point, ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts[fields[2]] = append(mounts[fields[2]], unescapeMountPath(fields[4]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", mountInfoPath, err)
+	}
+	return mounts, nil
+}
+
+// GetInfo collects size, partitions, by-id links and mountpoints of a
+// block device. byID and mounts come from ByIDLinks and Mountpoints so they
+// can be shared across devices.
+func GetInfo(name string, byID, mounts map[string][]string) (*Info, error) {
+	devNumber, err := DevNumber(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := Size(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		Name:        name,
+		DevNumber:   devNumber,
+		SizeBytes:   size,
+		ByID:        byID[name],
+		Mountpoints: mounts[devNumber],
+	}
+
+	partitions, err := Partitions(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, partition := range partitions {
+		partNumber, err := DevNumber(partition)
+		if err != nil {
+			return nil, err
+		}
+		partSize, err := Size(partition)
+		if err != nil {
+			return nil, err
+		}
+		info.Partitions = append(info.Partitions, Partition{
+			Name:        partition,
+			SizeBytes:   partSize,
+			Mountpoints: mounts[partNumber],
+		})
+	}
+
+	return info, nil
+}
+
+// unescapeMountPath decodes the octal escapes used in mountinfo paths
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if value, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
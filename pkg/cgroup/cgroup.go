@@ -0,0 +1,210 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultRoot is the mountpoint of the cgroup v2 hierarchy
+	DefaultRoot = "/sys/fs/cgroup"
+
+	// DefaultPodLogDirectory is the directory where the kubelet keeps the
+	// logs of every pod, in <namespace>_<name>_<uid> directories
+	DefaultPodLogDirectory = "/var/log/pods"
+
+	ioStatFile = "io.stat"
+)
+
+// kubepodsDirs are the parents of the pod cgroups created by the kubelet,
+// with the systemd and the cgroupfs cgroup drivers
+var kubepodsDirs = []string{"kubepods.slice", "kubepods"}
+
+// IOStat is the I/O of a cgroup on a block device, from io.stat
+type IOStat struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+	ReadOps    uint64
+	WriteOps   uint64
+}
+
+// Pod is the cgroup of a pod created by the kubelet
+type Pod struct {
+	UID string
+
+	// Namespace and Name are empty if the pod's log directory was not found
+	Namespace string
+	Name      string
+
+	// Path is the cgroup directory of the pod
+	Path string
+}
+
+// IsV2 reports whether root is a cgroup v2 hierarchy
+func IsV2(root string) bool {
+	_, err := os.Stat(filepath.Join(root, "cgroup.controllers"))
+	return err == nil
+}
+
+// ListPods finds the pod cgroups under root and names them from the pod log
+// directories in logDir. Guaranteed pods are directly under kubepods, the
+// others under its besteffort and burstable children.
+func ListPods(root, logDir string) ([]Pod, error) {
+	names, err := podNames(logDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []Pod
+	for _, dir := range kubepodsDirs {
+		found, err := findPods(filepath.Join(root, dir), 2)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, found...)
+	}
+	for i := range pods {
+		name := names[pods[i].UID]
+		pods[i].Namespace, pods[i].Name = name.namespace, name.name
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Path < pods[j].Path })
+	return pods, nil
+}
+
+// ReadIOStat reads the io.stat file of a cgroup directory, keyed by the
+// "major:minor" number of each device
+func ReadIOStat(dir string) (map[string]IOStat, error) {
+	file, err := os.Open(filepath.Join(dir, ioStatFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stats, err := parseIOStat(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file.Name(), err)
+	}
+	return stats, nil
+}
+
+// parseIOStat parses io.stat lines such as
+// "259:0 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=0 dios=0"
+func parseIOStat(r io.Reader) (map[string]IOStat, error) {
+	stats := make(map[string]IOStat)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var stat IOStat
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s of %s: %w", key, fields[0], err)
+			}
+			switch key {
+			case "rbytes":
+				stat.ReadBytes = n
+			case "wbytes":
+				stat.WriteBytes = n
+			case "rios":
+				stat.ReadOps = n
+			case "wios":
+				stat.WriteOps = n
+			}
+		}
+		stats[fields[0]] = stat
+	}
+	return stats, scanner.Err()
+}
+
+// findPods returns the pod cgroups in dir and, up to depth levels down, in
+// its subdirectories
+func findPods(dir string, depth int) ([]Pod, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+
+	var pods []Pod
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if uid, ok := podUID(entry.Name()); ok {
+			pods = append(pods, Pod{UID: uid, Path: path})
+			continue
+		}
+		if depth > 1 {
+			found, err := findPods(path, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			pods = append(pods, found...)
+		}
+	}
+	return pods, nil
+}
+
+// podUID returns the pod UID of a pod cgroup directory name, which is
+// kubepods-burstable-pod<uid>.slice with dashes replaced by underscores
+// for the systemd driver, and pod<uid> for the cgroupfs driver
+func podUID(name string) (string, bool) {
+	var uid string
+	switch {
+	case strings.HasSuffix(name, ".slice"):
+		unit := strings.TrimSuffix(name, ".slice")
+		unit = unit[strings.LastIndex(unit, "-")+1:]
+		if !strings.HasPrefix(unit, "pod") {
+			return "", false
+		}
+		uid = strings.ReplaceAll(strings.TrimPrefix(unit, "pod"), "_", "-")
+	case strings.HasPrefix(name, "pod"):
+		uid = strings.TrimPrefix(name, "pod")
+	}
+	return uid, uid != ""
+}
+
+type podName struct {
+	namespace string
+	name      string
+}
+
+// podNames maps pod UIDs to their namespace and name, read from the pod log
+// directories. Namespaces and pod names cannot contain underscores, so the
+// directory names split unambiguously.
+func podNames(logDir string) (map[string]podName, error) {
+	entries, err := os.ReadDir(logDir)
+	if os.IsNotExist(err) {
+		return map[string]podName{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", logDir, err)
+	}
+
+	names := make(map[string]podName, len(entries))
+	for _, entry := range entries {
+		parts := strings.Split(entry.Name(), "_")
+		if !entry.IsDir() || len(parts) != 3 {
+			continue
+		}
+		names[parts[2]] = podName{namespace: parts[0], name: parts[1]}
+	}
+	return names, nil
+}
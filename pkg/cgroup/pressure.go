@@ -0,0 +1,103 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NodeIOPressure is the IO pressure stall information of the whole node.
+// It is not namespaced, so a container reads the node's.
+const NodeIOPressure = "/proc/pressure/io"
+
+const ioPressureFile = "io.pressure"
+
+// PressureStat is one line of a pressure stall information file
+type PressureStat struct {
+	// Avg10, Avg60 and Avg300 are the percentage of the last 10, 60 and
+	// 300 seconds during which tasks were stalled
+	Avg10  float64
+	Avg60  float64
+	Avg300 float64
+
+	// Total is the time tasks were stalled, in microseconds
+	Total uint64
+}
+
+// Pressure is the pressure stall information of a resource. Some is the
+// time at least one task was stalled on the resource, Full the time all
+// non-idle tasks were stalled at once.
+type Pressure struct {
+	Some PressureStat
+	Full PressureStat
+}
+
+// ReadPressure reads a pressure stall information file, e.g.
+// NodeIOPressure. The files only exist on kernels with PSI enabled.
+func ReadPressure(path string) (Pressure, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Pressure{}, err
+	}
+	defer file.Close()
+
+	pressure, err := parsePressure(file)
+	if err != nil {
+		return Pressure{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return pressure, nil
+}
+
+// ReadIOPressure reads the io.pressure file of a cgroup directory
+func ReadIOPressure(dir string) (Pressure, error) {
+	return ReadPressure(filepath.Join(dir, ioPressureFile))
+}
+
+// parsePressure parses pressure lines such as
+// "some avg10=1.53 avg60=0.87 avg300=0.30 total=2345678"
+func parsePressure(r io.Reader) (Pressure, error) {
+	var pressure Pressure
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var stat *PressureStat
+		switch fields[0] {
+		case "some":
+			stat = &pressure.Some
+		case "full":
+			stat = &pressure.Full
+		default:
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			var err error
+			switch key {
+			case "avg10":
+				stat.Avg10, err = strconv.ParseFloat(value, 64)
+			case "avg60":
+				stat.Avg60, err = strconv.ParseFloat(value, 64)
+			case "avg300":
+				stat.Avg300, err = strconv.ParseFloat(value, 64)
+			case "total":
+				stat.Total, err = strconv.ParseUint(value, 10, 64)
+			}
+			if err != nil {
+				return Pressure{}, fmt.Errorf("invalid %s %s: %w", fields[0], key, err)
+			}
+		}
+	}
+	return pressure, scanner.Err()
+}
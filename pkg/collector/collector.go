@@ -1,201 +1,149 @@
 package collector
 
 import (
-	"fmt"
-	"log"
-	"strings"
-	"sync"
-
 	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Names of the series reporting the sampling status of each device
+const (
+	sampleTimeMetric = "ebs_collector_last_sample_timestamp_seconds"
+	queryErrorMetric = "ebs_collector_query_error"
+)
+
 // EBSCollector collects EBS volume performance metrics
 type EBSCollector struct {
-	device   *nvme.Device
-	mutex    sync.Mutex
-
-	// Counter metrics
-	volumePerformanceExceededIOPSTotal       *prometheus.Desc
-	volumePerformanceExceededThroughputTotal *prometheus.Desc
-	instancePerformanceExceededIOPSTotal     *prometheus.Desc
-	instancePerformanceExceededThroughputTotal *prometheus.Desc
-	totalReadOpsTotal                        *prometheus.Desc
-	totalWriteOpsTotal                       *prometheus.Desc
-	totalReadBytesTotal                      *prometheus.Desc
-	totalWriteBytesTotal                     *prometheus.Desc
-
-	// Gauge metrics
-	volumeQueueLength                        *prometheus.Desc
+	sampler *Sampler
+
+	// descs holds one descriptor per entry in Metrics
+	descs []*prometheus.Desc
+	// histogramDescs holds one descriptor per entry in LatencyHistograms
+	histogramDescs []*prometheus.Desc
+	// sampleTimeDesc and queryErrorDesc describe the sampling status of
+	// every device, including those whose last query failed
+	sampleTimeDesc *prometheus.Desc
+	queryErrorDesc *prometheus.Desc
+	// series holds the name of every series of the descriptors
+	series []string
 }
 
-// NewEBSCollector creates a new EBS collector
-func NewEBSCollector(devicePath string) (*EBSCollector, error) {
-	device, err := nvme.OpenDevice(devicePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open device: %w", err)
-	}
-
+// NewEBSCollector creates a new EBS collector that reports the latest
+// stats recorded by the sampler
+func NewEBSCollector(sampler *Sampler) *EBSCollector {
 	labels := []string{"device", "volume_id"}
 
+	descs := make([]*prometheus.Desc, 0, len(Metrics))
+	var series []string
+	for _, metric := range Metrics {
+		descs = append(descs, prometheus.NewDesc(metric.Name, metric.Help, labels, nil))
+		series = append(series, metric.Name)
+	}
+	histogramDescs := make([]*prometheus.Desc, 0, len(LatencyHistograms))
+	for _, histogram := range LatencyHistograms {
+		histogramDescs = append(histogramDescs, prometheus.NewDesc(histogram.Name, histogram.Help, labels, nil))
+		series = append(series, histogram.Name+"_bucket", histogram.Name+"_sum", histogram.Name+"_count")
+	}
+	series = append(series, sampleTimeMetric, queryErrorMetric)
+
 	return &EBSCollector{
-		device: device,
-		volumePerformanceExceededIOPSTotal: prometheus.NewDesc(
-			"ebs_volume_performance_exceeded_iops_total",
-			"Total time in microseconds that the EBS volume IOPS limit was exceeded",
-			labels,
-			nil,
-		),
-		volumePerformanceExceededThroughputTotal: prometheus.NewDesc(
-			"ebs_volume_performance_exceeded_throughput_total",
-			"Total time in microseconds that the EBS volume throughput limit was exceeded",
-			labels,
-			nil,
-		),
-		instancePerformanceExceededIOPSTotal: prometheus.NewDesc(
-			"ebs_instance_performance_exceeded_iops_total",
-			"Total time in microseconds that the EC2 instance EBS IOPS limit was exceeded",
-			labels,
-			nil,
-		),
-		instancePerformanceExceededThroughputTotal: prometheus.NewDesc(
-			"ebs_instance_performance_exceeded_throughput_total",
-			"Total time in microseconds that the EC2 instance EBS throughput limit was exceeded",
-			labels,
-			nil,
-		),
-		totalReadOpsTotal: prometheus.NewDesc(
-			"ebs_total_read_ops_total",
-			"Total number of read operations",
-			labels,
-			nil,
-		),
-		totalWriteOpsTotal: prometheus.NewDesc(
-			"ebs_total_write_ops_total",
-			"Total number of write operations",
-			labels,
-			nil,
-		),
-		totalReadBytesTotal: prometheus.NewDesc(
-			"ebs_total_read_bytes_total",
-			"Total bytes read",
-			labels,
-			nil,
-		),
-		totalWriteBytesTotal: prometheus.NewDesc(
-			"ebs_total_write_bytes_total",
-			"Total bytes written",
-			labels,
-			nil,
-		),
-		volumeQueueLength: prometheus.NewDesc(
-			"ebs_volume_queue_length",
-			"Current volume queue length",
-			labels,
-			nil,
-		),
-	}, nil
+		sampler:        sampler,
+		descs:          descs,
+		histogramDescs: histogramDescs,
+		sampleTimeDesc: prometheus.NewDesc(sampleTimeMetric,
+			"Unix time of the last successful query of the device", labels, nil),
+		queryErrorDesc: prometheus.NewDesc(queryErrorMetric,
+			"1 while the last query of the device failed, with the error as a label",
+			append(labels, "error"), nil),
+		series: series,
+	}
+}
+
+// SeriesNames returns the names of the series of every metric reported by
+// Describe, with the _bucket, _sum and _count series of each histogram
+func (c *EBSCollector) SeriesNames() []string {
+	return append([]string(nil), c.series...)
 }
 
 // Describe implements the prometheus.Collector interface
 func (c *EBSCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.volumePerformanceExceededIOPSTotal
-	ch <- c.volumePerformanceExceededThroughputTotal
-	ch <- c.instancePerformanceExceededIOPSTotal
-	ch <- c.instancePerformanceExceededThroughputTotal
-	ch <- c.totalReadOpsTotal
-	ch <- c.totalWriteOpsTotal
-	ch <- c.totalReadBytesTotal
-	ch <- c.totalWriteBytesTotal
-	ch <- c.volumeQueueLength
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+	for _, desc := range c.histogramDescs {
+		ch <- desc
+	}
+	ch <- c.sampleTimeDesc
+	ch <- c.queryErrorDesc
 }
 
 // Collect implements the prometheus.Collector interface
 func (c *EBSCollector) Collect(ch chan<- prometheus.Metric) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	stats, err := c.device.QueryStats()
-	if err != nil {
-		log.Printf("Error querying stats: %v", err)
-		return
+	for _, sample := range c.sampler.Samples() {
+		c.collectStatus(ch, sample)
+		// Devices whose last query failed are skipped until they recover
+		if sample.Stats == nil {
+			continue
+		}
+		c.collectSample(ch, sample)
 	}
+}
+
+// collectStatus emits the sampling status of a device
+func (c *EBSCollector) collectStatus(ch chan<- prometheus.Metric, sample DeviceSample) {
+	labels := []string{sample.DeviceName(), sample.Device.VolumeID}
 
-	deviceName := strings.TrimPrefix(c.device.Path, "/dev/")
-	labels := []string{deviceName, c.device.VolumeID}
-
-	// Counter metrics
-	ch <- prometheus.MustNewConstMetric(
-		c.volumePerformanceExceededIOPSTotal,
-		prometheus.CounterValue,
-		float64(stats.EBSVolumePerformanceExceededIOPS),
-		labels...,
-	)
-
-	ch <- prometheus.MustNewConstMetric(
-		c.volumePerformanceExceededThroughputTotal,
-		prometheus.CounterValue,
-		float64(stats.EBSVolumePerformanceExceededTP),
-		labels...,
-	)
-
-	ch <- prometheus.MustNewConstMetric(
-		c.instancePerformanceExceededIOPSTotal,
-		prometheus.CounterValue,
-		float64(stats.EBSInstancePerformanceExceededIOPS),
-		labels...,
-	)
-
-	ch <- prometheus.MustNewConstMetric(
-		c.instancePerformanceExceededThroughputTotal,
-		prometheus.CounterValue,
-		float64(stats.EBSInstancePerformanceExceededTP),
-		labels...,
-	)
-
-	ch <- prometheus.MustNewConstMetric(
-		c.totalReadOpsTotal,
-		prometheus.CounterValue,
-		float64(stats.TotalReadOps),
-		labels...,
-	)
-
-	ch <- prometheus.MustNewConstMetric(
-		c.totalWriteOpsTotal,
-		prometheus.CounterValue,
-		float64(stats.TotalWriteOps),
-		labels...,
-	)
-
-	ch <- prometheus.MustNewConstMetric(
-		c.totalReadBytesTotal,
-		prometheus.CounterValue,
-		float64(stats.TotalReadBytes),
-		labels...,
-	)
-
-	ch <- prometheus.MustNewConstMetric(
-		c.totalWriteBytesTotal,
-		prometheus.CounterValue,
-		float64(stats.TotalWriteBytes),
-		labels...,
-	)
-
-	// Gauge metrics
-	ch <- prometheus.MustNewConstMetric(
-		c.volumeQueueLength,
-		prometheus.GaugeValue,
-		float64(stats.VolumeQueueLength),
-		labels...,
-	)
+	if !sample.SampleTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.sampleTimeDesc, prometheus.GaugeValue,
+			float64(sample.SampleTime.UnixNano())/1e9, labels...)
+	}
+	if sample.Err != nil {
+		ch <- prometheus.MustNewConstMetric(c.queryErrorDesc, prometheus.GaugeValue,
+			1, append(labels, sample.Err.Error())...)
+	}
 }
 
-// GetDevice returns the device path
-func (c *EBSCollector) GetDevice() string {
-	return c.device.Path
+// collectSample emits the metrics for a single device sample
+func (c *EBSCollector) collectSample(ch chan<- prometheus.Metric, sample DeviceSample) {
+	labels := []string{sample.DeviceName(), sample.Device.VolumeID}
+
+	for i, metric := range Metrics {
+		valueType := prometheus.GaugeValue
+		if metric.Counter {
+			valueType = prometheus.CounterValue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			c.descs[i],
+			valueType,
+			float64(metric.Value(sample.Stats)),
+			labels...,
+		)
+	}
+
+	for i, histogram := range LatencyHistograms {
+		bins := histogram.Histogram(sample.Stats)
+		if len(bins) == 0 {
+			continue
+		}
+		count, buckets := cumulativeBuckets(bins)
+		ch <- prometheus.MustNewConstHistogram(
+			c.histogramDescs[i],
+			count,
+			float64(histogram.Sum(sample.Stats)),
+			buckets,
+			labels...,
+		)
+	}
 }
 
-// GetVolumeID returns the volume ID
-func (c *EBSCollector) GetVolumeID() string {
-	return c.device.VolumeID
+// cumulativeBuckets converts the bins of a device histogram to cumulative
+// buckets keyed by the upper bound of each bin, and returns the total count
+func cumulativeBuckets(bins []nvme.HistogramBin) (uint64, map[float64]uint64) {
+	buckets := make(map[float64]uint64, len(bins))
+	var count uint64
+	for _, bin := range bins {
+		count += bin.Count
+		buckets[float64(bin.Upper)] = count
+	}
+	return count, buckets
 }
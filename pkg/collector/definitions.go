@@ -0,0 +1,118 @@
+package collector
+
+import (
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// Metric units, using the UCUM notation expected by OpenTelemetry
+const (
+	UnitMicroseconds = "us"
+	UnitBytes        = "By"
+	UnitOperations   = "{operation}"
+	UnitRequests     = "{request}"
+)
+
+// MetricDefinition describes a metric exported for every device. It is
+// shared by the Prometheus collector and the push outputs so that every
+// output uses the same names and semantics.
+type MetricDefinition struct {
+	// Name is the Prometheus metric name. Counter names end in _total.
+	Name    string
+	Help    string
+	Unit    string
+	Counter bool
+	Value   func(stats *nvme.EBSNVMEStats) uint64
+}
+
+// Metrics lists the metrics exported for every device
+var Metrics = []MetricDefinition{
+	{
+		Name:    "ebs_volume_performance_exceeded_iops_total",
+		Help:    "Total time in microseconds that the EBS volume IOPS limit was exceeded",
+		Unit:    UnitMicroseconds,
+		Counter: true,
+		Value:   func(stats *nvme.EBSNVMEStats) uint64 { return stats.EBSVolumePerformanceExceededIOPS },
+	},
+	{
+		Name:    "ebs_volume_performance_exceeded_throughput_total",
+		Help:    "Total time in microseconds that the EBS volume throughput limit was exceeded",
+		Unit:    UnitMicroseconds,
+		Counter: true,
+		Value:   func(stats *nvme.EBSNVMEStats) uint64 { return stats.EBSVolumePerformanceExceededTP },
+	},
+	{
+		Name:    "ebs_instance_performance_exceeded_iops_total",
+		Help:    "Total time in microseconds that the EC2 instance EBS IOPS limit was exceeded",
+		Unit:    UnitMicroseconds,
+		Counter: true,
+		Value:   func(stats *nvme.EBSNVMEStats) uint64 { return stats.EBSInstancePerformanceExceededIOPS },
+	},
+	{
+		Name:    "ebs_instance_performance_exceeded_throughput_total",
+		Help:    "Total time in microseconds that the EC2 instance EBS throughput limit was exceeded",
+		Unit:    UnitMicroseconds,
+		Counter: true,
+		Value:   func(stats *nvme.EBSNVMEStats) uint64 { return stats.EBSInstancePerformanceExceededTP },
+	},
+	{
+		Name:    "ebs_total_read_ops_total",
+		Help:    "Total number of read operations",
+		Unit:    UnitOperations,
+		Counter: true,
+		Value:   func(stats *nvme.EBSNVMEStats) uint64 { return stats.TotalReadOps },
+	},
+	{
+		Name:    "ebs_total_write_ops_total",
+		Help:    "Total number of write operations",
+		Unit:    UnitOperations,
+		Counter: true,
+		Value:   func(stats *nvme.EBSNVMEStats) uint64 { return stats.TotalWriteOps },
+	},
+	{
+		Name:    "ebs_total_read_bytes_total",
+		Help:    "Total bytes read",
+		Unit:    UnitBytes,
+		Counter: true,
+		Value:   func(stats *nvme.EBSNVMEStats) uint64 { return stats.TotalReadBytes },
+	},
+	{
+		Name:    "ebs_total_write_bytes_total",
+		Help:    "Total bytes written",
+		Unit:    UnitBytes,
+		Counter: true,
+		Value:   func(stats *nvme.EBSNVMEStats) uint64 { return stats.TotalWriteBytes },
+	},
+	{
+		Name:  "ebs_volume_queue_length",
+		Help:  "Current volume queue length",
+		Unit:  UnitRequests,
+		Value: func(stats *nvme.EBSNVMEStats) uint64 { return stats.VolumeQueueLength },
+	},
+}
+
+// LatencyHistogramDefinition describes a latency histogram exported for
+// every device. Sum returns the total time of the histogram's I/Os, in
+// microseconds.
+type LatencyHistogramDefinition struct {
+	Name      string
+	Help      string
+	Histogram func(stats *nvme.EBSNVMEStats) []nvme.HistogramBin
+	Sum       func(stats *nvme.EBSNVMEStats) uint64
+}
+
+// LatencyHistograms lists the latency histograms exported for every
+// device. Bin bounds are in microseconds.
+var LatencyHistograms = []LatencyHistogramDefinition{
+	{
+		Name:      "ebs_read_io_latency_microseconds",
+		Help:      "Read I/O latency histogram in microseconds",
+		Histogram: func(stats *nvme.EBSNVMEStats) []nvme.HistogramBin { return stats.ReadIOLatencyHistogram.Buckets() },
+		Sum:       func(stats *nvme.EBSNVMEStats) uint64 { return stats.TotalReadTime },
+	},
+	{
+		Name:      "ebs_write_io_latency_microseconds",
+		Help:      "Write I/O latency histogram in microseconds",
+		Histogram: func(stats *nvme.EBSNVMEStats) []nvme.HistogramBin { return stats.WriteIOLatencyHistogram.Buckets() },
+		Sum:       func(stats *nvme.EBSNVMEStats) uint64 { return stats.TotalWriteTime },
+	},
+}
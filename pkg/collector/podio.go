@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/blockdev"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/cgroup"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PodIOMetricDefinition describes a metric exported for every pod doing I/O
+// on a device
+type PodIOMetricDefinition struct {
+	Name  string
+	Help  string
+	Unit  string
+	Value func(stat cgroup.IOStat) uint64
+}
+
+// PodIOMetrics lists the metrics exported for every pod and device
+var PodIOMetrics = []PodIOMetricDefinition{
+	{
+		Name:  "ebs_pod_read_ops_total",
+		Help:  "Total number of read operations of a pod on the EBS volume",
+		Unit:  UnitOperations,
+		Value: func(stat cgroup.IOStat) uint64 { return stat.ReadOps },
+	},
+	{
+		Name:  "ebs_pod_write_ops_total",
+		Help:  "Total number of write operations of a pod on the EBS volume",
+		Unit:  UnitOperations,
+		Value: func(stat cgroup.IOStat) uint64 { return stat.WriteOps },
+	},
+	{
+		Name:  "ebs_pod_read_bytes_total",
+		Help:  "Total bytes read by a pod from the EBS volume",
+		Unit:  UnitBytes,
+		Value: func(stat cgroup.IOStat) uint64 { return stat.ReadBytes },
+	},
+	{
+		Name:  "ebs_pod_write_bytes_total",
+		Help:  "Total bytes written by a pod to the EBS volume",
+		Unit:  UnitBytes,
+		Value: func(stat cgroup.IOStat) uint64 { return stat.WriteBytes },
+	},
+}
+
+// PodIOCollector attributes the I/O on the monitored devices to the pods of
+// the node, read from the io.stat file of every pod cgroup on each scrape.
+// The kernel accounts the I/O of partitions to their disk, so the stats
+// cover every partition of a device. The IO pressure of the pods doing I/O
+// on the devices is read from their io.pressure, where the kernel has PSI
+// enabled.
+type PodIOCollector struct {
+	cgroupRoot string
+	podLogDir  string
+
+	// devices maps the "major:minor" number of every device to the device
+	devices map[string]*nvme.Device
+
+	descs       []*prometheus.Desc
+	waitingDesc *prometheus.Desc
+	stalledDesc *prometheus.Desc
+}
+
+// NewPodIOCollector creates a collector for the pods under the cgroup v2
+// hierarchy at cgroupRoot, named from the kubelet pod log directory
+// podLogDir. Devices without a block device number, e.g. replayed ones,
+// are skipped.
+func NewPodIOCollector(devices []*nvme.Device, cgroupRoot, podLogDir string) *PodIOCollector {
+	labels := []string{"device", "volume_id", "namespace", "pod", "pod_uid"}
+
+	descs := make([]*prometheus.Desc, 0, len(PodIOMetrics))
+	for _, metric := range PodIOMetrics {
+		descs = append(descs, prometheus.NewDesc(metric.Name, metric.Help, labels, nil))
+	}
+
+	numbers := make(map[string]*nvme.Device, len(devices))
+	for _, device := range devices {
+		number, err := blockdev.DevNumber(filepath.Base(device.Path))
+		if err != nil {
+			log.Printf("Not attributing pod I/O on %s: %v", device.Path, err)
+			continue
+		}
+		numbers[number] = device
+	}
+
+	podLabels := []string{"namespace", "pod", "pod_uid"}
+	return &PodIOCollector{
+		cgroupRoot: cgroupRoot,
+		podLogDir:  podLogDir,
+		devices:    numbers,
+		descs:      descs,
+		waitingDesc: prometheus.NewDesc("ebs_pod_io_pressure_waiting_seconds_total",
+			"Total time in seconds that at least one task of a pod was stalled on IO", podLabels, nil),
+		stalledDesc: prometheus.NewDesc("ebs_pod_io_pressure_stalled_seconds_total",
+			"Total time in seconds that all non-idle tasks of a pod were stalled on IO", podLabels, nil),
+	}
+}
+
+// Describe implements the prometheus.Collector interface
+func (c *PodIOCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+	ch <- c.waitingDesc
+	ch <- c.stalledDesc
+}
+
+// Collect implements the prometheus.Collector interface
+func (c *PodIOCollector) Collect(ch chan<- prometheus.Metric) {
+	if len(c.devices) == 0 {
+		return
+	}
+
+	pods, err := cgroup.ListPods(c.cgroupRoot, c.podLogDir)
+	if err != nil {
+		log.Printf("Error listing pod cgroups: %v", err)
+		return
+	}
+	for _, pod := range pods {
+		// Pods without a log directory cannot be named, and an empty
+		// pod label would be replaced with the collector's when scraped
+		if pod.Name == "" {
+			continue
+		}
+		// Pods deleted since they were listed have no io.stat anymore
+		stats, err := cgroup.ReadIOStat(pod.Path)
+		if err != nil {
+			continue
+		}
+		monitored := false
+		for number, stat := range stats {
+			device, ok := c.devices[number]
+			if !ok {
+				continue
+			}
+			c.collectPod(ch, device, pod, stat)
+			monitored = true
+		}
+		if monitored {
+			c.collectPressure(ch, pod)
+		}
+	}
+}
+
+// collectPressure emits the IO pressure of a pod, if the kernel reports it
+func (c *PodIOCollector) collectPressure(ch chan<- prometheus.Metric, pod cgroup.Pod) {
+	pressure, err := cgroup.ReadIOPressure(pod.Path)
+	if err != nil {
+		return
+	}
+	labels := []string{pod.Namespace, pod.Name, pod.UID}
+	ch <- prometheus.MustNewConstMetric(c.waitingDesc, prometheus.CounterValue, microsecondsToSeconds(pressure.Some.Total), labels...)
+	ch <- prometheus.MustNewConstMetric(c.stalledDesc, prometheus.CounterValue, microsecondsToSeconds(pressure.Full.Total), labels...)
+}
+
+// collectPod emits the metrics of a pod's I/O on a device
+func (c *PodIOCollector) collectPod(ch chan<- prometheus.Metric, device *nvme.Device, pod cgroup.Pod, stat cgroup.IOStat) {
+	labels := []string{DeviceSample{Device: device}.DeviceName(), device.VolumeID, pod.Namespace, pod.Name, pod.UID}
+
+	for i, metric := range PodIOMetrics {
+		ch <- prometheus.MustNewConstMetric(
+			c.descs[i],
+			prometheus.CounterValue,
+			float64(metric.Value(stat)),
+			labels...,
+		)
+	}
+}
@@ -0,0 +1,210 @@
+package collector
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/cgroup"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Limits that high IO pressure is correlated with
+const (
+	limitAny      = "any"
+	limitVolume   = "volume"
+	limitInstance = "instance"
+)
+
+var pressureLimits = []string{limitAny, limitVolume, limitInstance}
+
+// pressureInterval is a sampling interval with high IO pressure, and the
+// limits exceeded by the monitored volumes during it
+type pressureInterval struct {
+	end      time.Time
+	volume   bool
+	instance bool
+}
+
+// throttled reports whether the given limit was exceeded during the interval
+func (i pressureInterval) throttled(limit string) bool {
+	switch limit {
+	case limitVolume:
+		return i.volume
+	case limitInstance:
+		return i.instance
+	default:
+		return i.volume || i.instance
+	}
+}
+
+// PressureCorrelator correlates the IO pressure of the node with the
+// throttling of the monitored volumes. As a Sink it classifies every
+// sampling interval in which tasks were stalled on IO for more than the
+// threshold percentage of the interval by whether a volume or instance
+// limit was exceeded during it. As a prometheus.Collector it exports the
+// node's IO pressure and these intervals.
+//
+// A low throttled ratio means IO stalls come from something other than the
+// EBS limits, e.g. CPU throttling or contention on local devices.
+type PressureCorrelator struct {
+	path      string
+	threshold float64
+	window    time.Duration
+
+	waitingDesc   *prometheus.Desc
+	stalledDesc   *prometheus.Desc
+	highDesc      *prometheus.Desc
+	throttledDesc *prometheus.Desc
+	ratioDesc     *prometheus.Desc
+
+	mutex     sync.Mutex
+	last      *cgroup.Pressure
+	lastTime  time.Time
+	high      uint64
+	throttled map[string]uint64
+	// recent holds the high pressure intervals that ended within the window
+	recent []pressureInterval
+}
+
+// NewPressureCorrelator creates a correlator reading the node's IO pressure
+// from path. threshold is the percentage of an interval tasks must have
+// been stalled on IO for it to count as high pressure, and window the
+// period the throttled ratio is computed over.
+func NewPressureCorrelator(path string, threshold float64, window time.Duration) *PressureCorrelator {
+	return &PressureCorrelator{
+		path:      path,
+		threshold: threshold,
+		window:    window,
+		waitingDesc: prometheus.NewDesc("ebs_io_pressure_waiting_seconds_total",
+			"Total time in seconds that at least one task of the node was stalled on IO", nil, nil),
+		stalledDesc: prometheus.NewDesc("ebs_io_pressure_stalled_seconds_total",
+			"Total time in seconds that all non-idle tasks of the node were stalled on IO", nil, nil),
+		highDesc: prometheus.NewDesc("ebs_io_pressure_high_intervals_total",
+			"Total number of sampling intervals with high IO pressure on the node", nil, nil),
+		throttledDesc: prometheus.NewDesc("ebs_io_pressure_throttled_intervals_total",
+			"Total number of sampling intervals with high IO pressure during which a monitored volume exceeded a volume or instance limit",
+			[]string{"limit"}, nil),
+		ratioDesc: prometheus.NewDesc("ebs_io_pressure_throttled_ratio",
+			"Fraction of the recent sampling intervals with high IO pressure during which a monitored volume exceeded a volume or instance limit",
+			[]string{"limit"}, nil),
+		throttled: make(map[string]uint64, len(pressureLimits)),
+	}
+}
+
+// Name implements the Sink interface
+func (p *PressureCorrelator) Name() string {
+	return "io-pressure"
+}
+
+// Write implements the Sink interface. It reads the node's IO pressure
+// after every sampling pass, so each interval between two passes is
+// compared with the rates of the samples taken at its end.
+func (p *PressureCorrelator) Write(ctx context.Context, samples []DeviceSample) error {
+	pressure, err := cgroup.ReadPressure(p.path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	previous, previousTime := p.last, p.lastTime
+	p.last, p.lastTime = &pressure, now
+	if previous == nil {
+		return nil
+	}
+	intervalMicros := float64(now.Sub(previousTime).Microseconds())
+	if intervalMicros <= 0 {
+		return nil
+	}
+	waiting := counterDelta(previous.Some.Total, pressure.Some.Total)
+	if waiting/intervalMicros*100 <= p.threshold {
+		return nil
+	}
+
+	interval := pressureInterval{end: now}
+	for _, sample := range samples {
+		rates, ok := sample.Rates()
+		if !ok {
+			continue
+		}
+		interval.volume = interval.volume || rates.VolumeThrottled()
+		interval.instance = interval.instance || rates.InstanceThrottled()
+	}
+
+	p.high++
+	for _, limit := range pressureLimits {
+		if interval.throttled(limit) {
+			p.throttled[limit]++
+		}
+	}
+	p.recent = append(p.expire(now), interval)
+	return nil
+}
+
+// Close implements the Sink interface
+func (p *PressureCorrelator) Close() error {
+	return nil
+}
+
+// expire drops the recent intervals that ended before the window
+func (p *PressureCorrelator) expire(now time.Time) []pressureInterval {
+	cutoff := now.Add(-p.window)
+	for i, interval := range p.recent {
+		if interval.end.After(cutoff) {
+			return p.recent[i:]
+		}
+	}
+	return p.recent[:0]
+}
+
+// Describe implements the prometheus.Collector interface
+func (p *PressureCorrelator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.waitingDesc
+	ch <- p.stalledDesc
+	ch <- p.highDesc
+	ch <- p.throttledDesc
+	ch <- p.ratioDesc
+}
+
+// Collect implements the prometheus.Collector interface
+func (p *PressureCorrelator) Collect(ch chan<- prometheus.Metric) {
+	if pressure, err := cgroup.ReadPressure(p.path); err != nil {
+		log.Printf("Error reading IO pressure: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(p.waitingDesc, prometheus.CounterValue, microsecondsToSeconds(pressure.Some.Total))
+		ch <- prometheus.MustNewConstMetric(p.stalledDesc, prometheus.CounterValue, microsecondsToSeconds(pressure.Full.Total))
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(p.highDesc, prometheus.CounterValue, float64(p.high))
+	for _, limit := range pressureLimits {
+		ch <- prometheus.MustNewConstMetric(p.throttledDesc, prometheus.CounterValue, float64(p.throttled[limit]), limit)
+	}
+
+	// The ratio is undefined without an interval of high pressure in the
+	// window
+	recent := p.expire(time.Now())
+	if len(recent) == 0 {
+		return
+	}
+	for _, limit := range pressureLimits {
+		var throttled int
+		for _, interval := range recent {
+			if interval.throttled(limit) {
+				throttled++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(p.ratioDesc, prometheus.GaugeValue, float64(throttled)/float64(len(recent)), limit)
+	}
+}
+
+// microsecondsToSeconds converts a pressure stall total to seconds
+func microsecondsToSeconds(micros uint64) float64 {
+	return float64(micros) / 1e6
+}
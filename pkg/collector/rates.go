@@ -0,0 +1,110 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// Rates holds per-second rates and percentages derived from two
+// consecutive stats samples
+type Rates struct {
+	IntervalSeconds float64 `json:"intervalSeconds"`
+
+	ReadIOPS            float64 `json:"readIops"`
+	WriteIOPS           float64 `json:"writeIops"`
+	ReadBytesPerSecond  float64 `json:"readBytesPerSecond"`
+	WriteBytesPerSecond float64 `json:"writeBytesPerSecond"`
+
+	// Average latencies are in microseconds
+	AvgReadLatency  float64 `json:"avgReadLatencyMicroseconds"`
+	AvgWriteLatency float64 `json:"avgWriteLatencyMicroseconds"`
+
+	// Exceeded percentages are the share of the interval during which the
+	// volume or instance limit was exceeded
+	VolumeIOPSExceededPercent         float64 `json:"volumeIopsExceededPercent"`
+	VolumeThroughputExceededPercent   float64 `json:"volumeThroughputExceededPercent"`
+	InstanceIOPSExceededPercent       float64 `json:"instanceIopsExceededPercent"`
+	InstanceThroughputExceededPercent float64 `json:"instanceThroughputExceededPercent"`
+
+	// Exceeded durations are the time spent over the limit during the
+	// interval, in microseconds
+	VolumeIOPSExceeded         float64 `json:"volumeIopsExceededMicroseconds"`
+	VolumeThroughputExceeded   float64 `json:"volumeThroughputExceededMicroseconds"`
+	InstanceIOPSExceeded       float64 `json:"instanceIopsExceededMicroseconds"`
+	InstanceThroughputExceeded float64 `json:"instanceThroughputExceededMicroseconds"`
+}
+
+// Throttled reports whether any volume or instance limit was exceeded
+// during the interval
+func (r Rates) Throttled() bool {
+	return r.VolumeThrottled() || r.InstanceThrottled()
+}
+
+// VolumeThrottled reports whether a volume limit was exceeded during the
+// interval
+func (r Rates) VolumeThrottled() bool {
+	return r.VolumeIOPSExceeded > 0 || r.VolumeThroughputExceeded > 0
+}
+
+// InstanceThrottled reports whether an instance limit was exceeded during
+// the interval
+func (r Rates) InstanceThrottled() bool {
+	return r.InstanceIOPSExceeded > 0 || r.InstanceThroughputExceeded > 0
+}
+
+// ComputeRates derives rates from two stats samples taken interval apart.
+// Counters that went backwards, e.g. after a volume was re-attached, are
+// treated as having restarted from zero.
+func ComputeRates(previous, current *nvme.EBSNVMEStats, interval time.Duration) Rates {
+	seconds := interval.Seconds()
+	rates := Rates{IntervalSeconds: seconds}
+	if seconds <= 0 {
+		return rates
+	}
+
+	readOps := counterDelta(previous.TotalReadOps, current.TotalReadOps)
+	writeOps := counterDelta(previous.TotalWriteOps, current.TotalWriteOps)
+	rates.ReadIOPS = readOps / seconds
+	rates.WriteIOPS = writeOps / seconds
+	rates.ReadBytesPerSecond = counterDelta(previous.TotalReadBytes, current.TotalReadBytes) / seconds
+	rates.WriteBytesPerSecond = counterDelta(previous.TotalWriteBytes, current.TotalWriteBytes) / seconds
+
+	if readOps > 0 {
+		rates.AvgReadLatency = counterDelta(previous.TotalReadTime, current.TotalReadTime) / readOps
+	}
+	if writeOps > 0 {
+		rates.AvgWriteLatency = counterDelta(previous.TotalWriteTime, current.TotalWriteTime) / writeOps
+	}
+
+	rates.VolumeIOPSExceeded = counterDelta(previous.EBSVolumePerformanceExceededIOPS, current.EBSVolumePerformanceExceededIOPS)
+	rates.VolumeThroughputExceeded = counterDelta(previous.EBSVolumePerformanceExceededTP, current.EBSVolumePerformanceExceededTP)
+	rates.InstanceIOPSExceeded = counterDelta(previous.EBSInstancePerformanceExceededIOPS, current.EBSInstancePerformanceExceededIOPS)
+	rates.InstanceThroughputExceeded = counterDelta(previous.EBSInstancePerformanceExceededTP, current.EBSInstancePerformanceExceededTP)
+
+	intervalMicros := float64(interval.Microseconds())
+	rates.VolumeIOPSExceededPercent = exceededPercent(rates.VolumeIOPSExceeded, intervalMicros)
+	rates.VolumeThroughputExceededPercent = exceededPercent(rates.VolumeThroughputExceeded, intervalMicros)
+	rates.InstanceIOPSExceededPercent = exceededPercent(rates.InstanceIOPSExceeded, intervalMicros)
+	rates.InstanceThroughputExceededPercent = exceededPercent(rates.InstanceThroughputExceeded, intervalMicros)
+
+	return rates
+}
+
+// counterDelta returns the increase of a counter between two samples
+func counterDelta(previous, current uint64) float64 {
+	if current < previous {
+		return float64(current)
+	}
+	return float64(current - previous)
+}
+
+// exceededPercent converts time over a limit into a percentage of the
+// interval, capped at 100
+func exceededPercent(exceededMicros, intervalMicros float64) float64 {
+	percent := exceededMicros / intervalMicros * 100
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
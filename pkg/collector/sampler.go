@@ -0,0 +1,218 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// DeviceSample holds the most recent sampling outcome for a device
+type DeviceSample struct {
+	Device *nvme.Device
+	Stats  *nvme.EBSNVMEStats
+
+	// SampleTime is the time of the last successful query, as read from
+	// the sampler's clock
+	SampleTime time.Time
+
+	// QueryTime is the wall-clock time of the last successful query. It
+	// differs from SampleTime only when the sampler has a replay clock.
+	QueryTime time.Time
+
+	// PrevStats and PrevSampleTime hold the successful sample before the
+	// latest one and are used to derive rates
+	PrevStats      *nvme.EBSNVMEStats
+	PrevSampleTime time.Time
+
+	// Err is the error from the last query, nil if it succeeded
+	Err     error
+	ErrTime time.Time
+}
+
+// DeviceName returns the device name without the /dev/ prefix
+func (s DeviceSample) DeviceName() string {
+	return strings.TrimPrefix(s.Device.Path, "/dev/")
+}
+
+// Rates returns the rates derived from the latest two successful samples.
+// The second return value is false until two consecutive samples exist.
+func (s DeviceSample) Rates() (Rates, bool) {
+	if s.Stats == nil || s.PrevStats == nil {
+		return Rates{}, false
+	}
+	return ComputeRates(s.PrevStats, s.Stats, s.SampleTime.Sub(s.PrevSampleTime)), true
+}
+
+// Sampler periodically queries EBS stats from a set of devices and keeps
+// the latest result for each of them
+type Sampler struct {
+	devices  []*nvme.Device
+	interval time.Duration
+	started  time.Time
+	clock    func() time.Time
+	sinks    []Sink
+
+	mutex    sync.RWMutex
+	samples  map[string]*DeviceSample
+	lastTick time.Time
+}
+
+// NewSampler creates a new sampler for the given devices
+func NewSampler(devices []*nvme.Device, interval time.Duration) *Sampler {
+	samples := make(map[string]*DeviceSample, len(devices))
+	for _, device := range devices {
+		samples[device.Path] = &DeviceSample{Device: device}
+	}
+
+	return &Sampler{
+		devices:  devices,
+		interval: interval,
+		started:  time.Now(),
+		clock:    time.Now,
+		samples:  samples,
+	}
+}
+
+// SetClock sets the clock used to stamp samples. Replayed devices use the
+// recording time so that rates match the recorded ones at any playback
+// speed. It must be called before Run.
+func (s *Sampler) SetClock(clock func() time.Time) {
+	s.clock = clock
+}
+
+// AddSink registers a sink that receives the samples after every pass.
+// Sinks must be added before Run is called.
+func (s *Sampler) AddSink(sink Sink) {
+	s.sinks = append(s.sinks, sink)
+}
+
+// Run samples all devices once immediately and then on every interval
+// until the context is cancelled
+func (s *Sampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	s.SampleOnce(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.SampleOnce(ctx)
+		}
+	}
+}
+
+// SampleOnce queries every device, records the results and delivers them
+// to the registered sinks
+func (s *Sampler) SampleOnce(ctx context.Context) {
+	s.sample()
+	s.writeSinks(ctx)
+}
+
+// Flush takes a final sample and delivers it to the registered sinks. It
+// is used on shutdown, after Run has returned.
+func (s *Sampler) Flush(ctx context.Context) error {
+	s.sample()
+	return s.writeSinks(ctx)
+}
+
+// Close closes all registered sinks
+func (s *Sampler) Close() error {
+	var errs []error
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close %s sink: %w", sink.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeSinks delivers the latest samples to every sink. Sink errors are
+// logged so that one failing output does not block the others.
+func (s *Sampler) writeSinks(ctx context.Context) error {
+	if len(s.sinks) == 0 {
+		return nil
+	}
+
+	samples := s.Samples()
+	var errs []error
+	for _, sink := range s.sinks {
+		if err := sink.Write(ctx, samples); err != nil {
+			log.Printf("Error writing samples to %s sink: %v", sink.Name(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sample queries every device and records the results
+func (s *Sampler) sample() {
+	for _, device := range s.devices {
+		stats, err := device.QueryStats()
+		now := s.clock()
+		queried := time.Now()
+
+		s.mutex.Lock()
+		sample := s.samples[device.Path]
+		if err != nil {
+			log.Printf("Error querying stats for %s: %v", device.Path, err)
+			sample.Stats = nil
+			sample.Err = err
+			sample.ErrTime = now
+		} else {
+			sample.PrevStats = sample.Stats
+			sample.PrevSampleTime = sample.SampleTime
+			sample.Stats = stats
+			sample.SampleTime = now
+			sample.QueryTime = queried
+			sample.Err = nil
+		}
+		s.mutex.Unlock()
+	}
+
+	s.mutex.Lock()
+	s.lastTick = time.Now()
+	s.mutex.Unlock()
+}
+
+// Samples returns a copy of the latest sample for every device, in the
+// order the devices were given to the sampler
+func (s *Sampler) Samples() []DeviceSample {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	samples := make([]DeviceSample, 0, len(s.devices))
+	for _, device := range s.devices {
+		samples = append(samples, *s.samples[device.Path])
+	}
+	return samples
+}
+
+// LastTick returns the time the sampler last finished a pass over all
+// devices, or the time it was created if no pass has completed yet
+func (s *Sampler) LastTick() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.lastTick.IsZero() {
+		return s.started
+	}
+	return s.lastTick
+}
+
+// Interval returns the sampling interval
+func (s *Sampler) Interval() time.Duration {
+	return s.interval
+}
+
+// Devices returns the devices being sampled
+func (s *Sampler) Devices() []*nvme.Device {
+	return s.devices
+}
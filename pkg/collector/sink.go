@@ -0,0 +1,16 @@
+package collector
+
+import "context"
+
+// Sink receives every set of samples taken by the sampler. Sinks are used
+// by outputs that push or write metrics instead of waiting to be scraped.
+type Sink interface {
+	// Name identifies the sink in logs
+	Name() string
+
+	// Write delivers the latest samples to the sink
+	Write(ctx context.Context, samples []DeviceSample) error
+
+	// Close flushes any buffered data and releases the sink's resources
+	Close() error
+}
@@ -0,0 +1,108 @@
+package ec2metadata
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultEndpoint is the EC2 instance metadata service endpoint
+	DefaultEndpoint = "http://169.254.169.254"
+
+	tokenTTLSeconds = "21600"
+	requestTimeout  = 2 * time.Second
+)
+
+// InstanceMetadata identifies the EC2 instance the collector runs on
+type InstanceMetadata struct {
+	InstanceID       string `json:"instanceId,omitempty"`
+	InstanceType     string `json:"instanceType,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	Region           string `json:"region,omitempty"`
+}
+
+// Labels returns the metadata as snake_case labels, for outputs that tag
+// metrics with key/value pairs. Empty values are omitted.
+func (m *InstanceMetadata) Labels() map[string]string {
+	labels := make(map[string]string, 4)
+	for key, value := range map[string]string{
+		"instance_id":       m.InstanceID,
+		"instance_type":     m.InstanceType,
+		"availability_zone": m.AvailabilityZone,
+		"region":            m.Region,
+	} {
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// Fetch retrieves the instance metadata using IMDSv2
+func Fetch(ctx context.Context, endpoint string) (*InstanceMetadata, error) {
+	client := &http.Client{Timeout: requestTimeout}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	token, err := request(ctx, client, http.MethodPut, endpoint+"/latest/api/token", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": tokenTTLSeconds,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata token: %w", err)
+	}
+
+	get := func(path string) (string, error) {
+		value, err := request(ctx, client, http.MethodGet, endpoint+"/latest/meta-data/"+path, map[string]string{
+			"X-aws-ec2-metadata-token": token,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get %s: %w", path, err)
+		}
+		return value, nil
+	}
+
+	metadata := &InstanceMetadata{}
+	if metadata.InstanceID, err = get("instance-id"); err != nil {
+		return nil, err
+	}
+	if metadata.InstanceType, err = get("instance-type"); err != nil {
+		return nil, err
+	}
+	if metadata.AvailabilityZone, err = get("placement/availability-zone"); err != nil {
+		return nil, err
+	}
+	if metadata.Region, err = get("placement/region"); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// request sends a metadata request and returns the response body
+func request(ctx context.Context, client *http.Client, method, url string, headers map[string]string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,169 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+)
+
+// ReadyPolicy controls how many devices must be healthy for the collector
+// to report ready
+type ReadyPolicy string
+
+const (
+	// ReadyPolicyAny requires at least one device to have been sampled recently
+	ReadyPolicyAny ReadyPolicy = "any"
+	// ReadyPolicyAll requires every device to have been sampled recently
+	ReadyPolicyAll ReadyPolicy = "all"
+
+	// missedTicks is the number of sampling intervals the sampler may miss
+	// before the process is considered unhealthy
+	missedTicks = 3
+)
+
+// ParseReadyPolicy converts a flag value into a ReadyPolicy
+func ParseReadyPolicy(value string) (ReadyPolicy, error) {
+	switch policy := ReadyPolicy(value); policy {
+	case ReadyPolicyAny, ReadyPolicyAll:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown ready policy %q (expected %q or %q)", value, ReadyPolicyAny, ReadyPolicyAll)
+	}
+}
+
+// DeviceStatus is the health detail reported for a single device
+type DeviceStatus struct {
+	Device        string     `json:"device"`
+	VolumeID      string     `json:"volumeId"`
+	Ready         bool       `json:"ready"`
+	LastSample    *time.Time `json:"lastSample,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Status is the JSON body returned by the health endpoints
+type Status struct {
+	Status   string         `json:"status"`
+	Policy   ReadyPolicy    `json:"policy,omitempty"`
+	LastTick time.Time      `json:"lastTick"`
+	Devices  []DeviceStatus `json:"devices"`
+}
+
+// Checker reports liveness and readiness based on the sampler state
+type Checker struct {
+	sampler *collector.Sampler
+	policy  ReadyPolicy
+	maxAge  time.Duration
+}
+
+// NewChecker creates a new health checker. A device counts as ready when it
+// was successfully sampled within maxAge.
+func NewChecker(sampler *collector.Sampler, policy ReadyPolicy, maxAge time.Duration) *Checker {
+	return &Checker{
+		sampler: sampler,
+		policy:  policy,
+		maxAge:  maxAge,
+	}
+}
+
+// Alive reports whether the sampler loop is still ticking
+func (c *Checker) Alive() bool {
+	return time.Since(c.sampler.LastTick()) <= missedTicks*c.sampler.Interval()
+}
+
+// Ready reports whether enough devices were sampled recently to satisfy
+// the ready policy
+func (c *Checker) Ready() bool {
+	return c.ready(c.deviceStatuses())
+}
+
+// HealthzHandler returns the liveness handler
+func (c *Checker) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := Status{
+			LastTick: c.sampler.LastTick(),
+			Devices:  c.deviceStatuses(),
+		}
+		writeStatus(w, status, c.Alive())
+	})
+}
+
+// ReadyzHandler returns the readiness handler
+func (c *Checker) ReadyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		devices := c.deviceStatuses()
+		status := Status{
+			Policy:   c.policy,
+			LastTick: c.sampler.LastTick(),
+			Devices:  devices,
+		}
+		writeStatus(w, status, c.ready(devices))
+	})
+}
+
+// deviceStatuses builds the per-device health detail
+func (c *Checker) deviceStatuses() []DeviceStatus {
+	now := time.Now()
+	samples := c.sampler.Samples()
+	devices := make([]DeviceStatus, 0, len(samples))
+
+	for _, sample := range samples {
+		status := DeviceStatus{
+			Device:   sample.DeviceName(),
+			VolumeID: sample.Device.VolumeID,
+			Ready:    sample.Err == nil && !sample.QueryTime.IsZero() && now.Sub(sample.QueryTime) <= c.maxAge,
+		}
+		if !sample.SampleTime.IsZero() {
+			sampleTime := sample.SampleTime
+			status.LastSample = &sampleTime
+		}
+		if sample.Err != nil {
+			errTime := sample.ErrTime
+			status.LastError = sample.Err.Error()
+			status.LastErrorTime = &errTime
+		}
+		devices = append(devices, status)
+	}
+
+	return devices
+}
+
+// ready applies the ready policy to the device statuses. A collector
+// without devices has nothing to wait for, so it is ready.
+func (c *Checker) ready(devices []DeviceStatus) bool {
+	if len(devices) == 0 {
+		return true
+	}
+
+	readyCount := 0
+	for _, device := range devices {
+		if device.Ready {
+			readyCount++
+		}
+	}
+
+	if c.policy == ReadyPolicyAll {
+		return readyCount == len(devices)
+	}
+	return readyCount > 0
+}
+
+// writeStatus writes the status as JSON with a 200 or 503 response code
+func writeStatus(w http.ResponseWriter, status Status, ok bool) {
+	code := http.StatusOK
+	status.Status = "ok"
+	if !ok {
+		code = http.StatusServiceUnavailable
+		status.Status = "fail"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Error writing health status: %v", err)
+	}
+}
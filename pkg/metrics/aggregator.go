@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -12,237 +13,457 @@ const (
 	deviceLabel    = "device"
 	volumeIDLabel  = "volume_id"
 	nodeLabel      = "node"
-	
+	reasonLabel    = "reason"
+
 	ebsExporterValue = "ebs-metrics-exporter"
 )
 
-// EBSMetricsAggregator collects and aggregates EBS performance metrics
+// Reasons a volume's series were expired
+const (
+	// ExpiryReasonTTL means the volume was not seen for the series TTL,
+	// e.g. after it was detached
+	ExpiryReasonTTL = "ttl"
+	// ExpiryReasonPodDeleted means the collector pod on the volume's node
+	// was deleted, e.g. because the node was removed from the cluster
+	ExpiryReasonPodDeleted = "pod_deleted"
+)
+
+// volumeLabels are the variable labels of every volume series
+var volumeLabels = []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}
+
+// volumeMetric describes a counter or gauge emitted for every volume. The
+// collectors are scraped by Prometheus as well, so the metrics are named
+// ebs_cluster_volume_* rather than after the collector's, which would be
+// counted twice by queries summing over both.
+type volumeMetric struct {
+	name      string
+	help      string
+	valueType prometheus.ValueType
+	// value returns the metric's value, or false if the volume has none yet
+	value func(volume *volumeState) (float64, bool)
+}
+
+// volumeMetrics lists the counters and gauges emitted for every volume
+var volumeMetrics = []volumeMetric{
+	{
+		name:      "ebs_cluster_volume_performance_exceeded_iops_total",
+		help:      "Total time in microseconds that the EBS volume IOPS limit was exceeded",
+		valueType: prometheus.CounterValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Counters.VolumeIOPSExceeded, true },
+	},
+	{
+		name:      "ebs_cluster_volume_performance_exceeded_throughput_total",
+		help:      "Total time in microseconds that the EBS volume throughput limit was exceeded",
+		valueType: prometheus.CounterValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Counters.VolumeThroughputExceeded, true },
+	},
+	{
+		name:      "ebs_cluster_volume_instance_performance_exceeded_iops_total",
+		help:      "Total time in microseconds that the EC2 instance EBS IOPS limit was exceeded",
+		valueType: prometheus.CounterValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Counters.InstanceIOPSExceeded, true },
+	},
+	{
+		name:      "ebs_cluster_volume_instance_performance_exceeded_throughput_total",
+		help:      "Total time in microseconds that the EC2 instance EBS throughput limit was exceeded",
+		valueType: prometheus.CounterValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Counters.InstanceThroughputExceeded, true },
+	},
+	{
+		name:      "ebs_cluster_volume_read_ops_total",
+		help:      "Total number of read operations",
+		valueType: prometheus.CounterValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Counters.ReadOps, true },
+	},
+	{
+		name:      "ebs_cluster_volume_write_ops_total",
+		help:      "Total number of write operations",
+		valueType: prometheus.CounterValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Counters.WriteOps, true },
+	},
+	{
+		name:      "ebs_cluster_volume_read_bytes_total",
+		help:      "Total bytes read",
+		valueType: prometheus.CounterValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Counters.ReadBytes, true },
+	},
+	{
+		name:      "ebs_cluster_volume_write_bytes_total",
+		help:      "Total bytes written",
+		valueType: prometheus.CounterValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Counters.WriteBytes, true },
+	},
+	{
+		name:      "ebs_cluster_volume_queue_length",
+		help:      "Current volume queue length",
+		valueType: prometheus.GaugeValue,
+		value:     func(v *volumeState) (float64, bool) { return v.sample.Gauges.QueueLength, true },
+	},
+	{
+		name:      "ebs_cluster_volume_iops_exceeded_check",
+		help:      "Reports whether an application consistently attempted to drive IOPS that exceeds the volume's provisioned IOPS performance within the last collection interval",
+		valueType: prometheus.GaugeValue,
+		value:     deltaValue(func(d *counterDeltas) float64 { return exceededCheck(d.counters.VolumeIOPSExceeded) }),
+	},
+	{
+		name:      "ebs_cluster_volume_throughput_exceeded_check",
+		help:      "Reports whether an application consistently attempted to drive throughput that exceeds the volume's provisioned throughput performance within the last collection interval",
+		valueType: prometheus.GaugeValue,
+		value:     deltaValue(func(d *counterDeltas) float64 { return exceededCheck(d.counters.VolumeThroughputExceeded) }),
+	},
+	{
+		name:      "ebs_cluster_volume_performance_exceeded_iops_percent",
+		help:      "Percentage of time that the EBS volume IOPS limit was exceeded during the last interval",
+		valueType: prometheus.GaugeValue,
+		value:     deltaValue(func(d *counterDeltas) float64 { return d.percent(d.counters.VolumeIOPSExceeded) }),
+	},
+	{
+		name:      "ebs_cluster_volume_performance_exceeded_throughput_percent",
+		help:      "Percentage of time that the EBS volume throughput limit was exceeded during the last interval",
+		valueType: prometheus.GaugeValue,
+		value:     deltaValue(func(d *counterDeltas) float64 { return d.percent(d.counters.VolumeThroughputExceeded) }),
+	},
+	{
+		name:      "ebs_cluster_volume_instance_performance_exceeded_iops_percent",
+		help:      "Percentage of time that the EC2 instance EBS IOPS limit was exceeded during the last interval",
+		valueType: prometheus.GaugeValue,
+		value:     deltaValue(func(d *counterDeltas) float64 { return d.percent(d.counters.InstanceIOPSExceeded) }),
+	},
+	{
+		name:      "ebs_cluster_volume_instance_performance_exceeded_throughput_percent",
+		help:      "Percentage of time that the EC2 instance EBS throughput limit was exceeded during the last interval",
+		valueType: prometheus.GaugeValue,
+		value:     deltaValue(func(d *counterDeltas) float64 { return d.percent(d.counters.InstanceThroughputExceeded) }),
+	},
+}
+
+// volumeHistogram describes a latency histogram emitted for every volume
+// whose samples include it
+type volumeHistogram struct {
+	name      string
+	help      string
+	histogram func(sample *VolumeSample) *LatencyHistogram
+}
+
+// volumeHistograms lists the latency histograms emitted for every volume
+var volumeHistograms = []volumeHistogram{
+	{
+		name:      "ebs_cluster_volume_read_io_latency_microseconds",
+		help:      "Read I/O latency histogram in microseconds",
+		histogram: func(s *VolumeSample) *LatencyHistogram { return s.ReadLatency },
+	},
+	{
+		name:      "ebs_cluster_volume_write_io_latency_microseconds",
+		help:      "Write I/O latency histogram in microseconds",
+		histogram: func(s *VolumeSample) *LatencyHistogram { return s.WriteLatency },
+	},
+}
+
+// volumeKey identifies the series of a volume
+type volumeKey struct {
+	node     string
+	device   string
+	volumeID string
+}
+
+// counterDeltas holds the increase of a volume's counters between its two
+// latest samples
+type counterDeltas struct {
+	intervalMicros float64
+	counters       VolumeCounters
+}
+
+// percent returns the share of the interval a limit was exceeded
+func (d *counterDeltas) percent(exceededMicros float64) float64 {
+	return min(exceededMicros/d.intervalMicros*100, 100)
+}
+
+// perSecond returns the rate of a counter delta over the interval
+func (d *counterDeltas) perSecond(delta float64) float64 {
+	return delta / d.intervalMicros * float64(time.Second/time.Microsecond)
+}
+
+// throttled reports whether the volume or instance limits were exceeded
+// during the interval
+func (d *counterDeltas) throttled() (volume, instance bool) {
+	c := d.counters
+	return c.VolumeIOPSExceeded > 0 || c.VolumeThroughputExceeded > 0,
+		c.InstanceIOPSExceeded > 0 || c.InstanceThroughputExceeded > 0
+}
+
+// deltaValue returns the value of a metric derived from the counter
+// deltas, which a volume only has from its second sample
+func deltaValue(value func(d *counterDeltas) float64) func(v *volumeState) (float64, bool) {
+	return func(v *volumeState) (float64, bool) {
+		if v.deltas == nil {
+			return 0, false
+		}
+		return value(v.deltas), true
+	}
+}
+
+// volumeState holds a volume's latest sample and when it was set
+type volumeState struct {
+	sample   VolumeSample
+	lastSeen time.Time
+	// deltas is nil until the volume's second sample
+	deltas *counterDeltas
+}
+
+// EBSMetricsAggregator collects and aggregates EBS performance metrics. It
+// is a prometheus.Collector emitting the latest sample of every volume.
 type EBSMetricsAggregator struct {
-	volumeIOPSExceededTotal            *prometheus.GaugeVec
-	volumeThroughputExceededTotal      *prometheus.GaugeVec
-	volumeIOPSExceededCheck            *prometheus.GaugeVec
-	volumeThroughputExceededCheck      *prometheus.GaugeVec
-	instanceIOPSExceededTotal          *prometheus.GaugeVec
-	instanceThroughputExceededTotal    *prometheus.GaugeVec
-	totalReadOpsTotal                  *prometheus.GaugeVec
-	totalWriteOpsTotal                 *prometheus.GaugeVec
-	totalReadBytesTotal                *prometheus.GaugeVec
-	totalWriteBytesTotal               *prometheus.GaugeVec
-	volumeQueueLength                  *prometheus.GaugeVec
-	volumeIOPSExceededPercent          *prometheus.GaugeVec
-	volumeThroughputExceededPercent    *prometheus.GaugeVec
-	instanceIOPSExceededPercent        *prometheus.GaugeVec
-	instanceThroughputExceededPercent  *prometheus.GaugeVec
-	
+	metricDescs        []*prometheus.Desc
+	histogramDescs     []*prometheus.Desc
+	rollupDescs        rollupDescs
+	fleetDescs         fleetDescs
+	seriesExpiredTotal *prometheus.CounterVec
+
 	mutex               sync.Mutex
 	aggregationInterval time.Duration
 	clusterId           string
+	seriesTTL           time.Duration
+	topThrottled        int
+	volumes             map[volumeKey]*volumeState
+	// rollups is nil until the first aggregation cycle
+	rollups *rollups
+	// fleets holds the state of every collector DaemonSet by name
+	fleets map[string]*CollectorFleet
 }
 
 // NewMetricsAggregator creates a new EBS metrics aggregator
 func NewMetricsAggregator(aggregationInterval time.Duration, clusterId string) *EBSMetricsAggregator {
+	constLabels := prometheus.Labels{"name": ebsExporterValue}
+
+	metricDescs := make([]*prometheus.Desc, 0, len(volumeMetrics))
+	for _, metric := range volumeMetrics {
+		metricDescs = append(metricDescs, prometheus.NewDesc(metric.name, metric.help, volumeLabels, constLabels))
+	}
+	histogramDescs := make([]*prometheus.Desc, 0, len(volumeHistograms))
+	for _, histogram := range volumeHistograms {
+		histogramDescs = append(histogramDescs, prometheus.NewDesc(histogram.name, histogram.help, volumeLabels, constLabels))
+	}
+
 	return &EBSMetricsAggregator{
-		volumeIOPSExceededTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_volume_performance_exceeded_iops_total",
-			Help:        "Total time in microseconds that the EBS volume IOPS limit was exceeded",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		volumeThroughputExceededTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_volume_performance_exceeded_throughput_total",
-			Help:        "Total time in microseconds that the EBS volume throughput limit was exceeded",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		volumeIOPSExceededCheck: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_volume_iops_exceeded_check",
-			Help:        "Reports whether an application consistently attempted to drive IOPS that exceeds the volume's provisioned IOPS performance within the last collection interval",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		volumeThroughputExceededCheck: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_volume_throughput_exceeded_check",
-			Help:        "Reports whether an application consistently attempted to drive throughput that exceeds the volume's provisioned throughput performance within the last collection interval",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		instanceIOPSExceededTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_instance_performance_exceeded_iops_total",
-			Help:        "Total time in microseconds that the EC2 instance EBS IOPS limit was exceeded",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		instanceThroughputExceededTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_instance_performance_exceeded_throughput_total",
-			Help:        "Total time in microseconds that the EC2 instance EBS throughput limit was exceeded",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		totalReadOpsTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_total_read_ops_total",
-			Help:        "Total number of read operations",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		totalWriteOpsTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_total_write_ops_total",
-			Help:        "Total number of write operations",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		totalReadBytesTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_total_read_bytes_total",
-			Help:        "Total bytes read",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		totalWriteBytesTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_total_write_bytes_total",
-			Help:        "Total bytes written",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		volumeQueueLength: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_volume_queue_length",
-			Help:        "Current volume queue length",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		volumeIOPSExceededPercent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_volume_performance_exceeded_iops_percent",
-			Help:        "Percentage of time that the EBS volume IOPS limit was exceeded during the last interval",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		volumeThroughputExceededPercent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_volume_performance_exceeded_throughput_percent",
-			Help:        "Percentage of time that the EBS volume throughput limit was exceeded during the last interval",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		instanceIOPSExceededPercent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_instance_performance_exceeded_iops_percent",
-			Help:        "Percentage of time that the EC2 instance EBS IOPS limit was exceeded during the last interval",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
-		instanceThroughputExceededPercent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name:        "ebs_instance_performance_exceeded_throughput_percent",
-			Help:        "Percentage of time that the EC2 instance EBS throughput limit was exceeded during the last interval",
-			ConstLabels: map[string]string{"name": ebsExporterValue},
-		}, []string{clusterIDLabel, nodeLabel, deviceLabel, volumeIDLabel}),
-		
+		metricDescs:    metricDescs,
+		histogramDescs: histogramDescs,
+		rollupDescs:    newRollupDescs(),
+		fleetDescs:     newFleetDescs(),
+		seriesExpiredTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "ebs_aggregator_series_expired_total",
+			Help:        "Total number of volumes whose series were removed from the aggregator, by reason",
+			ConstLabels: prometheus.Labels{"name": ebsExporterValue, clusterIDLabel: clusterId},
+		}, []string{reasonLabel}),
+
 		aggregationInterval: aggregationInterval,
 		clusterId:           clusterId,
+		seriesTTL:           defaultSeriesTTLIntervals * aggregationInterval,
+		topThrottled:        defaultTopThrottledVolumes,
+		volumes:             make(map[volumeKey]*volumeState),
+		fleets:              make(map[string]*CollectorFleet),
 	}
 }
 
-// GetMetrics returns all Prometheus collectors
+// GetMetrics returns the collectors to register with Prometheus
 func (a *EBSMetricsAggregator) GetMetrics() []prometheus.Collector {
-	return []prometheus.Collector{
-		a.volumeIOPSExceededTotal,
-		a.volumeThroughputExceededTotal,
-		a.volumeIOPSExceededCheck,
-		a.volumeThroughputExceededCheck,
-		a.instanceIOPSExceededTotal,
-		a.instanceThroughputExceededTotal,
-		a.totalReadOpsTotal,
-		a.totalWriteOpsTotal,
-		a.totalReadBytesTotal,
-		a.totalWriteBytesTotal,
-		a.volumeQueueLength,
-		a.volumeIOPSExceededPercent,
-		a.volumeThroughputExceededPercent,
-		a.instanceIOPSExceededPercent,
-		a.instanceThroughputExceededPercent,
-	}
-}
-
-// SetVolumeMetrics updates all metrics for a specific volume
-// This will be called from the DaemonSet pods that collect the actual NVMe stats
-func (a *EBSMetricsAggregator) SetVolumeMetrics(node, device, volumeID string, metrics map[string]float64) {
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
-	
-	labels := prometheus.Labels{
-		clusterIDLabel: a.clusterId,
-		nodeLabel:      node,
-		deviceLabel:    device,
-		volumeIDLabel:  volumeID,
-	}
-	
-	if val, ok := metrics["volume_iops_exceeded_total"]; ok {
-		a.volumeIOPSExceededTotal.With(labels).Set(val)
-	}
-	if val, ok := metrics["volume_throughput_exceeded_total"]; ok {
-		a.volumeThroughputExceededTotal.With(labels).Set(val)
-	}
-	if val, ok := metrics["volume_iops_exceeded_check"]; ok {
-		a.volumeIOPSExceededCheck.With(labels).Set(val)
-	}
-	if val, ok := metrics["volume_throughput_exceeded_check"]; ok {
-		a.volumeThroughputExceededCheck.With(labels).Set(val)
-	}
-	if val, ok := metrics["instance_iops_exceeded_total"]; ok {
-		a.instanceIOPSExceededTotal.With(labels).Set(val)
-	}
-	if val, ok := metrics["instance_throughput_exceeded_total"]; ok {
-		a.instanceThroughputExceededTotal.With(labels).Set(val)
+	return []prometheus.Collector{a}
+}
+
+// Describe implements the prometheus.Collector interface
+func (a *EBSMetricsAggregator) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range a.metricDescs {
+		ch <- desc
 	}
-	if val, ok := metrics["total_read_ops_total"]; ok {
-		a.totalReadOpsTotal.With(labels).Set(val)
+	for _, desc := range a.histogramDescs {
+		ch <- desc
 	}
-	if val, ok := metrics["total_write_ops_total"]; ok {
-		a.totalWriteOpsTotal.With(labels).Set(val)
+	a.rollupDescs.describe(ch)
+	a.fleetDescs.describe(ch)
+	a.seriesExpiredTotal.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface
+func (a *EBSMetricsAggregator) Collect(ch chan<- prometheus.Metric) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for key, volume := range a.volumes {
+		labels := []string{a.clusterId, key.node, key.device, key.volumeID}
+
+		for i, metric := range volumeMetrics {
+			value, ok := metric.value(volume)
+			if !ok {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(a.metricDescs[i], metric.valueType, value, labels...)
+		}
+
+		for i, histogram := range volumeHistograms {
+			latency := histogram.histogram(&volume.sample)
+			if latency == nil {
+				continue
+			}
+			ch <- prometheus.MustNewConstHistogram(a.histogramDescs[i], latency.Count, latency.Sum, latency.Buckets, labels...)
+		}
 	}
-	if val, ok := metrics["total_read_bytes_total"]; ok {
-		a.totalReadBytesTotal.With(labels).Set(val)
+	if a.rollups != nil {
+		a.rollups.collect(ch, a.rollupDescs, a.clusterId)
 	}
-	if val, ok := metrics["total_write_bytes_total"]; ok {
-		a.totalWriteBytesTotal.With(labels).Set(val)
+	for name, fleet := range a.fleets {
+		fleet.collect(ch, a.fleetDescs, a.clusterId, name)
 	}
-	if val, ok := metrics["volume_queue_length"]; ok {
-		a.volumeQueueLength.With(labels).Set(val)
+	a.seriesExpiredTotal.Collect(ch)
+}
+
+// SetCollectorFleet sets the state of a collector DaemonSet
+func (a *EBSMetricsAggregator) SetCollectorFleet(daemonSet string, fleet CollectorFleet) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.fleets[daemonSet] = &fleet
+}
+
+// RemoveCollectorFleet removes the state of a deleted collector DaemonSet
+func (a *EBSMetricsAggregator) RemoveCollectorFleet(daemonSet string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.fleets, daemonSet)
+}
+
+// Aggregate computes the per-node and cluster rollups and the top
+// throttled volumes from the volumes' latest samples. It is called once per
+// aggregation cycle, after the collectors were scraped.
+func (a *EBSMetricsAggregator) Aggregate() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.rollups = computeRollups(a.volumes, a.topThrottled)
+}
+
+// AggregationInterval returns how often collector metrics are aggregated
+func (a *EBSMetricsAggregator) AggregationInterval() time.Duration {
+	return a.aggregationInterval
+}
+
+// SetSeriesTTL sets how long a volume's series are kept after its latest
+// sample was set
+func (a *EBSMetricsAggregator) SetSeriesTTL(ttl time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.seriesTTL = ttl
+}
+
+// SetTopThrottledVolumes sets how many volumes the top throttled list holds
+func (a *EBSMetricsAggregator) SetTopThrottledVolumes(n int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.topThrottled = n
+}
+
+// SetVolumeSample updates all metrics for a specific volume from a sample
+// collected on its node. The exceeded percentages and checks are derived
+// from the volume's previous sample. Invalid samples, and samples that are
+// not newer than the volume's latest one, are rejected.
+func (a *EBSMetricsAggregator) SetVolumeSample(sample VolumeSample) error {
+	if err := sample.Validate(); err != nil {
+		return err
 	}
-	if val, ok := metrics["volume_iops_exceeded_percent"]; ok {
-		a.volumeIOPSExceededPercent.With(labels).Set(val)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := volumeKey{node: sample.Node, device: sample.Device, volumeID: sample.VolumeID}
+	previous, seen := a.volumes[key]
+	if seen && !sample.SampleTime.After(previous.sample.SampleTime) {
+		return fmt.Errorf("volume %s on node %s: %w", sample.VolumeID, sample.Node, ErrOutOfOrder)
 	}
-	if val, ok := metrics["volume_throughput_exceeded_percent"]; ok {
-		a.volumeThroughputExceededPercent.With(labels).Set(val)
+
+	volume := &volumeState{sample: sample, lastSeen: time.Now()}
+	if seen {
+		current, last := sample.Counters, previous.sample.Counters
+		volume.deltas = &counterDeltas{
+			intervalMicros: float64(sample.SampleTime.Sub(previous.sample.SampleTime).Microseconds()),
+			counters: VolumeCounters{
+				VolumeIOPSExceeded:         counterDelta(last.VolumeIOPSExceeded, current.VolumeIOPSExceeded),
+				VolumeThroughputExceeded:   counterDelta(last.VolumeThroughputExceeded, current.VolumeThroughputExceeded),
+				InstanceIOPSExceeded:       counterDelta(last.InstanceIOPSExceeded, current.InstanceIOPSExceeded),
+				InstanceThroughputExceeded: counterDelta(last.InstanceThroughputExceeded, current.InstanceThroughputExceeded),
+				ReadOps:                    counterDelta(last.ReadOps, current.ReadOps),
+				WriteOps:                   counterDelta(last.WriteOps, current.WriteOps),
+				ReadBytes:                  counterDelta(last.ReadBytes, current.ReadBytes),
+				WriteBytes:                 counterDelta(last.WriteBytes, current.WriteBytes),
+			},
+		}
 	}
-	if val, ok := metrics["instance_iops_exceeded_percent"]; ok {
-		a.instanceIOPSExceededPercent.With(labels).Set(val)
+	a.volumes[key] = volume
+	return nil
+}
+
+// counterDelta returns the increase of a counter between two samples. A
+// decrease means the counter was reset, e.g. on reattachment.
+func counterDelta(previous, current float64) float64 {
+	if current < previous {
+		return current
 	}
-	if val, ok := metrics["instance_throughput_exceeded_percent"]; ok {
-		a.instanceThroughputExceededPercent.With(labels).Set(val)
+	return current - previous
+}
+
+// exceededCheck returns 1 if a limit was exceeded during the interval
+func exceededCheck(exceededMicros float64) float64 {
+	if exceededMicros > 0 {
+		return 1
 	}
+	return 0
 }
 
 // RemoveVolumeMetrics removes metrics for a specific volume when the pod is deleted
 func (a *EBSMetricsAggregator) RemoveVolumeMetrics(node, device, volumeID string) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
-	
-	labels := prometheus.Labels{
-		clusterIDLabel: a.clusterId,
-		nodeLabel:      node,
-		deviceLabel:    device,
-		volumeIDLabel:  volumeID,
-	}
-	
-	a.volumeIOPSExceededTotal.Delete(labels)
-	a.volumeThroughputExceededTotal.Delete(labels)
-	a.volumeIOPSExceededCheck.Delete(labels)
-	a.volumeThroughputExceededCheck.Delete(labels)
-	a.instanceIOPSExceededTotal.Delete(labels)
-	a.instanceThroughputExceededTotal.Delete(labels)
-	a.totalReadOpsTotal.Delete(labels)
-	a.totalWriteOpsTotal.Delete(labels)
-	a.totalReadBytesTotal.Delete(labels)
-	a.totalWriteBytesTotal.Delete(labels)
-	a.volumeQueueLength.Delete(labels)
-	a.volumeIOPSExceededPercent.Delete(labels)
-	a.volumeThroughputExceededPercent.Delete(labels)
-	a.instanceIOPSExceededPercent.Delete(labels)
-	a.instanceThroughputExceededPercent.Delete(labels)
+
+	delete(a.volumes, volumeKey{node: node, device: device, volumeID: volumeID})
+}
+
+// ExpireStaleSeries removes the series of volumes whose samples were not
+// set within the series TTL, and returns the number of volumes removed
+func (a *EBSMetricsAggregator) ExpireStaleSeries(now time.Time) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	expired := 0
+	for key, volume := range a.volumes {
+		if now.Sub(volume.lastSeen) > a.seriesTTL {
+			delete(a.volumes, key)
+			expired++
+		}
+	}
+	a.seriesExpiredTotal.WithLabelValues(ExpiryReasonTTL).Add(float64(expired))
+	return expired
+}
+
+// RemoveNodesExcept removes the series of volumes on nodes that are not in
+// nodes, i.e. nodes that no longer run a collector pod, and returns the
+// number of volumes removed
+func (a *EBSMetricsAggregator) RemoveNodesExcept(nodes map[string]bool) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	removed := 0
+	for key := range a.volumes {
+		if !nodes[key.node] {
+			delete(a.volumes, key)
+			removed++
+		}
+	}
+	a.seriesExpiredTotal.WithLabelValues(ExpiryReasonPodDeleted).Add(float64(removed))
+
+	// Drop the removed nodes from the rollups without waiting for the next
+	// aggregation cycle
+	if removed > 0 && a.rollups != nil {
+		a.rollups = computeRollups(a.volumes, a.topThrottled)
+	}
+	return removed
 }
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSetVolumeSampleOutOfOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  time.Duration
+		wantErr error
+	}{
+		{
+			name:   "newer",
+			offset: time.Minute,
+		},
+		{
+			name:    "equal",
+			offset:  0,
+			wantErr: ErrOutOfOrder,
+		},
+		{
+			name:    "older",
+			offset:  -time.Minute,
+			wantErr: ErrOutOfOrder,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregator := NewMetricsAggregator(time.Minute, "test")
+			first := validSample()
+			if err := aggregator.SetVolumeSample(first); err != nil {
+				t.Fatalf("unexpected error setting the first sample: %v", err)
+			}
+
+			second := validSample()
+			second.SampleTime = first.SampleTime.Add(tt.offset)
+			err := aggregator.SetVolumeSample(second)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSetVolumeSampleRejectsInvalid(t *testing.T) {
+	aggregator := NewMetricsAggregator(time.Minute, "test")
+	sample := validSample()
+	sample.VolumeID = ""
+
+	if err := aggregator.SetVolumeSample(sample); err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	if len(aggregator.volumes) != 0 {
+		t.Fatalf("expected no volumes, got %d", len(aggregator.volumes))
+	}
+}
+
+func TestExpireStaleSeries(t *testing.T) {
+	aggregator := NewMetricsAggregator(time.Minute, "test")
+	aggregator.SetSeriesTTL(10 * time.Minute)
+
+	stale := validSample()
+	fresh := validSample()
+	fresh.VolumeID = "vol-0fedcba9876543210"
+	for _, sample := range []VolumeSample{stale, fresh} {
+		if err := aggregator.SetVolumeSample(sample); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Age the stale volume past the TTL
+	staleKey := volumeKey{node: stale.Node, device: stale.Device, volumeID: stale.VolumeID}
+	aggregator.volumes[staleKey].lastSeen = time.Now().Add(-time.Hour)
+
+	if expired := aggregator.ExpireStaleSeries(time.Now()); expired != 1 {
+		t.Fatalf("expected 1 volume expired, got %d", expired)
+	}
+	if _, ok := aggregator.volumes[staleKey]; ok {
+		t.Fatal("expected the stale volume to be removed")
+	}
+	if len(aggregator.volumes) != 1 {
+		t.Fatalf("expected 1 volume left, got %d", len(aggregator.volumes))
+	}
+
+	// Every volume expires once the TTL has passed
+	if expired := aggregator.ExpireStaleSeries(time.Now().Add(time.Hour)); expired != 1 {
+		t.Fatalf("expected 1 volume expired, got %d", expired)
+	}
+	if len(aggregator.volumes) != 0 {
+		t.Fatalf("expected no volumes left, got %d", len(aggregator.volumes))
+	}
+}
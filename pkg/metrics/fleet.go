@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	daemonSetLabel = "daemonset"
+	imageLabel     = "image"
+	imageIDLabel   = "image_id"
+)
+
+// Collector fleet metrics referenced by the operator's alerts
+const (
+	CollectorPodsDesiredMetric   = "ebs_collector_pods_desired"
+	CollectorPodsAvailableMetric = "ebs_collector_pods_available"
+)
+
+// CollectorFleet is the state of a collector DaemonSet and its pods
+type CollectorFleet struct {
+	Desired      int32
+	Ready        int32
+	Available    int32
+	Misscheduled int32
+	Nodes        []CollectorNode
+}
+
+// CollectorNode is the state of the collector pods of a node
+type CollectorNode struct {
+	Node string
+	// NotReady is the number of the node's collector pods that are not
+	// ready
+	NotReady int
+	// Image and ImageID are the image of the node's collector container
+	// and the digest it resolved to, empty until the container started
+	Image   string
+	ImageID string
+	// Scraped is whether the node's collector was scraped without error,
+	// and NoDevices whether it then reported no EBS volume
+	Scraped   bool
+	NoDevices bool
+}
+
+// fleetDescs holds the descriptors of the collector fleet metrics
+type fleetDescs struct {
+	desired       *prometheus.Desc
+	ready         *prometheus.Desc
+	available     *prometheus.Desc
+	misscheduled  *prometheus.Desc
+	imageVersions *prometheus.Desc
+	nodeNotReady  *prometheus.Desc
+	nodeImage     *prometheus.Desc
+	nodeNoDevices *prometheus.Desc
+}
+
+func newFleetDescs() fleetDescs {
+	constLabels := prometheus.Labels{"name": ebsExporterValue}
+	labels := []string{clusterIDLabel, daemonSetLabel}
+	nodeLabels := []string{clusterIDLabel, daemonSetLabel, nodeLabel}
+
+	return fleetDescs{
+		desired: prometheus.NewDesc(CollectorPodsDesiredMetric,
+			"Number of nodes that should run a collector pod",
+			labels, constLabels),
+		ready: prometheus.NewDesc("ebs_collector_pods_ready",
+			"Number of nodes running a ready collector pod",
+			labels, constLabels),
+		available: prometheus.NewDesc(CollectorPodsAvailableMetric,
+			"Number of nodes running an available collector pod",
+			labels, constLabels),
+		misscheduled: prometheus.NewDesc("ebs_collector_pods_misscheduled",
+			"Number of nodes running a collector pod that should not",
+			labels, constLabels),
+		imageVersions: prometheus.NewDesc("ebs_collector_image_versions",
+			"Number of distinct collector images running, more than one during a rollout or on version skew",
+			labels, constLabels),
+		nodeNotReady: prometheus.NewDesc("ebs_collector_node_pods_not_ready",
+			"Number of the node's collector pods that are not ready",
+			nodeLabels, constLabels),
+		nodeImage: prometheus.NewDesc("ebs_collector_node_image_info",
+			"Image of the node's collector, always 1",
+			append(nodeLabels, imageLabel, imageIDLabel), constLabels),
+		nodeNoDevices: prometheus.NewDesc("ebs_collector_node_no_devices",
+			"Whether the node's collector reported no EBS volume when last scraped",
+			nodeLabels, constLabels),
+	}
+}
+
+// describe sends the collector fleet descriptors
+func (d fleetDescs) describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		d.desired, d.ready, d.available, d.misscheduled, d.imageVersions,
+		d.nodeNotReady, d.nodeImage, d.nodeNoDevices,
+	} {
+		ch <- desc
+	}
+}
+
+// collect emits the metrics of a collector DaemonSet
+func (f *CollectorFleet) collect(ch chan<- prometheus.Metric, descs fleetDescs, clusterId, daemonSet string) {
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value,
+			append([]string{clusterId, daemonSet}, labels...)...)
+	}
+
+	gauge(descs.desired, float64(f.Desired))
+	gauge(descs.ready, float64(f.Ready))
+	gauge(descs.available, float64(f.Available))
+	gauge(descs.misscheduled, float64(f.Misscheduled))
+	gauge(descs.imageVersions, float64(len(f.imageVersions())))
+
+	for _, node := range f.Nodes {
+		gauge(descs.nodeNotReady, float64(node.NotReady), node.Node)
+		if node.Image != "" {
+			gauge(descs.nodeImage, 1, node.Node, node.Image, node.ImageID)
+		}
+		if node.Scraped {
+			gauge(descs.nodeNoDevices, boolValue(node.NoDevices), node.Node)
+		}
+	}
+}
+
+// imageVersions returns the distinct images of the fleet, by digest when
+// known
+func (f *CollectorFleet) imageVersions() []string {
+	versions := make(map[string]bool)
+	for _, node := range f.Nodes {
+		switch {
+		case node.ImageID != "":
+			versions[node.ImageID] = true
+		case node.Image != "":
+			versions[node.Image] = true
+		}
+	}
+
+	result := make([]string, 0, len(versions))
+	for version := range versions {
+		result = append(result, version)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -3,15 +3,27 @@ package metrics
 import "time"
 
 const (
-	aggregatorResyncInterval = 5 * time.Minute
+	// DefaultAggregationInterval is how often the collectors are scraped and
+	// aggregated by default. Every rate, percentage and check computed from
+	// the difference of two scrapes covers this interval.
+	DefaultAggregationInterval = 5 * time.Minute
+
+	// defaultSeriesTTLIntervals is the default series TTL in aggregation
+	// intervals, so a volume survives a couple of failed scrapes
+	defaultSeriesTTLIntervals = 3
+
+	// defaultTopThrottledVolumes is the default length of the top throttled
+	// volumes list
+	defaultTopThrottledVolumes = 10
 )
 
 var aggregator *EBSMetricsAggregator
 
-// GetMetricsAggregator returns the singleton metrics aggregator instance
-func GetMetricsAggregator(clusterId string) *EBSMetricsAggregator {
+// GetMetricsAggregator returns the singleton metrics aggregator instance,
+// creating it with the given aggregation interval on the first call
+func GetMetricsAggregator(clusterId string, aggregationInterval time.Duration) *EBSMetricsAggregator {
 	if aggregator == nil {
-		aggregator = NewMetricsAggregator(aggregatorResyncInterval, clusterId)
+		aggregator = NewMetricsAggregator(aggregationInterval, clusterId)
 	}
 	return aggregator
 }
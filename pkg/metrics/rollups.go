@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	limitLabel = "limit"
+	rankLabel  = "rank"
+)
+
+// Limits reported by the exceeded-time rollups
+const (
+	limitVolumeIOPS         = "volume_iops"
+	limitVolumeThroughput   = "volume_throughput"
+	limitInstanceIOPS       = "instance_iops"
+	limitInstanceThroughput = "instance_throughput"
+)
+
+// Limit kinds reported by the throttled-volume counts
+const (
+	limitVolume   = "volume"
+	limitInstance = "instance"
+)
+
+// exceededLimits lists the limits of the exceeded-time rollups, and whether
+// each is an instance limit
+var exceededLimits = []struct {
+	name     string
+	instance bool
+	exceeded func(c VolumeCounters) float64
+}{
+	{limitVolumeIOPS, false, func(c VolumeCounters) float64 { return c.VolumeIOPSExceeded }},
+	{limitVolumeThroughput, false, func(c VolumeCounters) float64 { return c.VolumeThroughputExceeded }},
+	{limitInstanceIOPS, true, func(c VolumeCounters) float64 { return c.InstanceIOPSExceeded }},
+	{limitInstanceThroughput, true, func(c VolumeCounters) float64 { return c.InstanceThroughputExceeded }},
+}
+
+// rollup holds the totals of a node or of the cluster over the volumes'
+// latest intervals
+type rollup struct {
+	volumes    int
+	iops       float64
+	throughput float64
+	// exceeded is the exceeded time in microseconds, indexed like
+	// exceededLimits
+	exceeded          []float64
+	throttledVolume   int
+	throttledInstance int
+}
+
+func newRollup() *rollup {
+	return &rollup{exceeded: make([]float64, len(exceededLimits))}
+}
+
+// throttledVolume is a volume in the top throttled list
+type throttledVolume struct {
+	key     volumeKey
+	percent float64
+}
+
+// rollups is the result of an aggregation cycle
+type rollups struct {
+	nodes   map[string]*rollup
+	cluster *rollup
+	top     []throttledVolume
+}
+
+// rollupDescs holds the descriptors of the rollup metrics
+type rollupDescs struct {
+	nodeVolumes         *prometheus.Desc
+	nodeIOPS            *prometheus.Desc
+	nodeThroughput      *prometheus.Desc
+	nodeExceeded        *prometheus.Desc
+	nodeThrottled       *prometheus.Desc
+	clusterVolumes      *prometheus.Desc
+	clusterIOPS         *prometheus.Desc
+	clusterThroughput   *prometheus.Desc
+	clusterExceeded     *prometheus.Desc
+	clusterThrottled    *prometheus.Desc
+	clusterTopThrottled *prometheus.Desc
+}
+
+func newRollupDescs() rollupDescs {
+	constLabels := prometheus.Labels{"name": ebsExporterValue}
+	nodeLabels := []string{clusterIDLabel, nodeLabel}
+	clusterLabels := []string{clusterIDLabel}
+
+	return rollupDescs{
+		nodeVolumes: prometheus.NewDesc("ebs_node_volumes",
+			"Number of EBS volumes reported by the node",
+			nodeLabels, constLabels),
+		nodeIOPS: prometheus.NewDesc("ebs_node_iops",
+			"Read and write operations per second of the node's volumes during their last interval",
+			nodeLabels, constLabels),
+		nodeThroughput: prometheus.NewDesc("ebs_node_throughput_bytes_per_second",
+			"Bytes read and written per second by the node's volumes during their last interval",
+			nodeLabels, constLabels),
+		nodeExceeded: prometheus.NewDesc("ebs_node_performance_exceeded_microseconds",
+			"Time in microseconds a limit was exceeded during the last interval, summed over the node's volumes for volume limits and the maximum over them for instance limits",
+			append(nodeLabels, limitLabel), constLabels),
+		nodeThrottled: prometheus.NewDesc("ebs_node_throttled_volumes",
+			"Number of the node's volumes that exceeded a volume or instance limit during the last interval",
+			append(nodeLabels, limitLabel), constLabels),
+
+		clusterVolumes: prometheus.NewDesc("ebs_cluster_volumes",
+			"Number of EBS volumes reported in the cluster",
+			clusterLabels, constLabels),
+		clusterIOPS: prometheus.NewDesc("ebs_cluster_iops",
+			"Read and write operations per second of the cluster's volumes during their last interval",
+			clusterLabels, constLabels),
+		clusterThroughput: prometheus.NewDesc("ebs_cluster_throughput_bytes_per_second",
+			"Bytes read and written per second by the cluster's volumes during their last interval",
+			clusterLabels, constLabels),
+		clusterExceeded: prometheus.NewDesc("ebs_cluster_performance_exceeded_microseconds",
+			"Time in microseconds a limit was exceeded during the last interval, summed over the cluster's nodes",
+			append(clusterLabels, limitLabel), constLabels),
+		clusterThrottled: prometheus.NewDesc("ebs_cluster_throttled_volumes",
+			"Number of the cluster's volumes that exceeded a volume or instance limit during the last interval",
+			append(clusterLabels, limitLabel), constLabels),
+		clusterTopThrottled: prometheus.NewDesc("ebs_cluster_top_throttled_volume",
+			"Most throttled volumes of the cluster, by the highest percentage of the last interval any limit was exceeded",
+			[]string{clusterIDLabel, rankLabel, nodeLabel, deviceLabel, volumeIDLabel}, constLabels),
+	}
+}
+
+// describe sends the rollup descriptors
+func (d rollupDescs) describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		d.nodeVolumes, d.nodeIOPS, d.nodeThroughput, d.nodeExceeded, d.nodeThrottled,
+		d.clusterVolumes, d.clusterIOPS, d.clusterThroughput, d.clusterExceeded, d.clusterThrottled,
+		d.clusterTopThrottled,
+	} {
+		ch <- desc
+	}
+}
+
+// computeRollups totals the volumes per node and for the cluster, and ranks
+// the topN most throttled volumes. Volumes count towards the rates and
+// exceeded times from their second sample.
+func computeRollups(volumes map[volumeKey]*volumeState, topN int) *rollups {
+	result := &rollups{
+		nodes:   make(map[string]*rollup),
+		cluster: newRollup(),
+	}
+
+	var throttled []throttledVolume
+	for key, volume := range volumes {
+		node, ok := result.nodes[key.node]
+		if !ok {
+			node = newRollup()
+			result.nodes[key.node] = node
+		}
+		node.volumes++
+		result.cluster.volumes++
+
+		deltas := volume.deltas
+		if deltas == nil {
+			continue
+		}
+		c := deltas.counters
+		node.iops += deltas.perSecond(c.ReadOps + c.WriteOps)
+		node.throughput += deltas.perSecond(c.ReadBytes + c.WriteBytes)
+
+		// Every volume reports the time its I/O hit the shared instance
+		// limits, so those are not summed within a node
+		worst := 0.0
+		for i, limit := range exceededLimits {
+			exceeded := limit.exceeded(c)
+			if limit.instance {
+				node.exceeded[i] = max(node.exceeded[i], exceeded)
+			} else {
+				node.exceeded[i] += exceeded
+			}
+			worst = max(worst, deltas.percent(exceeded))
+		}
+
+		volumeLimit, instanceLimit := deltas.throttled()
+		if volumeLimit {
+			node.throttledVolume++
+		}
+		if instanceLimit {
+			node.throttledInstance++
+		}
+		if worst > 0 {
+			throttled = append(throttled, throttledVolume{key: key, percent: worst})
+		}
+	}
+
+	for _, node := range result.nodes {
+		result.cluster.iops += node.iops
+		result.cluster.throughput += node.throughput
+		for i := range exceededLimits {
+			result.cluster.exceeded[i] += node.exceeded[i]
+		}
+		result.cluster.throttledVolume += node.throttledVolume
+		result.cluster.throttledInstance += node.throttledInstance
+	}
+
+	sort.Slice(throttled, func(i, j int) bool {
+		if throttled[i].percent != throttled[j].percent {
+			return throttled[i].percent > throttled[j].percent
+		}
+		return throttled[i].key.volumeID < throttled[j].key.volumeID
+	})
+	if len(throttled) > topN {
+		throttled = throttled[:topN]
+	}
+	result.top = throttled
+
+	return result
+}
+
+// collect emits the rollup metrics
+func (r *rollups) collect(ch chan<- prometheus.Metric, descs rollupDescs, clusterId string) {
+	for name, node := range r.nodes {
+		node.collect(ch, clusterId, name, descs.nodeVolumes, descs.nodeIOPS, descs.nodeThroughput, descs.nodeExceeded, descs.nodeThrottled)
+	}
+	r.cluster.collect(ch, clusterId, "", descs.clusterVolumes, descs.clusterIOPS, descs.clusterThroughput, descs.clusterExceeded, descs.clusterThrottled)
+
+	for i, volume := range r.top {
+		ch <- prometheus.MustNewConstMetric(descs.clusterTopThrottled, prometheus.GaugeValue, volume.percent,
+			clusterId, strconv.Itoa(i+1), volume.key.node, volume.key.device, volume.key.volumeID)
+	}
+}
+
+// collect emits the metrics of a node rollup, or of the cluster rollup if
+// node is empty
+func (r *rollup) collect(ch chan<- prometheus.Metric, clusterId, node string, volumes, iops, throughput, exceeded, throttled *prometheus.Desc) {
+	labels := []string{clusterId}
+	if node != "" {
+		labels = append(labels, node)
+	}
+	withLimit := func(limit string) []string {
+		return append(append([]string{}, labels...), limit)
+	}
+
+	ch <- prometheus.MustNewConstMetric(volumes, prometheus.GaugeValue, float64(r.volumes), labels...)
+	ch <- prometheus.MustNewConstMetric(iops, prometheus.GaugeValue, r.iops, labels...)
+	ch <- prometheus.MustNewConstMetric(throughput, prometheus.GaugeValue, r.throughput, labels...)
+	for i, limit := range exceededLimits {
+		ch <- prometheus.MustNewConstMetric(exceeded, prometheus.GaugeValue, r.exceeded[i], withLimit(limit.name)...)
+	}
+	ch <- prometheus.MustNewConstMetric(throttled, prometheus.GaugeValue, float64(r.throttledVolume), withLimit(limitVolume)...)
+	ch <- prometheus.MustNewConstMetric(throttled, prometheus.GaugeValue, float64(r.throttledInstance), withLimit(limitInstance)...)
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// ErrOutOfOrder is returned for a sample that is not newer than the
+// volume's latest sample
+var ErrOutOfOrder = errors.New("sample is not newer than the volume's latest sample")
+
+// VolumeCounters holds the cumulative counters of a volume as reported by
+// the NVMe stats log page. Exceeded times are in microseconds.
+type VolumeCounters struct {
+	VolumeIOPSExceeded         float64
+	VolumeThroughputExceeded   float64
+	InstanceIOPSExceeded       float64
+	InstanceThroughputExceeded float64
+	ReadOps                    float64
+	WriteOps                   float64
+	ReadBytes                  float64
+	WriteBytes                 float64
+}
+
+// VolumeGauges holds the point-in-time values of a volume
+type VolumeGauges struct {
+	QueueLength float64
+}
+
+// LatencyHistogram is a cumulative I/O latency histogram in microseconds
+type LatencyHistogram struct {
+	// Buckets maps each upper bound to the number of I/Os at or below it
+	Buckets map[float64]uint64
+	Count   uint64
+	Sum     float64
+}
+
+// VolumeSample is a sample of a single volume's metrics as collected on its
+// node. It is the input of EBSMetricsAggregator.SetVolumeSample.
+type VolumeSample struct {
+	Node     string
+	Device   string
+	VolumeID string
+	// SampleTime is when the metrics were collected
+	SampleTime time.Time
+
+	Counters VolumeCounters
+	Gauges   VolumeGauges
+	// ReadLatency and WriteLatency are nil if the producer has no histograms
+	ReadLatency  *LatencyHistogram
+	WriteLatency *LatencyHistogram
+}
+
+// Validate checks that the sample identifies a volume and holds only finite,
+// non-negative values
+func (s VolumeSample) Validate() error {
+	if s.Node == "" || s.Device == "" || s.VolumeID == "" {
+		return fmt.Errorf("sample must have a node, device and volume ID (got %q, %q, %q)", s.Node, s.Device, s.VolumeID)
+	}
+	if s.SampleTime.IsZero() {
+		return fmt.Errorf("sample of volume %s has no sample time", s.VolumeID)
+	}
+
+	values := map[string]float64{
+		"volume IOPS exceeded":         s.Counters.VolumeIOPSExceeded,
+		"volume throughput exceeded":   s.Counters.VolumeThroughputExceeded,
+		"instance IOPS exceeded":       s.Counters.InstanceIOPSExceeded,
+		"instance throughput exceeded": s.Counters.InstanceThroughputExceeded,
+		"read ops":                     s.Counters.ReadOps,
+		"write ops":                    s.Counters.WriteOps,
+		"read bytes":                   s.Counters.ReadBytes,
+		"write bytes":                  s.Counters.WriteBytes,
+		"queue length":                 s.Gauges.QueueLength,
+	}
+	for name, value := range values {
+		if err := checkValue(value); err != nil {
+			return fmt.Errorf("invalid %s of volume %s: %w", name, s.VolumeID, err)
+		}
+	}
+
+	if err := s.ReadLatency.validate(); err != nil {
+		return fmt.Errorf("invalid read latency histogram of volume %s: %w", s.VolumeID, err)
+	}
+	if err := s.WriteLatency.validate(); err != nil {
+		return fmt.Errorf("invalid write latency histogram of volume %s: %w", s.VolumeID, err)
+	}
+	return nil
+}
+
+// validate checks that the bucket counts are cumulative and within the
+// total count. A nil histogram is valid.
+func (h *LatencyHistogram) validate() error {
+	if h == nil {
+		return nil
+	}
+	if err := checkValue(h.Sum); err != nil {
+		return fmt.Errorf("sum: %w", err)
+	}
+
+	bounds := make([]float64, 0, len(h.Buckets))
+	for bound := range h.Buckets {
+		if math.IsNaN(bound) {
+			return errors.New("NaN bucket bound")
+		}
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+
+	var previous uint64
+	for _, bound := range bounds {
+		count := h.Buckets[bound]
+		if count < previous {
+			return fmt.Errorf("bucket %g has count %d, below the previous bucket's %d", bound, count, previous)
+		}
+		previous = count
+	}
+	if previous > h.Count {
+		return fmt.Errorf("bucket count %d exceeds the total count %d", previous, h.Count)
+	}
+	return nil
+}
+
+// checkValue rejects NaN, infinite and negative values
+func checkValue(value float64) error {
+	switch {
+	case math.IsNaN(value) || math.IsInf(value, 0):
+		return fmt.Errorf("%g is not finite", value)
+	case value < 0:
+		return fmt.Errorf("%g is negative", value)
+	}
+	return nil
+}
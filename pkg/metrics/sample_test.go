@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// validSample returns a sample that passes validation
+func validSample() VolumeSample {
+	return VolumeSample{
+		Node:       "node-1",
+		Device:     "nvme1n1",
+		VolumeID:   "vol-0123456789abcdef0",
+		SampleTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Counters: VolumeCounters{
+			ReadOps:  100,
+			WriteOps: 50,
+		},
+		Gauges: VolumeGauges{QueueLength: 1},
+		ReadLatency: &LatencyHistogram{
+			Buckets: map[float64]uint64{128: 10, 256: 60, 512: 100},
+			Count:   100,
+			Sum:     25000,
+		},
+	}
+}
+
+func TestVolumeSampleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(s *VolumeSample)
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			modify: func(s *VolumeSample) {},
+		},
+		{
+			name:   "valid without histograms",
+			modify: func(s *VolumeSample) { s.ReadLatency = nil },
+		},
+		{
+			name:    "missing node",
+			modify:  func(s *VolumeSample) { s.Node = "" },
+			wantErr: true,
+		},
+		{
+			name:    "missing device",
+			modify:  func(s *VolumeSample) { s.Device = "" },
+			wantErr: true,
+		},
+		{
+			name:    "missing volume ID",
+			modify:  func(s *VolumeSample) { s.VolumeID = "" },
+			wantErr: true,
+		},
+		{
+			name:    "missing sample time",
+			modify:  func(s *VolumeSample) { s.SampleTime = time.Time{} },
+			wantErr: true,
+		},
+		{
+			name:    "negative counter",
+			modify:  func(s *VolumeSample) { s.Counters.VolumeIOPSExceeded = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "negative gauge",
+			modify:  func(s *VolumeSample) { s.Gauges.QueueLength = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "NaN counter",
+			modify:  func(s *VolumeSample) { s.Counters.ReadBytes = math.NaN() },
+			wantErr: true,
+		},
+		{
+			name:    "infinite counter",
+			modify:  func(s *VolumeSample) { s.Counters.WriteBytes = math.Inf(1) },
+			wantErr: true,
+		},
+		{
+			name: "non-cumulative histogram buckets",
+			modify: func(s *VolumeSample) {
+				s.ReadLatency.Buckets = map[float64]uint64{128: 10, 256: 5, 512: 100}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "histogram buckets above the count",
+			modify:  func(s *VolumeSample) { s.ReadLatency.Count = 50 },
+			wantErr: true,
+		},
+		{
+			name:    "negative histogram sum",
+			modify:  func(s *VolumeSample) { s.ReadLatency.Sum = -1 },
+			wantErr: true,
+		},
+		{
+			name: "NaN histogram bound",
+			modify: func(s *VolumeSample) {
+				s.WriteLatency = &LatencyHistogram{Buckets: map[float64]uint64{math.NaN(): 1}, Count: 1}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample := validSample()
+			tt.modify(&sample)
+
+			err := sample.Validate()
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -2,8 +2,12 @@ package nvme
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"syscall"
 	"unsafe"
@@ -15,11 +19,19 @@ const (
 	NVMEGetLogPage     = 0x02
 	NVMEIoctlAdminCmd  = 0xC0484E41
 	AmznNVMEEBSMN      = "Amazon Elastic Block Store"
+	AmznNVMEInstanceMN = "Amazon EC2 NVMe Instance Storage"
 	AmznNVMEStatsLogID = 0xD0
 	AmznNVMEStatsMagic = 0x3C23B510
 	AmznNVMEVID        = 0x1D0F
 )
 
+// ErrNotEBS is returned when a device is not an Amazon EBS volume
+var ErrNotEBS = errors.New("not an EBS device")
+
+// namespacePattern matches NVMe namespace block devices, excluding
+// partitions and controller character devices
+var namespacePattern = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+
 // nvmeAdminCommand represents the NVMe admin command structure
 type nvmeAdminCommand struct {
 	Opcode     uint8
@@ -78,6 +90,13 @@ type nvmeIdentifyController struct {
 	VS        [1024]uint8 // Vendor Specific
 }
 
+// amznVendorSpecific represents the Amazon vendor specific area of the
+// Identify Controller structure
+type amznVendorSpecific struct {
+	BDev      [32]byte // EC2 block device mapping name
+	Reserved0 [1024 - 32]byte
+}
+
 // nvmeHistogramBin represents a histogram bin
 type nvmeHistogramBin struct {
 	Lower     uint64
@@ -113,10 +132,59 @@ type EBSNVMEStats struct {
 	Reserved2                         [496]byte
 }
 
+// HistogramBin is a single populated latency histogram bin. Bounds are in
+// microseconds.
+type HistogramBin struct {
+	Lower uint64
+	Upper uint64
+	Count uint64
+}
+
+// Buckets returns the populated bins of the histogram
+func (h *ebsNVMEHistogram) Buckets() []HistogramBin {
+	numBins := h.NumBins
+	if numBins > uint64(len(h.Bins)) {
+		numBins = uint64(len(h.Bins))
+	}
+
+	bins := make([]HistogramBin, 0, numBins)
+	for _, bin := range h.Bins[:numBins] {
+		bins = append(bins, HistogramBin{
+			Lower: bin.Lower,
+			Upper: bin.Upper,
+			Count: uint64(bin.Count),
+		})
+	}
+	return bins
+}
+
+// StatsPageSize is the size of the raw EBS stats log page
+const StatsPageSize = int(unsafe.Sizeof(EBSNVMEStats{}))
+
+// IdentifyDataSize is the size of the raw Identify Controller data
+const IdentifyDataSize = int(unsafe.Sizeof(nvmeIdentifyController{}))
+
+// PageReader reads the raw EBS stats log page of a device. The default
+// reader issues the Get Log Page admin command; other readers, such as the
+// replay backend, serve pages recorded earlier.
+type PageReader interface {
+	ReadStatsPage() ([]byte, error)
+	Close() error
+}
+
 // Device represents an NVMe EBS device
 type Device struct {
 	Path     string
 	VolumeID string
+
+	// EC2DeviceName is the block device mapping name (e.g., /dev/sdf)
+	// reported in the vendor specific area of the Identify Controller data
+	EC2DeviceName string
+	Model         string
+	Firmware      string
+
+	identify []byte
+	reader   PageReader
 }
 
 // nvmeIOCTL performs an NVMe IOCTL command
@@ -133,29 +201,103 @@ func nvmeIOCTL(device *os.File, cmd *nvmeAdminCommand) error {
 	return nil
 }
 
-// OpenDevice opens an NVMe device and retrieves its volume ID
+// ioctlReader reads the stats log page from an open device file
+type ioctlReader struct {
+	file *os.File
+}
+
+// ReadStatsPage issues the Get Log Page admin command
+func (r *ioctlReader) ReadStatsPage() ([]byte, error) {
+	page := make([]byte, StatsPageSize)
+	cmd := nvmeAdminCommand{
+		Opcode: NVMEGetLogPage,
+		Addr:   uint64(uintptr(unsafe.Pointer(&page[0]))),
+		ALen:   uint32(len(page)),
+		NSID:   1,
+		CDW10:  AmznNVMEStatsLogID | (1024 << 16),
+	}
+
+	if err := nvmeIOCTL(r.file, &cmd); err != nil {
+		return nil, fmt.Errorf("get log page failed: %w", err)
+	}
+	return page, nil
+}
+
+// Close closes the device file
+func (r *ioctlReader) Close() error {
+	return r.file.Close()
+}
+
+// OpenDevice opens an NVMe device and retrieves its volume ID. The device
+// handle stays open until Close is called.
 func OpenDevice(devicePath string) (*Device, error) {
 	// Open device for reading
 	dev, err := os.Open(devicePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open device %s: %w", devicePath, err)
 	}
-	defer dev.Close()
+
+	idCtrl, err := identifyController(dev)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to identify device: %w", err)
+	}
+
+	identify := make([]byte, IdentifyDataSize)
+	copy(identify, unsafe.Slice((*byte)(unsafe.Pointer(idCtrl)), IdentifyDataSize))
+
+	device, err := NewDevice(devicePath, identify, &ioctlReader{file: dev})
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return device, nil
+}
+
+// NewDevice creates a device from raw Identify Controller data and a page
+// reader. It is used by OpenDevice and by backends that do not talk to a
+// real device.
+func NewDevice(devicePath string, identify []byte, reader PageReader) (*Device, error) {
+	if len(identify) < IdentifyDataSize {
+		return nil, fmt.Errorf("identify data too short: %d bytes (expected %d)", len(identify), IdentifyDataSize)
+	}
+	var idCtrl nvmeIdentifyController
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&idCtrl)), IdentifyDataSize), identify)
 
 	// Get volume ID
-	volumeID, err := getVolumeID(dev)
+	volumeID, err := getVolumeID(&idCtrl)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get volume ID: %w", err)
 	}
 
 	return &Device{
-		Path:     devicePath,
-		VolumeID: volumeID,
+		Path:          devicePath,
+		VolumeID:      volumeID,
+		EC2DeviceName: getEC2DeviceName(&idCtrl),
+		Model:         trimField(idCtrl.MN[:]),
+		Firmware:      trimField(idCtrl.FR[:]),
+		identify:      identify[:IdentifyDataSize],
+		reader:        reader,
 	}, nil
 }
 
-// getVolumeID retrieves the EBS volume ID from the device
-func getVolumeID(dev *os.File) (string, error) {
+// Close closes the device handle
+func (d *Device) Close() error {
+	if d.reader == nil {
+		return nil
+	}
+	err := d.reader.Close()
+	d.reader = nil
+	return err
+}
+
+// IdentifyData returns a copy of the raw Identify Controller data
+func (d *Device) IdentifyData() []byte {
+	return append([]byte(nil), d.identify...)
+}
+
+// identifyController sends the Identify Controller admin command
+func identifyController(dev *os.File) (*nvmeIdentifyController, error) {
 	var idCtrl nvmeIdentifyController
 	cmd := nvmeAdminCommand{
 		Opcode: NVMEAdminIdentify,
@@ -165,21 +307,26 @@ func getVolumeID(dev *os.File) (string, error) {
 	}
 
 	if err := nvmeIOCTL(dev, &cmd); err != nil {
-		return "", fmt.Errorf("identify controller failed: %w", err)
+		return nil, fmt.Errorf("identify controller failed: %w", err)
 	}
 
+	return &idCtrl, nil
+}
+
+// getVolumeID retrieves the EBS volume ID from the Identify Controller data
+func getVolumeID(idCtrl *nvmeIdentifyController) (string, error) {
 	// Verify it's an Amazon EBS device
 	if idCtrl.VID != AmznNVMEVID {
-		return "", fmt.Errorf("not an Amazon NVMe device (VID: 0x%x)", idCtrl.VID)
+		return "", fmt.Errorf("%w: not an Amazon NVMe device (VID: 0x%x)", ErrNotEBS, idCtrl.VID)
 	}
 
-	mn := strings.TrimSpace(string(bytes.Trim(idCtrl.MN[:], "\x00")))
+	mn := trimField(idCtrl.MN[:])
 	if mn != AmznNVMEEBSMN {
-		return "", fmt.Errorf("not an EBS device (model: %s)", mn)
+		return "", fmt.Errorf("%w (model: %s)", ErrNotEBS, mn)
 	}
 
 	// Extract volume ID from serial number
-	sn := strings.TrimSpace(string(bytes.Trim(idCtrl.SN[:], "\x00")))
+	sn := trimField(idCtrl.SN[:])
 	vol := sn
 	if strings.HasPrefix(vol, "vol") && len(vol) > 3 && vol[3] != '-' {
 		vol = "vol-" + vol[3:]
@@ -188,27 +335,55 @@ func getVolumeID(dev *os.File) (string, error) {
 	return vol, nil
 }
 
+// getEC2DeviceName retrieves the EC2 block device mapping name from the
+// Amazon vendor specific area, prefixing it with /dev/ when needed
+func getEC2DeviceName(idCtrl *nvmeIdentifyController) string {
+	name := getVendorBDev(idCtrl)
+	if name != "" && !strings.HasPrefix(name, "/dev/") {
+		name = "/dev/" + name
+	}
+	return name
+}
+
+// getVendorBDev returns the raw block device name from the Amazon vendor
+// specific area. Instance store volumes report virtual names such as
+// ephemeral0 here.
+func getVendorBDev(idCtrl *nvmeIdentifyController) string {
+	vs := (*amznVendorSpecific)(unsafe.Pointer(&idCtrl.VS))
+	return trimField(vs.BDev[:])
+}
+
+// trimField converts a space or NUL padded identify field to a string
+func trimField(field []byte) string {
+	return strings.TrimSpace(string(bytes.Trim(field, "\x00")))
+}
+
 // QueryStats queries EBS performance statistics from the device
 func (d *Device) QueryStats() (*EBSNVMEStats, error) {
-	dev, err := os.Open(d.Path)
+	page, err := d.ReadStatsPage()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open device: %w", err)
+		return nil, err
 	}
-	defer dev.Close()
+	return DecodeStats(page)
+}
 
-	var stats EBSNVMEStats
-	cmd := nvmeAdminCommand{
-		Opcode: NVMEGetLogPage,
-		Addr:   uint64(uintptr(unsafe.Pointer(&stats))),
-		ALen:   uint32(unsafe.Sizeof(stats)),
-		NSID:   1,
-		CDW10:  AmznNVMEStatsLogID | (1024 << 16),
+// ReadStatsPage reads the raw EBS stats log page from the device
+func (d *Device) ReadStatsPage() ([]byte, error) {
+	if d.reader == nil {
+		return nil, fmt.Errorf("device %s is closed", d.Path)
 	}
+	return d.reader.ReadStatsPage()
+}
 
-	if err := nvmeIOCTL(dev, &cmd); err != nil {
-		return nil, fmt.Errorf("get log page failed: %w", err)
+// DecodeStats decodes a raw EBS stats log page
+func DecodeStats(page []byte) (*EBSNVMEStats, error) {
+	if len(page) < StatsPageSize {
+		return nil, fmt.Errorf("stats page too short: %d bytes (expected %d)", len(page), StatsPageSize)
 	}
 
+	var stats EBSNVMEStats
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&stats)), StatsPageSize), page)
+
 	// Verify magic number
 	if stats.Magic != AmznNVMEStatsMagic {
 		return nil, fmt.Errorf("invalid stats magic number: 0x%x (expected 0x%x)", stats.Magic, AmznNVMEStatsMagic)
@@ -217,6 +392,119 @@ func (d *Device) QueryStats() (*EBSNVMEStats, error) {
 	return &stats, nil
 }
 
+// EncodeStats encodes stats as a raw EBS stats log page. It is the inverse
+// of DecodeStats.
+func EncodeStats(stats *EBSNVMEStats) []byte {
+	return append([]byte(nil), unsafe.Slice((*byte)(unsafe.Pointer(stats)), StatsPageSize)...)
+}
+
+// DeviceKind classifies an NVMe device
+type DeviceKind string
+
+const (
+	DeviceKindEBS           DeviceKind = "ebs"
+	DeviceKindInstanceStore DeviceKind = "instance-store"
+	DeviceKindOther         DeviceKind = "other"
+)
+
+// Identity holds the Identify Controller data of any NVMe device
+type Identity struct {
+	Path         string
+	Kind         DeviceKind
+	VendorID     uint16
+	Model        string
+	SerialNumber string
+	Firmware     string
+
+	// VolumeID is only set for EBS volumes
+	VolumeID string
+
+	// EC2DeviceName is set for EBS and instance store volumes
+	EC2DeviceName string
+}
+
+// Identify reads the Identify Controller data of an NVMe device without
+// requiring it to be an EBS volume
+func Identify(devicePath string) (*Identity, error) {
+	dev, err := os.Open(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %w", devicePath, err)
+	}
+	defer dev.Close()
+
+	idCtrl, err := identifyController(dev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to identify device: %w", err)
+	}
+
+	identity := &Identity{
+		Path:         devicePath,
+		Kind:         DeviceKindOther,
+		VendorID:     idCtrl.VID,
+		Model:        trimField(idCtrl.MN[:]),
+		SerialNumber: trimField(idCtrl.SN[:]),
+		Firmware:     trimField(idCtrl.FR[:]),
+	}
+
+	if idCtrl.VID != AmznNVMEVID {
+		return identity, nil
+	}
+	switch identity.Model {
+	case AmznNVMEEBSMN:
+		identity.Kind = DeviceKindEBS
+		identity.VolumeID, _ = getVolumeID(idCtrl)
+		identity.EC2DeviceName = getEC2DeviceName(idCtrl)
+	case AmznNVMEInstanceMN:
+		identity.Kind = DeviceKindInstanceStore
+		identity.EC2DeviceName = getVendorBDev(idCtrl)
+	}
+
+	return identity, nil
+}
+
+// ListNamespaces returns the paths of all NVMe namespace block devices on
+// the host, sorted by name
+func ListNamespaces() ([]string, error) {
+	matches, err := filepath.Glob("/dev/nvme*n*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NVMe devices: %w", err)
+	}
+
+	var paths []string
+	for _, match := range matches {
+		if namespacePattern.MatchString(filepath.Base(match)) {
+			paths = append(paths, match)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// OpenAllDevices opens every EBS volume attached to the host. NVMe devices
+// that are not EBS volumes, such as instance store volumes, are skipped.
+func OpenAllDevices() ([]*Device, error) {
+	paths, err := ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []*Device
+	for _, path := range paths {
+		device, err := OpenDevice(path)
+		if errors.Is(err, ErrNotEBS) {
+			continue
+		}
+		if err != nil {
+			for _, device := range devices {
+				device.Close()
+			}
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
 // MustOpenDevice opens a device and panics on error (for initialization)
 func MustOpenDevice(devicePath string) *Device {
 	dev, err := OpenDevice(devicePath)
@@ -0,0 +1,197 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/ec2metadata"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+const (
+	// DefaultEMFNamespace is the CloudWatch namespace of the EMF metrics
+	DefaultEMFNamespace = "EBSMetricsExporter"
+
+	// CloudWatch storage resolutions in seconds
+	EMFResolutionHigh     = 1
+	EMFResolutionStandard = 60
+)
+
+// emfMetric maps a CloudWatch metric to a rate
+type emfMetric struct {
+	name  string
+	unit  string
+	value func(rates collector.Rates, stats *nvme.EBSNVMEStats) float64
+}
+
+// emfMetrics lists the metrics in every document
+var emfMetrics = []emfMetric{
+	{"ReadIOPS", "Count/Second", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.ReadIOPS }},
+	{"WriteIOPS", "Count/Second", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.WriteIOPS }},
+	{"ReadThroughput", "Bytes/Second", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.ReadBytesPerSecond }},
+	{"WriteThroughput", "Bytes/Second", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.WriteBytesPerSecond }},
+	{"AvgReadLatency", "Microseconds", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.AvgReadLatency }},
+	{"AvgWriteLatency", "Microseconds", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.AvgWriteLatency }},
+	{"VolumeIOPSExceededTime", "Microseconds", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.VolumeIOPSExceeded }},
+	{"VolumeThroughputExceededTime", "Microseconds", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.VolumeThroughputExceeded }},
+	{"InstanceIOPSExceededTime", "Microseconds", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.InstanceIOPSExceeded }},
+	{"InstanceThroughputExceededTime", "Microseconds", func(r collector.Rates, _ *nvme.EBSNVMEStats) float64 { return r.InstanceThroughputExceeded }},
+	{"VolumeQueueLength", "Count", func(_ collector.Rates, s *nvme.EBSNVMEStats) float64 { return float64(s.VolumeQueueLength) }},
+}
+
+// EMFConfig configures the CloudWatch EMF sink
+type EMFConfig struct {
+	// Namespace defaults to DefaultEMFNamespace
+	Namespace string
+	// Resolution is the CloudWatch storage resolution in seconds, either
+	// EMFResolutionHigh or EMFResolutionStandard
+	Resolution int
+	// Instance, if set, adds the InstanceId dimension
+	Instance *ec2metadata.InstanceMetadata
+}
+
+// emfPrevious is the stats a device's next rates are computed from
+type emfPrevious struct {
+	stats *nvme.EBSNVMEStats
+	time  time.Time
+}
+
+// EMFSink writes CloudWatch Embedded Metric Format documents, one JSON
+// line per device, for the CloudWatch agent or Lambda-style log ingestion.
+// Rates cover the time since the sink's previous write, so the sink can be
+// written less often than the sampler samples.
+type EMFSink struct {
+	w          io.Writer
+	closer     io.Closer
+	namespace  string
+	resolution int
+	instance   *ec2metadata.InstanceMetadata
+
+	mutex    sync.Mutex
+	previous map[string]emfPrevious
+}
+
+// NewEMFSink creates a sink writing to path, appending if the file exists.
+// A path of "-" writes to stdout.
+func NewEMFSink(path string, config EMFConfig) (*EMFSink, error) {
+	if config.Resolution != EMFResolutionHigh && config.Resolution != EMFResolutionStandard {
+		return nil, fmt.Errorf("invalid EMF resolution %d (must be %d or %d)", config.Resolution, EMFResolutionHigh, EMFResolutionStandard)
+	}
+
+	sink := &EMFSink{
+		w:          os.Stdout,
+		namespace:  config.Namespace,
+		resolution: config.Resolution,
+		instance:   config.Instance,
+		previous:   make(map[string]emfPrevious),
+	}
+	if sink.namespace == "" {
+		sink.namespace = DefaultEMFNamespace
+	}
+
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open EMF log: %w", err)
+		}
+		sink.w = file
+		sink.closer = file
+	}
+
+	return sink, nil
+}
+
+// Name implements collector.Sink
+func (s *EMFSink) Name() string {
+	return "emf"
+}
+
+// Write implements collector.Sink. A device's first write only records its
+// stats, since rates need two samples.
+func (s *EMFSink) Write(ctx context.Context, samples []collector.DeviceSample) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var buf []byte
+	for _, sample := range samples {
+		// Devices whose last query failed are skipped until they recover
+		if sample.Stats == nil {
+			continue
+		}
+
+		previous, ok := s.previous[sample.Device.Path]
+		s.previous[sample.Device.Path] = emfPrevious{stats: sample.Stats, time: sample.SampleTime}
+		if !ok || !sample.SampleTime.After(previous.time) {
+			continue
+		}
+
+		rates := collector.ComputeRates(previous.stats, sample.Stats, sample.SampleTime.Sub(previous.time))
+		document, err := json.Marshal(s.document(sample, rates))
+		if err != nil {
+			return fmt.Errorf("failed to encode EMF document: %w", err)
+		}
+		buf = append(append(buf, document...), '\n')
+	}
+
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := s.w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write EMF documents: %w", err)
+	}
+	return nil
+}
+
+// document builds the EMF document of a device. Dimension values and
+// metric values are top-level members referenced by the _aws metadata.
+func (s *EMFSink) document(sample collector.DeviceSample, rates collector.Rates) map[string]any {
+	document := map[string]any{
+		"VolumeId": sample.Device.VolumeID,
+		"Device":   sample.DeviceName(),
+	}
+	dimensions := []string{"VolumeId", "Device"}
+
+	if s.instance != nil {
+		document["InstanceId"] = s.instance.InstanceID
+		document["InstanceType"] = s.instance.InstanceType
+		document["AvailabilityZone"] = s.instance.AvailabilityZone
+		dimensions = []string{"VolumeId", "InstanceId", "Device"}
+	}
+	if sample.Device.EC2DeviceName != "" {
+		document["EC2DeviceName"] = sample.Device.EC2DeviceName
+	}
+
+	metrics := make([]map[string]any, 0, len(emfMetrics))
+	for _, metric := range emfMetrics {
+		document[metric.name] = metric.value(rates, sample.Stats)
+		metrics = append(metrics, map[string]any{
+			"Name":              metric.name,
+			"Unit":              metric.unit,
+			"StorageResolution": s.resolution,
+		})
+	}
+
+	document["_aws"] = map[string]any{
+		"Timestamp": sample.SampleTime.UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  s.namespace,
+			"Dimensions": [][]string{dimensions},
+			"Metrics":    metrics,
+		}},
+	}
+	return document
+}
+
+// Close implements collector.Sink
+func (s *EMFSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,372 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/ec2metadata"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// DefaultInfluxMeasurement is the measurement every device is written to
+const DefaultInfluxMeasurement = "ebs"
+
+// influxCounterField maps a line protocol field to a stats counter
+type influxCounterField struct {
+	name  string
+	value func(stats *nvme.EBSNVMEStats) uint64
+}
+
+// influxCounterFields lists the stats counters written as integer fields
+var influxCounterFields = []influxCounterField{
+	{"total_read_ops", func(s *nvme.EBSNVMEStats) uint64 { return s.TotalReadOps }},
+	{"total_write_ops", func(s *nvme.EBSNVMEStats) uint64 { return s.TotalWriteOps }},
+	{"total_read_bytes", func(s *nvme.EBSNVMEStats) uint64 { return s.TotalReadBytes }},
+	{"total_write_bytes", func(s *nvme.EBSNVMEStats) uint64 { return s.TotalWriteBytes }},
+	{"total_read_time_us", func(s *nvme.EBSNVMEStats) uint64 { return s.TotalReadTime }},
+	{"total_write_time_us", func(s *nvme.EBSNVMEStats) uint64 { return s.TotalWriteTime }},
+	{"volume_performance_exceeded_iops_us", func(s *nvme.EBSNVMEStats) uint64 { return s.EBSVolumePerformanceExceededIOPS }},
+	{"volume_performance_exceeded_throughput_us", func(s *nvme.EBSNVMEStats) uint64 { return s.EBSVolumePerformanceExceededTP }},
+	{"instance_performance_exceeded_iops_us", func(s *nvme.EBSNVMEStats) uint64 { return s.EBSInstancePerformanceExceededIOPS }},
+	{"instance_performance_exceeded_throughput_us", func(s *nvme.EBSNVMEStats) uint64 { return s.EBSInstancePerformanceExceededTP }},
+	{"volume_queue_length", func(s *nvme.EBSNVMEStats) uint64 { return s.VolumeQueueLength }},
+}
+
+// InfluxConfig configures the InfluxDB sink
+type InfluxConfig struct {
+	// URL is the InfluxDB v2 server, e.g. http://localhost:8086, or
+	// udp://host:port for a UDP listener
+	URL    string
+	Org    string
+	Bucket string
+	Token  string
+	TLS    TLSConfig
+	// Timeout bounds each HTTP write
+	Timeout time.Duration
+
+	// Measurement defaults to DefaultInfluxMeasurement
+	Measurement string
+	// Tags are added to every line
+	Tags map[string]string
+	// Instance, if set, is added to every line as tags
+	Instance *ec2metadata.InstanceMetadata
+}
+
+// influxWriter delivers encoded lines
+type influxWriter interface {
+	write(ctx context.Context, lines [][]byte) error
+	close() error
+}
+
+// InfluxSink writes device metrics in InfluxDB line protocol, with one
+// line per device carrying every stats counter, the rates derived from the
+// previous sample and the latency histogram bins as fields
+type InfluxSink struct {
+	name        string
+	writer      influxWriter
+	measurement string
+	tags        string
+}
+
+// NewInfluxSink creates a sink writing to an InfluxDB v2 write API or a
+// UDP listener
+func NewInfluxSink(config InfluxConfig) (*InfluxSink, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+
+	var writer influxWriter
+	switch u.Scheme {
+	case "http", "https":
+		writer, err = newInfluxHTTPWriter(u, config)
+	case "udp":
+		writer, err = newInfluxUDPWriter(u.Host)
+	default:
+		return nil, fmt.Errorf("unsupported InfluxDB URL %q (must be http, https or udp)", config.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newInfluxSink("influxdb", writer, config), nil
+}
+
+// NewInfluxStreamSink creates a sink writing lines to w, e.g. stdout for
+// the Telegraf execd input
+func NewInfluxStreamSink(w io.Writer, config InfluxConfig) *InfluxSink {
+	return newInfluxSink("influx-stream", &influxStreamWriter{w: w}, config)
+}
+
+func newInfluxSink(name string, writer influxWriter, config InfluxConfig) *InfluxSink {
+	measurement := config.Measurement
+	if measurement == "" {
+		measurement = DefaultInfluxMeasurement
+	}
+
+	return &InfluxSink{
+		name:        name,
+		writer:      writer,
+		measurement: influxEscape(measurement, false),
+		tags:        influxTags(config.Tags, config.Instance),
+	}
+}
+
+// Name implements collector.Sink
+func (s *InfluxSink) Name() string {
+	return s.name
+}
+
+// Write implements collector.Sink
+func (s *InfluxSink) Write(ctx context.Context, samples []collector.DeviceSample) error {
+	lines := make([][]byte, 0, len(samples))
+	for _, sample := range samples {
+		// Devices whose last query failed are skipped until they recover
+		if sample.Stats == nil {
+			continue
+		}
+		lines = append(lines, s.line(sample))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return s.writer.write(ctx, lines)
+}
+
+// Close implements collector.Sink
+func (s *InfluxSink) Close() error {
+	return s.writer.close()
+}
+
+// line encodes a device sample as a single line
+func (s *InfluxSink) line(sample collector.DeviceSample) []byte {
+	var b bytes.Buffer
+	b.WriteString(s.measurement)
+	b.WriteString(",device=")
+	b.WriteString(influxEscape(sample.DeviceName(), true))
+	b.WriteString(",volume_id=")
+	b.WriteString(influxEscape(sample.Device.VolumeID, true))
+	if sample.Device.EC2DeviceName != "" {
+		b.WriteString(",ec2_device_name=")
+		b.WriteString(influxEscape(sample.Device.EC2DeviceName, true))
+	}
+	b.WriteString(s.tags)
+	b.WriteByte(' ')
+
+	first := true
+	field := func(name, value string) {
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+	intField := func(name string, value uint64) {
+		field(name, strconv.FormatUint(value, 10)+"i")
+	}
+	floatField := func(name string, value float64) {
+		field(name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	for _, counter := range influxCounterFields {
+		intField(counter.name, counter.value(sample.Stats))
+	}
+
+	if rates, ok := sample.Rates(); ok {
+		floatField("read_iops", rates.ReadIOPS)
+		floatField("write_iops", rates.WriteIOPS)
+		floatField("read_bytes_per_second", rates.ReadBytesPerSecond)
+		floatField("write_bytes_per_second", rates.WriteBytesPerSecond)
+		floatField("avg_read_latency_us", rates.AvgReadLatency)
+		floatField("avg_write_latency_us", rates.AvgWriteLatency)
+		floatField("volume_iops_exceeded_pct", rates.VolumeIOPSExceededPercent)
+		floatField("volume_throughput_exceeded_pct", rates.VolumeThroughputExceededPercent)
+		floatField("instance_iops_exceeded_pct", rates.InstanceIOPSExceededPercent)
+		floatField("instance_throughput_exceeded_pct", rates.InstanceThroughputExceededPercent)
+	}
+
+	// Histogram bins are named by their bounds in microseconds, e.g.
+	// read_latency_us_128_256
+	for _, bin := range sample.Stats.ReadIOLatencyHistogram.Buckets() {
+		intField(fmt.Sprintf("read_latency_us_%d_%d", bin.Lower, bin.Upper), bin.Count)
+	}
+	for _, bin := range sample.Stats.WriteIOLatencyHistogram.Buckets() {
+		intField(fmt.Sprintf("write_latency_us_%d_%d", bin.Lower, bin.Upper), bin.Count)
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(sample.SampleTime.UnixNano(), 10))
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// influxTags encodes the tags shared by every line, sorted by key as
+// InfluxDB recommends
+func influxTags(tags map[string]string, instance *ec2metadata.InstanceMetadata) string {
+	all := make(map[string]string, len(tags)+4)
+	if instance != nil {
+		all = instance.Labels()
+	}
+	for key, value := range tags {
+		all[key] = value
+	}
+
+	keys := make([]string, 0, len(all))
+	for key, value := range all {
+		// Empty tag values are not allowed
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString("," + influxEscape(key, true) + "=" + influxEscape(all[key], true))
+	}
+	return b.String()
+}
+
+// influxEscape escapes a measurement name, or a tag key or value if tag is
+// set
+func influxEscape(value string, tag bool) string {
+	if tag {
+		return strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(value)
+	}
+	return strings.NewReplacer(",", `\,`, " ", `\ `).Replace(value)
+}
+
+// influxHTTPWriter writes to the InfluxDB v2 write API
+type influxHTTPWriter struct {
+	client  *http.Client
+	url     string
+	token   string
+	timeout time.Duration
+}
+
+func newInfluxHTTPWriter(u *url.URL, config InfluxConfig) (*influxHTTPWriter, error) {
+	if config.Org == "" {
+		return nil, fmt.Errorf("InfluxDB organization is required")
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("InfluxDB bucket is required")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if u.Scheme == "https" {
+		tlsConfig, err := config.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	query := url.Values{}
+	query.Set("org", config.Org)
+	query.Set("bucket", config.Bucket)
+	query.Set("precision", "ns")
+	write := *u
+	write.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	write.RawQuery = query.Encode()
+
+	return &influxHTTPWriter{
+		client:  &http.Client{Transport: transport},
+		url:     write.String(),
+		token:   config.Token,
+		timeout: config.Timeout,
+	}, nil
+}
+
+func (w *influxHTTPWriter) write(ctx context.Context, lines [][]byte) error {
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(bytes.Join(lines, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("InfluxDB write failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("InfluxDB write failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (w *influxHTTPWriter) close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// influxUDPWriter sends every line as a separate datagram, since a line
+// with both histograms can exceed a typical MTU
+type influxUDPWriter struct {
+	conn net.Conn
+}
+
+func newInfluxUDPWriter(address string) (*influxUDPWriter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to InfluxDB at %s: %w", address, err)
+	}
+	return &influxUDPWriter{conn: conn}, nil
+}
+
+func (w *influxUDPWriter) write(ctx context.Context, lines [][]byte) error {
+	for _, line := range lines {
+		if _, err := w.conn.Write(line); err != nil {
+			return fmt.Errorf("InfluxDB UDP write failed: %w", err)
+		}
+	}
+	return nil
+}
+
+func (w *influxUDPWriter) close() error {
+	return w.conn.Close()
+}
+
+// influxStreamWriter writes lines to a stream
+type influxStreamWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (w *influxStreamWriter) write(ctx context.Context, lines [][]byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, err := w.w.Write(bytes.Join(lines, nil)); err != nil {
+		return fmt.Errorf("failed to write lines: %w", err)
+	}
+	return nil
+}
+
+func (w *influxStreamWriter) close() error {
+	return nil
+}
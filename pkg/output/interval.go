@@ -0,0 +1,66 @@
+package output
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+)
+
+// closeTimeout bounds the final write made when a throttled sink is closed
+const closeTimeout = 5 * time.Second
+
+// intervalSink passes samples to the wrapped sink at most once per interval
+type intervalSink struct {
+	collector.Sink
+	interval time.Duration
+
+	mutex     sync.Mutex
+	lastWrite time.Time
+	pending   []collector.DeviceSample
+}
+
+// WithInterval wraps a sink so that it is written at most once per
+// interval, for outputs that should push less often than the sampler
+// samples. Samples skipped since the last write are written when the sink
+// is closed. A zero interval returns the sink unchanged.
+func WithInterval(sink collector.Sink, interval time.Duration) collector.Sink {
+	if interval <= 0 {
+		return sink
+	}
+	return &intervalSink{Sink: sink, interval: interval}
+}
+
+// Write implements collector.Sink
+func (s *intervalSink) Write(ctx context.Context, samples []collector.DeviceSample) error {
+	s.mutex.Lock()
+	if time.Since(s.lastWrite) < s.interval {
+		s.pending = samples
+		s.mutex.Unlock()
+		return nil
+	}
+	s.lastWrite = time.Now()
+	s.pending = nil
+	s.mutex.Unlock()
+
+	return s.Sink.Write(ctx, samples)
+}
+
+// Close implements collector.Sink
+func (s *intervalSink) Close() error {
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+
+	if pending != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		if err := s.Sink.Write(ctx, pending); err != nil {
+			s.Sink.Close()
+			return err
+		}
+	}
+	return s.Sink.Close()
+}
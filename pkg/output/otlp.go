@@ -0,0 +1,422 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/ec2metadata"
+)
+
+// OTLP transport protocols, named as in OTEL_EXPORTER_OTLP_PROTOCOL
+const (
+	OTLPProtocolGRPC = "grpc"
+	OTLPProtocolHTTP = "http/protobuf"
+)
+
+const (
+	otlpScopeName   = "github.com/nephomaniac/ebs-metrics-exporter"
+	otlpServiceName = "ebs-metrics-exporter"
+	otlpMetricsPath = "/v1/metrics"
+)
+
+// OTLPConfig configures the OTLP sink
+type OTLPConfig struct {
+	// Endpoint is host:port for gRPC, or a URL for HTTP. The HTTP path
+	// defaults to /v1/metrics.
+	Endpoint string
+	Protocol string
+	Headers  map[string]string
+	// Insecure disables TLS
+	Insecure bool
+	TLS      TLSConfig
+	Timeout  time.Duration
+	// Instance, if set, is added to every resource
+	Instance *ec2metadata.InstanceMetadata
+}
+
+// otlpExporter sends export requests over a single transport
+type otlpExporter interface {
+	export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error)
+	close() error
+}
+
+// OTLPSink pushes device metrics to an OpenTelemetry receiver. Counters are
+// sent as cumulative monotonic sums, the queue length as a gauge and the
+// latency histograms as explicit-bucket histograms, with one resource per
+// device.
+type OTLPSink struct {
+	exporter otlpExporter
+	timeout  time.Duration
+	instance *ec2metadata.InstanceMetadata
+
+	mutex sync.Mutex
+	// startTimes holds the start of each device's cumulative series, keyed
+	// by device path. The device counts from volume attachment, which is
+	// unknown, so a series starts when the device is first exported and
+	// restarts when its counters go backwards.
+	startTimes map[string]time.Time
+}
+
+// NewOTLPSink creates an OTLP sink
+func NewOTLPSink(config OTLPConfig) (*OTLPSink, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("OTLP endpoint is required")
+	}
+
+	var exporter otlpExporter
+	var err error
+	switch config.Protocol {
+	case OTLPProtocolGRPC:
+		exporter, err = newOTLPGRPCExporter(config)
+	case OTLPProtocolHTTP:
+		exporter, err = newOTLPHTTPExporter(config)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q (must be %s or %s)", config.Protocol, OTLPProtocolGRPC, OTLPProtocolHTTP)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &OTLPSink{
+		exporter:   exporter,
+		timeout:    config.Timeout,
+		instance:   config.Instance,
+		startTimes: make(map[string]time.Time),
+	}, nil
+}
+
+// Name implements collector.Sink
+func (s *OTLPSink) Name() string {
+	return "otlp"
+}
+
+// Write implements collector.Sink
+func (s *OTLPSink) Write(ctx context.Context, samples []collector.DeviceSample) error {
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	for _, sample := range samples {
+		// Devices whose last query failed are skipped until they recover
+		if sample.Stats == nil {
+			continue
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, s.resourceMetrics(sample))
+	}
+	if len(req.ResourceMetrics) == 0 {
+		return nil
+	}
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	resp, err := s.exporter.export(ctx, req)
+	if err != nil {
+		return fmt.Errorf("OTLP export failed: %w", err)
+	}
+	if partial := resp.GetPartialSuccess(); partial.GetRejectedDataPoints() > 0 {
+		return fmt.Errorf("OTLP receiver rejected %d data points: %s", partial.GetRejectedDataPoints(), partial.GetErrorMessage())
+	}
+	return nil
+}
+
+// Close implements collector.Sink
+func (s *OTLPSink) Close() error {
+	return s.exporter.close()
+}
+
+// startTime returns the start of the device's cumulative series
+func (s *OTLPSink) startTime(sample collector.DeviceSample) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start, ok := s.startTimes[sample.Device.Path]
+	if !ok || countersReset(sample) {
+		start = sample.SampleTime
+		s.startTimes[sample.Device.Path] = start
+	}
+	return start
+}
+
+// countersReset reports whether any counter went backwards since the
+// previous sample, e.g. after the volume was detached and reattached
+func countersReset(sample collector.DeviceSample) bool {
+	if sample.PrevStats == nil {
+		return false
+	}
+	for _, metric := range collector.Metrics {
+		if metric.Counter && metric.Value(sample.Stats) < metric.Value(sample.PrevStats) {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceMetrics converts a device sample to OTLP
+func (s *OTLPSink) resourceMetrics(sample collector.DeviceSample) *metricspb.ResourceMetrics {
+	start := uint64(s.startTime(sample).UnixNano())
+	now := uint64(sample.SampleTime.UnixNano())
+
+	metrics := make([]*metricspb.Metric, 0, len(collector.Metrics)+len(collector.LatencyHistograms))
+	for _, definition := range collector.Metrics {
+		metrics = append(metrics, otlpMetric(definition, sample, start, now))
+	}
+	for _, definition := range collector.LatencyHistograms {
+		if histogram := otlpHistogram(definition, sample, start, now); histogram != nil {
+			metrics = append(metrics, histogram)
+		}
+	}
+
+	return &metricspb.ResourceMetrics{
+		Resource: &resourcepb.Resource{Attributes: s.resourceAttributes(sample)},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{
+			Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName},
+			Metrics: metrics,
+		}},
+	}
+}
+
+// resourceAttributes describes the device and the instance it is attached to
+func (s *OTLPSink) resourceAttributes(sample collector.DeviceSample) []*commonpb.KeyValue {
+	attributes := []*commonpb.KeyValue{
+		otlpAttribute("service.name", otlpServiceName),
+		otlpAttribute("ebs.device", sample.DeviceName()),
+		otlpAttribute("ebs.volume_id", sample.Device.VolumeID),
+	}
+	if sample.Device.EC2DeviceName != "" {
+		attributes = append(attributes, otlpAttribute("ebs.ec2_device_name", sample.Device.EC2DeviceName))
+	}
+
+	if s.instance != nil {
+		attributes = append(attributes,
+			otlpAttribute("cloud.provider", "aws"),
+			otlpAttribute("cloud.platform", "aws_ec2"),
+			otlpAttribute("cloud.region", s.instance.Region),
+			otlpAttribute("cloud.availability_zone", s.instance.AvailabilityZone),
+			otlpAttribute("host.id", s.instance.InstanceID),
+			otlpAttribute("host.type", s.instance.InstanceType),
+		)
+	}
+	return attributes
+}
+
+// otlpMetric converts a counter to a cumulative monotonic sum and a gauge
+// to a gauge. Counter names drop the Prometheus _total suffix.
+func otlpMetric(definition collector.MetricDefinition, sample collector.DeviceSample, start, now uint64) *metricspb.Metric {
+	value := definition.Value(sample.Stats)
+
+	if !definition.Counter {
+		return &metricspb.Metric{
+			Name:        definition.Name,
+			Description: definition.Help,
+			Unit:        definition.Unit,
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{{
+					TimeUnixNano: now,
+					Value:        &metricspb.NumberDataPoint_AsInt{AsInt: int64(value)},
+				}},
+			}},
+		}
+	}
+
+	return &metricspb.Metric{
+		Name:        strings.TrimSuffix(definition.Name, "_total"),
+		Description: definition.Help,
+		Unit:        definition.Unit,
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+			DataPoints: []*metricspb.NumberDataPoint{{
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				Value:             &metricspb.NumberDataPoint_AsInt{AsInt: int64(value)},
+			}},
+		}},
+	}
+}
+
+// otlpHistogram converts a latency histogram to an explicit-bucket
+// histogram. The upper bound of every bin becomes an explicit bound, so
+// the final overflow bucket is always empty. Returns nil if the histogram
+// has no bins.
+func otlpHistogram(definition collector.LatencyHistogramDefinition, sample collector.DeviceSample, start, now uint64) *metricspb.Metric {
+	bins := definition.Histogram(sample.Stats)
+	if len(bins) == 0 {
+		return nil
+	}
+
+	bounds := make([]float64, 0, len(bins))
+	counts := make([]uint64, 0, len(bins)+1)
+	var total uint64
+	for _, bin := range bins {
+		bounds = append(bounds, float64(bin.Upper))
+		counts = append(counts, bin.Count)
+		total += bin.Count
+	}
+	counts = append(counts, 0)
+	sum := float64(definition.Sum(sample.Stats))
+
+	return &metricspb.Metric{
+		Name:        definition.Name,
+		Description: definition.Help,
+		Unit:        collector.UnitMicroseconds,
+		Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints: []*metricspb.HistogramDataPoint{{
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				Count:             total,
+				Sum:               &sum,
+				BucketCounts:      counts,
+				ExplicitBounds:    bounds,
+			}},
+		}},
+	}
+}
+
+// otlpAttribute creates a string attribute
+func otlpAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+// otlpGRPCExporter exports over gRPC
+type otlpGRPCExporter struct {
+	conn    *grpc.ClientConn
+	client  colmetricspb.MetricsServiceClient
+	headers metadata.MD
+}
+
+func newOTLPGRPCExporter(config OTLPConfig) (*otlpGRPCExporter, error) {
+	creds := insecure.NewCredentials()
+	if !config.Insecure {
+		tlsConfig, err := config.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient(config.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP gRPC client: %w", err)
+	}
+
+	return &otlpGRPCExporter{
+		conn:    conn,
+		client:  colmetricspb.NewMetricsServiceClient(conn),
+		headers: metadata.New(config.Headers),
+	}, nil
+}
+
+func (e *otlpGRPCExporter) export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	if len(e.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, e.headers)
+	}
+	return e.client.Export(ctx, req)
+}
+
+func (e *otlpGRPCExporter) close() error {
+	return e.conn.Close()
+}
+
+// otlpHTTPExporter exports protobuf over HTTP
+type otlpHTTPExporter struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+}
+
+func newOTLPHTTPExporter(config OTLPConfig) (*otlpHTTPExporter, error) {
+	endpoint := config.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https"
+		if config.Insecure {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpMetricsPath
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if u.Scheme == "https" {
+		tlsConfig, err := config.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &otlpHTTPExporter{
+		client:  &http.Client{Transport: transport},
+		url:     u.String(),
+		headers: config.Headers,
+	}, nil
+}
+
+func (e *otlpHTTPExporter) export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for key, value := range e.headers {
+		httpReq.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	exportResp := &colmetricspb.ExportMetricsServiceResponse{}
+	if err := proto.Unmarshal(respBody, exportResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return exportResp, nil
+}
+
+func (e *otlpHTTPExporter) close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
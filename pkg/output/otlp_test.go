@@ -0,0 +1,330 @@
+package output
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	"google.golang.org/grpc"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// testSampleTime is the time of the samples returned by testSample
+var testSampleTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testSample returns a successful sample of nvme1n1 with readOps read
+// operations and a two-bin read latency histogram
+func testSample(readOps uint64, sampleTime time.Time) collector.DeviceSample {
+	stats := &nvme.EBSNVMEStats{
+		Magic:             nvme.AmznNVMEStatsMagic,
+		TotalReadOps:      readOps,
+		TotalReadTime:     25000,
+		VolumeQueueLength: 2,
+	}
+	stats.ReadIOLatencyHistogram.NumBins = 2
+	stats.ReadIOLatencyHistogram.Bins[0].Lower = 0
+	stats.ReadIOLatencyHistogram.Bins[0].Upper = 128
+	stats.ReadIOLatencyHistogram.Bins[0].Count = 10
+	stats.ReadIOLatencyHistogram.Bins[1].Lower = 128
+	stats.ReadIOLatencyHistogram.Bins[1].Upper = 256
+	stats.ReadIOLatencyHistogram.Bins[1].Count = 60
+
+	return collector.DeviceSample{
+		Device: &nvme.Device{
+			Path:          "/dev/nvme1n1",
+			VolumeID:      "vol-0123456789abcdef0",
+			EC2DeviceName: "/dev/xvdf",
+		},
+		Stats:      stats,
+		SampleTime: sampleTime,
+	}
+}
+
+// nextSample returns a sample that follows previous with the given read
+// operations
+func nextSample(previous collector.DeviceSample, readOps uint64, sampleTime time.Time) collector.DeviceSample {
+	sample := testSample(readOps, sampleTime)
+	sample.PrevStats = previous.Stats
+	sample.PrevSampleTime = previous.SampleTime
+	return sample
+}
+
+// otlpReceiver records the metrics of every export request it receives
+type otlpReceiver struct {
+	pmetricotlp.UnimplementedGRPCServer
+
+	mutex    sync.Mutex
+	received []pmetric.Metrics
+}
+
+// Export implements pmetricotlp.GRPCServer
+func (r *otlpReceiver) Export(_ context.Context, req pmetricotlp.ExportRequest) (pmetricotlp.ExportResponse, error) {
+	r.record(req)
+	return pmetricotlp.NewExportResponse(), nil
+}
+
+func (r *otlpReceiver) record(req pmetricotlp.ExportRequest) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.received = append(r.received, req.Metrics())
+}
+
+// requests returns the metrics received so far
+func (r *otlpReceiver) requests() []pmetric.Metrics {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]pmetric.Metrics(nil), r.received...)
+}
+
+// startOTLPGRPCReceiver serves an in-process OTLP gRPC receiver and
+// returns its endpoint
+func startOTLPGRPCReceiver(t *testing.T) (string, *otlpReceiver) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	receiver := &otlpReceiver{}
+	server := grpc.NewServer()
+	pmetricotlp.RegisterGRPCServer(server, receiver)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().String(), receiver
+}
+
+// startOTLPHTTPReceiver serves an OTLP HTTP/protobuf receiver and returns
+// its URL
+func startOTLPHTTPReceiver(t *testing.T) (string, *otlpReceiver) {
+	t.Helper()
+
+	receiver := &otlpReceiver{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpMetricsPath {
+			http.NotFound(w, r)
+			return
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/x-protobuf" {
+			t.Errorf("expected content type application/x-protobuf, got %q", contentType)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := pmetricotlp.NewExportRequest()
+		if err := req.UnmarshalProto(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		receiver.record(req)
+
+		resp, err := pmetricotlp.NewExportResponse().MarshalProto()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL, receiver
+}
+
+// newTestOTLPSink starts a receiver for the protocol and returns a sink
+// exporting to it
+func newTestOTLPSink(t *testing.T, protocol string) (*OTLPSink, *otlpReceiver) {
+	t.Helper()
+
+	var endpoint string
+	var receiver *otlpReceiver
+	switch protocol {
+	case OTLPProtocolGRPC:
+		endpoint, receiver = startOTLPGRPCReceiver(t)
+	case OTLPProtocolHTTP:
+		endpoint, receiver = startOTLPHTTPReceiver(t)
+	}
+
+	sink, err := NewOTLPSink(OTLPConfig{
+		Endpoint: endpoint,
+		Protocol: protocol,
+		Insecure: true,
+		Timeout:  5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating the sink: %v", err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	return sink, receiver
+}
+
+// findOTLPMetric returns the metric with the given name from the only
+// resource of the request
+func findOTLPMetric(t *testing.T, metrics pmetric.Metrics, name string) pmetric.Metric {
+	t.Helper()
+
+	if metrics.ResourceMetrics().Len() != 1 {
+		t.Fatalf("expected 1 resource, got %d", metrics.ResourceMetrics().Len())
+	}
+	scopes := metrics.ResourceMetrics().At(0).ScopeMetrics()
+	if scopes.Len() != 1 {
+		t.Fatalf("expected 1 scope, got %d", scopes.Len())
+	}
+	for i := 0; i < scopes.At(0).Metrics().Len(); i++ {
+		if metric := scopes.At(0).Metrics().At(i); metric.Name() == name {
+			return metric
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return pmetric.Metric{}
+}
+
+func TestOTLPSinkWrite(t *testing.T) {
+	for _, protocol := range []string{OTLPProtocolGRPC, OTLPProtocolHTTP} {
+		t.Run(protocol, func(t *testing.T) {
+			sink, receiver := newTestOTLPSink(t, protocol)
+
+			if err := sink.Write(context.Background(), []collector.DeviceSample{testSample(100, testSampleTime)}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			requests := receiver.requests()
+			if len(requests) != 1 {
+				t.Fatalf("expected 1 request, got %d", len(requests))
+			}
+			metrics := requests[0]
+
+			attributes := metrics.ResourceMetrics().At(0).Resource().Attributes()
+			for key, want := range map[string]string{
+				"service.name":        otlpServiceName,
+				"ebs.device":          "nvme1n1",
+				"ebs.volume_id":       "vol-0123456789abcdef0",
+				"ebs.ec2_device_name": "/dev/xvdf",
+			} {
+				value, ok := attributes.Get(key)
+				if !ok || value.Str() != want {
+					t.Errorf("expected attribute %s=%q, got %q", key, want, value.AsString())
+				}
+			}
+
+			readOps := findOTLPMetric(t, metrics, "ebs_total_read_ops")
+			if readOps.Type() != pmetric.MetricTypeSum {
+				t.Fatalf("expected a sum, got %s", readOps.Type())
+			}
+			sum := readOps.Sum()
+			if sum.AggregationTemporality() != pmetric.AggregationTemporalityCumulative || !sum.IsMonotonic() {
+				t.Errorf("expected a cumulative monotonic sum, got %s monotonic=%t", sum.AggregationTemporality(), sum.IsMonotonic())
+			}
+			point := sum.DataPoints().At(0)
+			if point.IntValue() != 100 {
+				t.Errorf("expected value 100, got %d", point.IntValue())
+			}
+			if want := pcommon.NewTimestampFromTime(testSampleTime); point.Timestamp() != want || point.StartTimestamp() != want {
+				t.Errorf("expected start and time %s, got %s and %s", want, point.StartTimestamp(), point.Timestamp())
+			}
+
+			queueLength := findOTLPMetric(t, metrics, "ebs_volume_queue_length")
+			if queueLength.Type() != pmetric.MetricTypeGauge {
+				t.Fatalf("expected a gauge, got %s", queueLength.Type())
+			}
+			if value := queueLength.Gauge().DataPoints().At(0).IntValue(); value != 2 {
+				t.Errorf("expected queue length 2, got %d", value)
+			}
+		})
+	}
+}
+
+func TestOTLPSinkStartTimeReset(t *testing.T) {
+	sink, receiver := newTestOTLPSink(t, OTLPProtocolGRPC)
+
+	first := testSample(100, testSampleTime)
+	second := nextSample(first, 200, testSampleTime.Add(time.Minute))
+	// The counters go backwards, e.g. after the volume was reattached
+	reset := nextSample(second, 50, testSampleTime.Add(2*time.Minute))
+
+	wantStarts := []time.Time{first.SampleTime, first.SampleTime, reset.SampleTime}
+	for _, sample := range []collector.DeviceSample{first, second, reset} {
+		if err := sink.Write(context.Background(), []collector.DeviceSample{sample}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	requests := receiver.requests()
+	if len(requests) != len(wantStarts) {
+		t.Fatalf("expected %d requests, got %d", len(wantStarts), len(requests))
+	}
+	for i, metrics := range requests {
+		for _, name := range []string{"ebs_total_read_ops", "ebs_read_io_latency_microseconds"} {
+			metric := findOTLPMetric(t, metrics, name)
+			var start pcommon.Timestamp
+			if metric.Type() == pmetric.MetricTypeHistogram {
+				start = metric.Histogram().DataPoints().At(0).StartTimestamp()
+			} else {
+				start = metric.Sum().DataPoints().At(0).StartTimestamp()
+			}
+			if want := pcommon.NewTimestampFromTime(wantStarts[i]); start != want {
+				t.Errorf("request %d: expected %s start time %s, got %s", i, name, want, start)
+			}
+		}
+	}
+}
+
+func TestOTLPSinkHistogram(t *testing.T) {
+	sink, receiver := newTestOTLPSink(t, OTLPProtocolHTTP)
+
+	if err := sink.Write(context.Background(), []collector.DeviceSample{testSample(100, testSampleTime)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	requests := receiver.requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+
+	metric := findOTLPMetric(t, requests[0], "ebs_read_io_latency_microseconds")
+	if metric.Type() != pmetric.MetricTypeHistogram {
+		t.Fatalf("expected a histogram, got %s", metric.Type())
+	}
+	if metric.Unit() != collector.UnitMicroseconds {
+		t.Errorf("expected unit %s, got %s", collector.UnitMicroseconds, metric.Unit())
+	}
+	if temporality := metric.Histogram().AggregationTemporality(); temporality != pmetric.AggregationTemporalityCumulative {
+		t.Errorf("expected cumulative temporality, got %s", temporality)
+	}
+
+	point := metric.Histogram().DataPoints().At(0)
+	// The upper bound of every bin is an explicit bound, and the overflow
+	// bucket is empty
+	wantBounds := []float64{128, 256}
+	wantCounts := []uint64{10, 60, 0}
+	if bounds := point.ExplicitBounds().AsRaw(); !slices.Equal(bounds, wantBounds) {
+		t.Errorf("expected bounds %v, got %v", wantBounds, bounds)
+	}
+	if counts := point.BucketCounts().AsRaw(); !slices.Equal(counts, wantCounts) {
+		t.Errorf("expected bucket counts %v, got %v", wantCounts, counts)
+	}
+	if point.Count() != 70 {
+		t.Errorf("expected count 70, got %d", point.Count())
+	}
+	if !point.HasSum() || point.Sum() != 25000 {
+		t.Errorf("expected sum 25000, got %g", point.Sum())
+	}
+
+	// A histogram without bins is not exported
+	for i := 0; i < requests[0].ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().Len(); i++ {
+		if name := requests[0].ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(i).Name(); name == "ebs_write_io_latency_microseconds" {
+			t.Errorf("expected no %s metric without bins", name)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/ec2metadata"
+)
+
+// Remote-write defaults, matching Prometheus' queue configuration where it
+// has an equivalent
+const (
+	DefaultRemoteWriteShards            = 4
+	DefaultRemoteWriteQueueCapacity     = 10000
+	DefaultRemoteWriteMaxSamplesPerSend = 2000
+	DefaultRemoteWriteMinBackoff        = 30 * time.Millisecond
+	DefaultRemoteWriteMaxBackoff        = 5 * time.Second
+	DefaultRemoteWriteTimeout           = 30 * time.Second
+)
+
+// RemoteWriteConfig configures the remote-write sink
+type RemoteWriteConfig struct {
+	URL string
+
+	// Username and Password enable basic auth; BearerToken enables bearer
+	// auth. At most one of them may be set.
+	Username    string
+	Password    string
+	BearerToken string
+	TLS         TLSConfig
+	Timeout     time.Duration
+
+	// Shards is the number of concurrent senders. Every series is always
+	// sent by the same shard, so its samples arrive in order.
+	Shards int
+	// QueueCapacity is the number of samples each shard buffers while the
+	// endpoint is unreachable. The oldest samples are dropped when full.
+	QueueCapacity     int
+	MaxSamplesPerSend int
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+
+	// Labels are added to every series
+	Labels map[string]string
+	// Instance, if set, is added to every series as labels
+	Instance *ec2metadata.InstanceMetadata
+}
+
+// rwLabel is a series label
+type rwLabel struct {
+	name  string
+	value string
+}
+
+// rwSample is a single sample of a series, with its sorted labels
+type rwSample struct {
+	labels    []rwLabel
+	value     float64
+	timestamp int64
+}
+
+// RemoteWriteSink pushes samples to a Prometheus remote-write endpoint.
+// Writes only queue the samples, timestamped with the time they were
+// sampled; shards send them in the background, retrying with backoff
+// while the endpoint is unavailable.
+type RemoteWriteSink struct {
+	client *rwClient
+	shards []*rwShard
+	labels []rwLabel
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewRemoteWriteSink creates a remote-write sink and starts its shards
+func NewRemoteWriteSink(config RemoteWriteConfig) (*RemoteWriteSink, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("remote-write URL is required")
+	}
+	if config.BearerToken != "" && (config.Username != "" || config.Password != "") {
+		return nil, fmt.Errorf("remote-write basic auth and bearer token are mutually exclusive")
+	}
+	applyRemoteWriteDefaults(&config)
+
+	client, err := newRWClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string, len(config.Labels)+4)
+	if config.Instance != nil {
+		labels = config.Instance.Labels()
+	}
+	for name, value := range config.Labels {
+		labels[name] = value
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &RemoteWriteSink{
+		client: client,
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+	}
+	for name, value := range labels {
+		sink.labels = append(sink.labels, rwLabel{name: name, value: value})
+	}
+
+	for i := 0; i < config.Shards; i++ {
+		shard := &rwShard{
+			client:     client,
+			capacity:   config.QueueCapacity,
+			maxPerSend: config.MaxSamplesPerSend,
+			minBackoff: config.MinBackoff,
+			maxBackoff: config.MaxBackoff,
+			notify:     make(chan struct{}, 1),
+		}
+		sink.shards = append(sink.shards, shard)
+		sink.wg.Add(1)
+		go func() {
+			defer sink.wg.Done()
+			shard.run(ctx, sink.stop)
+		}()
+	}
+
+	return sink, nil
+}
+
+// applyRemoteWriteDefaults fills in unset queue settings
+func applyRemoteWriteDefaults(config *RemoteWriteConfig) {
+	if config.Shards <= 0 {
+		config.Shards = DefaultRemoteWriteShards
+	}
+	if config.QueueCapacity <= 0 {
+		config.QueueCapacity = DefaultRemoteWriteQueueCapacity
+	}
+	if config.MaxSamplesPerSend <= 0 {
+		config.MaxSamplesPerSend = DefaultRemoteWriteMaxSamplesPerSend
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultRemoteWriteMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = max(DefaultRemoteWriteMaxBackoff, config.MinBackoff)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultRemoteWriteTimeout
+	}
+}
+
+// Name implements collector.Sink
+func (s *RemoteWriteSink) Name() string {
+	return "remote-write"
+}
+
+// Write implements collector.Sink. It queues the samples and reports
+// samples dropped from full queues and send failures since the previous
+// write.
+func (s *RemoteWriteSink) Write(ctx context.Context, samples []collector.DeviceSample) error {
+	for _, sample := range samples {
+		// Devices whose last query failed are skipped until they recover
+		if sample.Stats == nil {
+			continue
+		}
+		timestamp := sample.SampleTime.UnixMilli()
+
+		for _, metric := range collector.Metrics {
+			labels := append([]rwLabel{
+				{name: "__name__", value: metric.Name},
+				{name: "device", value: sample.DeviceName()},
+				{name: "volume_id", value: sample.Device.VolumeID},
+			}, s.labels...)
+			sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+			s.shardFor(labels).enqueue(rwSample{
+				labels:    labels,
+				value:     float64(metric.Value(sample.Stats)),
+				timestamp: timestamp,
+			})
+		}
+	}
+
+	var errs []error
+	for i, shard := range s.shards {
+		if err := shard.takeErrors(); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// shardFor returns the shard that sends a series
+func (s *RemoteWriteSink) shardFor(labels []rwLabel) *rwShard {
+	hash := fnv.New32a()
+	for _, label := range labels {
+		hash.Write([]byte(label.name))
+		hash.Write([]byte{0})
+		hash.Write([]byte(label.value))
+		hash.Write([]byte{0})
+	}
+	return s.shards[hash.Sum32()%uint32(len(s.shards))]
+}
+
+// Close implements collector.Sink. Queued samples are sent for up to the
+// close timeout before they are abandoned.
+func (s *RemoteWriteSink) Close() error {
+	close(s.stop)
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		s.cancel()
+		<-done
+		err = fmt.Errorf("remote-write queue not drained within %s", closeTimeout)
+	}
+
+	s.cancel()
+	s.client.close()
+	return err
+}
+
+// rwShard queues the samples of a subset of series and sends them in order
+type rwShard struct {
+	client     *rwClient
+	capacity   int
+	maxPerSend int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// notify wakes the shard when samples are queued
+	notify chan struct{}
+
+	mutex   sync.Mutex
+	queue   []rwSample
+	dropped int
+	// dropErr is the last error that caused a batch to be dropped
+	dropErr error
+	// retryErr is the error of a batch still being retried
+	retryErr error
+}
+
+// enqueue adds a sample, dropping the oldest if the queue is full
+func (s *rwShard) enqueue(sample rwSample) {
+	s.mutex.Lock()
+	if len(s.queue) >= s.capacity {
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.queue = append(s.queue, sample)
+	s.mutex.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take removes up to maxPerSend samples from the front of the queue
+func (s *rwShard) take() []rwSample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := min(len(s.queue), s.maxPerSend)
+	batch := make([]rwSample, n)
+	copy(batch, s.queue[:n])
+	s.queue = s.queue[n:]
+	return batch
+}
+
+// takeErrors returns and clears the drops and send error since the last call
+func (s *rwShard) takeErrors() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var errs []error
+	if s.dropped > 0 {
+		errs = append(errs, fmt.Errorf("queue full, dropped %d samples", s.dropped))
+	}
+	if s.dropErr != nil {
+		errs = append(errs, s.dropErr)
+	}
+	if s.retryErr != nil {
+		errs = append(errs, fmt.Errorf("retrying: %w", s.retryErr))
+	}
+	s.dropped = 0
+	s.dropErr = nil
+	return errors.Join(errs...)
+}
+
+// setErrors records the outcome of a send attempt. The retry error is kept
+// until a send succeeds or the batch is dropped.
+func (s *rwShard) setErrors(dropErr, retryErr error) {
+	s.mutex.Lock()
+	if dropErr != nil {
+		s.dropErr = dropErr
+	}
+	s.retryErr = retryErr
+	s.mutex.Unlock()
+}
+
+// run sends queued samples until stop is closed, then drains the queue
+// until ctx is cancelled
+func (s *rwShard) run(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-s.notify:
+			s.sendQueued(ctx)
+		case <-stop:
+			s.sendQueued(ctx)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendQueued sends batches until the queue is empty
+func (s *rwShard) sendQueued(ctx context.Context) {
+	for ctx.Err() == nil {
+		batch := s.take()
+		if len(batch) == 0 {
+			return
+		}
+		s.sendWithRetry(ctx, batch)
+	}
+}
+
+// sendWithRetry sends a batch, retrying recoverable errors with
+// exponential backoff. The batch is dropped on a non-recoverable error.
+func (s *rwShard) sendWithRetry(ctx context.Context, batch []rwSample) {
+	body := snappy.Encode(nil, encodeWriteRequest(batch))
+	backoff := s.minBackoff
+
+	for {
+		err := s.client.send(ctx, body)
+		if err == nil {
+			s.setErrors(nil, nil)
+			return
+		}
+
+		var recoverable *rwRecoverableError
+		if !errors.As(err, &recoverable) {
+			s.setErrors(fmt.Errorf("dropped %d samples: %w", len(batch), err), nil)
+			return
+		}
+		s.setErrors(nil, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, s.maxBackoff)
+	}
+}
+
+// encodeWriteRequest encodes samples as a prometheus.WriteRequest protobuf
+// with one time series per sample
+func encodeWriteRequest(samples []rwSample) []byte {
+	var request []byte
+	for _, sample := range samples {
+		var series []byte
+		for _, label := range sample.labels {
+			var encoded []byte
+			encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label.name)
+			encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label.value)
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, encoded)
+		}
+
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, 1, protowire.Fixed64Type)
+		encoded = protowire.AppendFixed64(encoded, math.Float64bits(sample.value))
+		encoded = protowire.AppendTag(encoded, 2, protowire.VarintType)
+		encoded = protowire.AppendVarint(encoded, uint64(sample.timestamp))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, encoded)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
+
+// rwRecoverableError is a send error worth retrying
+type rwRecoverableError struct {
+	err error
+}
+
+func (e *rwRecoverableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rwRecoverableError) Unwrap() error {
+	return e.err
+}
+
+// rwClient posts write requests to the endpoint
+type rwClient struct {
+	client      *http.Client
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	timeout     time.Duration
+}
+
+func newRWClient(config RemoteWriteConfig) (*rwClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(config.URL, "https://") {
+		tlsConfig, err := config.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &rwClient{
+		client:      &http.Client{Transport: transport},
+		url:         config.URL,
+		username:    config.Username,
+		password:    config.Password,
+		bearerToken: config.BearerToken,
+		timeout:     config.Timeout,
+	}, nil
+}
+
+// send posts a snappy-compressed write request. Network errors, 429 and
+// 5xx responses are recoverable.
+func (c *rwClient) send(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "ebs-metrics-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	if c.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &rwRecoverableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("remote-write returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5 {
+		return &rwRecoverableError{err: err}
+	}
+	return err
+}
+
+func (c *rwClient) close() {
+	c.client.CloseIdleConnections()
+}
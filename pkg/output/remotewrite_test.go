@@ -0,0 +1,206 @@
+package output
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+)
+
+// rwReceiver decodes remote-write requests. The first failures requests
+// are answered with status, later ones succeed.
+type rwReceiver struct {
+	status   int
+	failures int
+
+	mutex    sync.Mutex
+	requests []*prompb.WriteRequest
+}
+
+func (r *rwReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if encoding := req.Header.Get("Content-Encoding"); encoding != "snappy" {
+		http.Error(w, "unexpected content encoding "+encoding, http.StatusBadRequest)
+		return
+	}
+	if version := req.Header.Get("X-Prometheus-Remote-Write-Version"); version != "0.1.0" {
+		http.Error(w, "unexpected remote-write version "+version, http.StatusBadRequest)
+		return
+	}
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeRequest := &prompb.WriteRequest{}
+	if err := writeRequest.Unmarshal(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mutex.Lock()
+	r.requests = append(r.requests, writeRequest)
+	failed := len(r.requests) <= r.failures
+	r.mutex.Unlock()
+
+	if failed {
+		http.Error(w, "failed", r.status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// received returns the requests received so far
+func (r *rwReceiver) received() []*prompb.WriteRequest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*prompb.WriteRequest(nil), r.requests...)
+}
+
+// newTestRemoteWriteSink returns a single-shard sink writing to receiver
+func newTestRemoteWriteSink(t *testing.T, receiver *rwReceiver) *RemoteWriteSink {
+	t.Helper()
+
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	sink, err := NewRemoteWriteSink(RemoteWriteConfig{
+		URL:        server.URL,
+		Shards:     1,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		Labels:     map[string]string{"cluster": "prod"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating the sink: %v", err)
+	}
+	return sink
+}
+
+// seriesLabels returns the labels of a series as a map
+func seriesLabels(series prompb.TimeSeries) map[string]string {
+	labels := make(map[string]string, len(series.Labels))
+	for _, label := range series.Labels {
+		labels[label.Name] = label.Value
+	}
+	return labels
+}
+
+func TestRemoteWriteSinkWrite(t *testing.T) {
+	receiver := &rwReceiver{}
+	sink := newTestRemoteWriteSink(t, receiver)
+
+	if err := sink.Write(context.Background(), []collector.DeviceSample{testSample(100, testSampleTime)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Closing drains the queue
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unexpected error closing the sink: %v", err)
+	}
+
+	var series []prompb.TimeSeries
+	for _, request := range receiver.received() {
+		series = append(series, request.Timeseries...)
+	}
+	if len(series) != len(collector.Metrics) {
+		t.Fatalf("expected %d series, got %d", len(collector.Metrics), len(series))
+	}
+
+	wantValues := map[string]float64{
+		"ebs_total_read_ops_total": 100,
+		"ebs_volume_queue_length":  2,
+	}
+	for _, s := range series {
+		for i := 1; i < len(s.Labels); i++ {
+			if s.Labels[i-1].Name >= s.Labels[i].Name {
+				t.Errorf("expected sorted labels, got %v", s.Labels)
+				break
+			}
+		}
+
+		labels := seriesLabels(s)
+		name := labels["__name__"]
+		for key, want := range map[string]string{
+			"device":    "nvme1n1",
+			"volume_id": "vol-0123456789abcdef0",
+			"cluster":   "prod",
+		} {
+			if labels[key] != want {
+				t.Errorf("%s: expected label %s=%q, got %q", name, key, want, labels[key])
+			}
+		}
+
+		if len(s.Samples) != 1 {
+			t.Fatalf("%s: expected 1 sample, got %d", name, len(s.Samples))
+		}
+		if s.Samples[0].Timestamp != testSampleTime.UnixMilli() {
+			t.Errorf("%s: expected timestamp %d, got %d", name, testSampleTime.UnixMilli(), s.Samples[0].Timestamp)
+		}
+		if s.Samples[0].Value != wantValues[name] {
+			t.Errorf("%s: expected value %g, got %g", name, wantValues[name], s.Samples[0].Value)
+		}
+	}
+}
+
+func TestRemoteWriteSinkRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantRequests int
+		wantErr      string
+	}{
+		{
+			name:         "server error",
+			status:       http.StatusInternalServerError,
+			wantRequests: 3,
+		},
+		{
+			name:         "too many requests",
+			status:       http.StatusTooManyRequests,
+			wantRequests: 3,
+		},
+		{
+			name:         "bad request",
+			status:       http.StatusBadRequest,
+			wantRequests: 1,
+			wantErr:      "400 Bad Request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &rwReceiver{status: tt.status, failures: 2}
+			sink := newTestRemoteWriteSink(t, receiver)
+
+			sink.Write(context.Background(), []collector.DeviceSample{testSample(100, testSampleTime)})
+			if err := sink.Close(); err != nil {
+				t.Fatalf("unexpected error closing the sink: %v", err)
+			}
+
+			if requests := len(receiver.received()); requests != tt.wantRequests {
+				t.Fatalf("expected %d requests, got %d", tt.wantRequests, requests)
+			}
+			// Writing no samples reports the outcome of the sends
+			err := sink.Write(context.Background(), nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
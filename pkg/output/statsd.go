@@ -0,0 +1,260 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/ec2metadata"
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+const (
+	// DefaultStatsDPrefix is prepended to every StatsD metric name
+	DefaultStatsDPrefix = "ebs."
+
+	// Maximum datagram sizes recommended by DogStatsD for each transport
+	statsdMaxUDPPacket  = 1432
+	statsdMaxUnixPacket = 8192
+)
+
+// StatsDConfig configures the StatsD sink
+type StatsDConfig struct {
+	// Address is host:port or udp://host:port for UDP, or unix:///path for
+	// a Unix datagram socket
+	Address string
+	// Prefix is prepended to every metric name
+	Prefix string
+	// Tags are added to every metric
+	Tags map[string]string
+	// Instance, if set, is added to every metric as tags
+	Instance *ec2metadata.InstanceMetadata
+}
+
+// StatsDSink sends device metrics to a DogStatsD agent. Counters are sent
+// as the increase since the previous write, the queue length as a gauge and
+// the latency histograms as distributions.
+type StatsDSink struct {
+	conn      net.Conn
+	prefix    string
+	tags      []string
+	maxPacket int
+
+	mutex sync.Mutex
+	// lastStats holds the stats last written for each device path
+	lastStats map[string]*nvme.EBSNVMEStats
+	// packet buffers metric lines until the next datagram is sent
+	packet []byte
+	// sendErr is the first send error of the current write
+	sendErr error
+}
+
+// NewStatsDSink creates a StatsD sink
+func NewStatsDSink(config StatsDConfig) (*StatsDSink, error) {
+	network, address, maxPacket, err := parseStatsDAddress(config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dialing UDP does not fail when no agent is listening; packets are
+	// dropped until one is
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD at %s: %w", config.Address, err)
+	}
+
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = DefaultStatsDPrefix
+	}
+
+	return &StatsDSink{
+		conn:      conn,
+		prefix:    prefix,
+		tags:      statsdTags(config.Tags, config.Instance),
+		maxPacket: maxPacket,
+		lastStats: make(map[string]*nvme.EBSNVMEStats),
+	}, nil
+}
+
+// parseStatsDAddress returns the network, address and maximum packet size
+// for a StatsD address
+func parseStatsDAddress(address string) (string, string, int, error) {
+	switch {
+	case address == "":
+		return "", "", 0, fmt.Errorf("StatsD address is required")
+	case strings.HasPrefix(address, "unix://"):
+		return "unixgram", strings.TrimPrefix(address, "unix://"), statsdMaxUnixPacket, nil
+	case strings.HasPrefix(address, "udp://"):
+		return "udp", strings.TrimPrefix(address, "udp://"), statsdMaxUDPPacket, nil
+	case strings.Contains(address, "://"):
+		return "", "", 0, fmt.Errorf("unsupported StatsD address %q (must be host:port, udp://host:port or unix:///path)", address)
+	default:
+		return "udp", address, statsdMaxUDPPacket, nil
+	}
+}
+
+// statsdTags formats the tags shared by every metric, sorted for stable
+// output
+func statsdTags(tags map[string]string, instance *ec2metadata.InstanceMetadata) []string {
+	all := make(map[string]string, len(tags)+4)
+	if instance != nil {
+		all = instance.Labels()
+	}
+	for key, value := range tags {
+		all[key] = value
+	}
+
+	formatted := make([]string, 0, len(all))
+	for key, value := range all {
+		formatted = append(formatted, statsdTag(key, value))
+	}
+	sort.Strings(formatted)
+	return formatted
+}
+
+// statsdTag formats a key:value tag. Characters that delimit tags or
+// metrics in the DogStatsD protocol are replaced.
+func statsdTag(key, value string) string {
+	replacer := strings.NewReplacer(",", "_", "|", "_", "\n", "_", "#", "_")
+	return replacer.Replace(key) + ":" + replacer.Replace(value)
+}
+
+// Name implements collector.Sink
+func (s *StatsDSink) Name() string {
+	return "statsd"
+}
+
+// Write implements collector.Sink. Counters and histograms are only sent
+// once a device has a previous write to compute the increase from.
+func (s *StatsDSink) Write(ctx context.Context, samples []collector.DeviceSample) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.packet = s.packet[:0]
+	s.sendErr = nil
+
+	for _, sample := range samples {
+		// Devices whose last query failed are skipped until they recover
+		if sample.Stats == nil {
+			continue
+		}
+		s.writeSample(sample)
+		s.lastStats[sample.Device.Path] = sample.Stats
+	}
+	s.flushPacket()
+
+	if s.sendErr != nil {
+		return fmt.Errorf("failed to send StatsD packet: %w", s.sendErr)
+	}
+	return nil
+}
+
+// writeSample sends the metrics of a single device
+func (s *StatsDSink) writeSample(sample collector.DeviceSample) {
+	tags := strings.Join(append([]string{
+		statsdTag("device", sample.DeviceName()),
+		statsdTag("volume_id", sample.Device.VolumeID),
+	}, s.tags...), ",")
+	previous := s.lastStats[sample.Device.Path]
+
+	add := func(line string) {
+		s.addLine(line + "|#" + tags)
+	}
+
+	for _, metric := range collector.Metrics {
+		name := s.metricName(metric.Name)
+		value := metric.Value(sample.Stats)
+
+		if !metric.Counter {
+			add(fmt.Sprintf("%s:%d|g", name, value))
+			continue
+		}
+		if previous != nil {
+			add(fmt.Sprintf("%s:%d|c", name, statsdDelta(metric.Value(previous), value)))
+		}
+	}
+
+	if previous != nil {
+		for _, histogram := range collector.LatencyHistograms {
+			name := s.metricName(histogram.Name)
+			for _, line := range statsdDistribution(name, histogram.Histogram(previous), histogram.Histogram(sample.Stats)) {
+				add(line)
+			}
+		}
+	}
+}
+
+// metricName converts a Prometheus metric name to a StatsD name, e.g.
+// ebs_total_read_ops_total becomes ebs.total_read_ops
+func (s *StatsDSink) metricName(name string) string {
+	return s.prefix + strings.TrimSuffix(strings.TrimPrefix(name, "ebs_"), "_total")
+}
+
+// statsdDistribution converts the increase of every histogram bin into a
+// distribution sample at the bin's midpoint. The sample rate makes the
+// agent count one packet as the number of I/Os in the bin.
+func statsdDistribution(name string, previous, current []nvme.HistogramBin) []string {
+	var lines []string
+	for i, bin := range current {
+		var count uint64
+		if i < len(previous) && previous[i].Lower == bin.Lower && previous[i].Upper == bin.Upper {
+			count = statsdDelta(previous[i].Count, bin.Count)
+		} else {
+			count = bin.Count
+		}
+		if count == 0 {
+			continue
+		}
+
+		midpoint := (bin.Lower + bin.Upper) / 2
+		line := fmt.Sprintf("%s:%d|d", name, midpoint)
+		if count > 1 {
+			line += "|@" + strconv.FormatFloat(1/float64(count), 'g', -1, 64)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// statsdDelta returns the increase of a counter, treating a decrease as a
+// reset
+func statsdDelta(previous, current uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// addLine buffers a metric line, sending the buffered packet first if the
+// line does not fit
+func (s *StatsDSink) addLine(line string) {
+	if len(s.packet) > 0 && len(s.packet)+1+len(line) > s.maxPacket {
+		s.flushPacket()
+	}
+	if len(s.packet) > 0 {
+		s.packet = append(s.packet, '\n')
+	}
+	s.packet = append(s.packet, line...)
+}
+
+// flushPacket sends the buffered packet, recording the first error
+func (s *StatsDSink) flushPacket() {
+	if len(s.packet) == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.packet); err != nil && s.sendErr == nil {
+		s.sendErr = err
+	}
+	s.packet = s.packet[:0]
+}
+
+// Close implements collector.Sink
+func (s *StatsDSink) Close() error {
+	return s.conn.Close()
+}
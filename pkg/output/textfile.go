@@ -0,0 +1,60 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/collector"
+)
+
+// TextfileSink writes the collector's metrics in the Prometheus text format
+// for the node_exporter textfile collector
+type TextfileSink struct {
+	path     string
+	registry *prometheus.Registry
+}
+
+// NewTextfileSink creates a sink writing to name in dir. The collectors are
+// registered in a dedicated registry so that only EBS metrics are written,
+// keeping them from clashing with node_exporter's own metrics.
+func NewTextfileSink(dir, name string, collectors ...prometheus.Collector) (*TextfileSink, error) {
+	if !strings.HasSuffix(name, ".prom") {
+		return nil, fmt.Errorf("textfile name %q must end in .prom", name)
+	}
+
+	registry := prometheus.NewRegistry()
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register collector: %w", err)
+		}
+	}
+
+	return &TextfileSink{
+		path:     filepath.Join(dir, name),
+		registry: registry,
+	}, nil
+}
+
+// Name implements collector.Sink
+func (s *TextfileSink) Name() string {
+	return "textfile"
+}
+
+// Write implements collector.Sink. The file is written to a temporary file
+// in the same directory and renamed into place, so node_exporter never
+// reads a partial file.
+func (s *TextfileSink) Write(ctx context.Context, samples []collector.DeviceSample) error {
+	if err := prometheus.WriteToTextfile(s.path, s.registry); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// Close implements collector.Sink. The last written file is left in place.
+func (s *TextfileSink) Close() error {
+	return nil
+}
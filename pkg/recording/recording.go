@@ -0,0 +1,262 @@
+package recording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// A recording is a gzip stream starting with the magic string, followed by
+// little-endian records. Each record starts with its type:
+//
+//	recordDevice: id uint16, path length uint16, path, identify data
+//	recordSample: id uint16, unix nanoseconds int64, stats log page
+//	recordError:  id uint16, unix nanoseconds int64, length uint16, message
+//
+// Log pages are mostly reserved zero bytes, so the stream compresses well.
+const (
+	magic = "EBSREC1\n"
+
+	recordDevice uint8 = 1
+	recordSample uint8 = 2
+	recordError  uint8 = 3
+)
+
+// Sample is a recorded stats log page, or the error returned instead
+type Sample struct {
+	Time time.Time
+	Page []byte
+	Err  string
+}
+
+// Device is a recorded device with its samples in time order
+type Device struct {
+	Path     string
+	Identify []byte
+	Samples  []Sample
+}
+
+// Recording is a fully loaded recording
+type Recording struct {
+	Devices []*Device
+}
+
+// Start returns the time of the first sample in the recording
+func (r *Recording) Start() time.Time {
+	var start time.Time
+	for _, device := range r.Devices {
+		if len(device.Samples) > 0 && (start.IsZero() || device.Samples[0].Time.Before(start)) {
+			start = device.Samples[0].Time
+		}
+	}
+	return start
+}
+
+// End returns the time of the last sample in the recording
+func (r *Recording) End() time.Time {
+	var end time.Time
+	for _, device := range r.Devices {
+		if n := len(device.Samples); n > 0 && device.Samples[n-1].Time.After(end) {
+			end = device.Samples[n-1].Time
+		}
+	}
+	return end
+}
+
+// Writer writes a recording
+type Writer struct {
+	gz      *gzip.Writer
+	devices map[string]uint16
+}
+
+// NewWriter starts a recording on w
+func NewWriter(w io.Writer) (*Writer, error) {
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write([]byte(magic)); err != nil {
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+	return &Writer{
+		gz:      gz,
+		devices: make(map[string]uint16),
+	}, nil
+}
+
+// AddDevice records a device's identify data and returns the ID used for
+// its samples
+func (w *Writer) AddDevice(device *nvme.Device) (uint16, error) {
+	if id, ok := w.devices[device.Path]; ok {
+		return id, nil
+	}
+
+	id := uint16(len(w.devices))
+	if err := w.write(recordDevice, id, uint16(len(device.Path)), []byte(device.Path), device.IdentifyData()); err != nil {
+		return 0, fmt.Errorf("failed to record device %s: %w", device.Path, err)
+	}
+	w.devices[device.Path] = id
+	return id, nil
+}
+
+// WriteSample records a raw stats log page
+func (w *Writer) WriteSample(id uint16, t time.Time, page []byte) error {
+	if len(page) != nvme.StatsPageSize {
+		return fmt.Errorf("unexpected stats page size %d", len(page))
+	}
+	return w.write(recordSample, id, t.UnixNano(), page)
+}
+
+// WriteError records a failed stats query
+func (w *Writer) WriteError(id uint16, t time.Time, queryErr error) error {
+	message := queryErr.Error()
+	if len(message) > 0xFFFF {
+		message = message[:0xFFFF]
+	}
+	return w.write(recordError, id, t.UnixNano(), uint16(len(message)), []byte(message))
+}
+
+// Flush writes buffered records so that the recording can be read even if
+// the process is killed
+func (w *Writer) Flush() error {
+	return w.gz.Flush()
+}
+
+// Close finishes the recording. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	return w.gz.Close()
+}
+
+// write writes the record type followed by the fields
+func (w *Writer) write(recordType uint8, fields ...interface{}) error {
+	if err := binary.Write(w.gz, binary.LittleEndian, recordType); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if err := binary.Write(w.gz, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads a recording file
+func Load(path string) (*Recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	recording, err := Read(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recording %s: %w", path, err)
+	}
+	return recording, nil
+}
+
+// Read reads a recording. A recording that ends in the middle of a record,
+// e.g. because the recorder was killed, is returned up to the last
+// complete record.
+func Read(r io.Reader) (*Recording, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	br := bufio.NewReader(gz)
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != magic {
+		return nil, fmt.Errorf("not an EBS stats recording")
+	}
+
+	recording := &Recording{}
+	devices := make(map[uint16]*Device)
+	for {
+		err := readRecord(br, recording, devices)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return recording, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readRecord reads a single record into the recording
+func readRecord(r io.Reader, recording *Recording, devices map[uint16]*Device) error {
+	var recordType uint8
+	if err := binary.Read(r, binary.LittleEndian, &recordType); err != nil {
+		return err
+	}
+
+	var id uint16
+	if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	if recordType == recordDevice {
+		var pathLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &pathLen); err != nil {
+			return unexpectedEOF(err)
+		}
+		path := make([]byte, pathLen)
+		identify := make([]byte, nvme.IdentifyDataSize)
+		if _, err := io.ReadFull(r, path); err != nil {
+			return unexpectedEOF(err)
+		}
+		if _, err := io.ReadFull(r, identify); err != nil {
+			return unexpectedEOF(err)
+		}
+		device := &Device{Path: string(path), Identify: identify}
+		devices[id] = device
+		recording.Devices = append(recording.Devices, device)
+		return nil
+	}
+
+	device, ok := devices[id]
+	if !ok {
+		return fmt.Errorf("record for unknown device %d", id)
+	}
+	var nanos int64
+	if err := binary.Read(r, binary.LittleEndian, &nanos); err != nil {
+		return unexpectedEOF(err)
+	}
+	sample := Sample{Time: time.Unix(0, nanos)}
+
+	switch recordType {
+	case recordSample:
+		sample.Page = make([]byte, nvme.StatsPageSize)
+		if _, err := io.ReadFull(r, sample.Page); err != nil {
+			return unexpectedEOF(err)
+		}
+	case recordError:
+		var length uint16
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return unexpectedEOF(err)
+		}
+		message := make([]byte, length)
+		if _, err := io.ReadFull(r, message); err != nil {
+			return unexpectedEOF(err)
+		}
+		sample.Err = string(message)
+	default:
+		return fmt.Errorf("unknown record type %d", recordType)
+	}
+
+	device.Samples = append(device.Samples, sample)
+	return nil
+}
+
+// unexpectedEOF converts io.EOF inside a record into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package recording
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/nvme"
+)
+
+// Player replays a recording in real time or at an accelerated speed. The
+// devices it returns behave like live devices whose stats are the latest
+// recorded sample at the current playback position.
+type Player struct {
+	recording *Recording
+	speed     float64
+	loop      bool
+
+	started time.Time
+	origin  time.Time
+	length  time.Duration
+}
+
+// NewPlayer creates a player. speed is the playback rate relative to real
+// time; when loop is set playback restarts at the end of the recording,
+// otherwise the last samples keep being served.
+func NewPlayer(recording *Recording, speed float64, loop bool) (*Player, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("replay speed must be positive")
+	}
+	if len(recording.Devices) == 0 {
+		return nil, fmt.Errorf("recording contains no devices")
+	}
+
+	origin := recording.Start()
+	return &Player{
+		recording: recording,
+		speed:     speed,
+		loop:      loop,
+		started:   time.Now(),
+		origin:    origin,
+		length:    recording.End().Sub(origin),
+	}, nil
+}
+
+// Devices returns a device for every recorded device
+func (p *Player) Devices() ([]*nvme.Device, error) {
+	devices := make([]*nvme.Device, 0, len(p.recording.Devices))
+	for _, recorded := range p.recording.Devices {
+		reader := &replayReader{player: p, device: recorded}
+		reader.first, reader.last = recorded.counterRange()
+		device, err := nvme.NewDevice(recorded.Path, recorded.Identify, reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay device %s: %w", recorded.Path, err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// Now returns the recording time reached by playback. Unlike Position it
+// keeps advancing across loops and past the end of the recording, so it
+// can be used as the clock of a sampler reading the replayed devices.
+func (p *Player) Now() time.Time {
+	return p.origin.Add(p.elapsed())
+}
+
+// Position returns the recording time currently being played
+func (p *Player) Position() time.Time {
+	position, _ := p.playback()
+	return position
+}
+
+// playback returns the recording time currently being played and the
+// number of times playback has looped
+func (p *Player) playback() (time.Time, uint64) {
+	elapsed := p.elapsed()
+	var loops uint64
+	if p.loop && p.length > 0 {
+		loops = uint64(elapsed / p.length)
+		elapsed %= p.length
+	} else if elapsed > p.length {
+		elapsed = p.length
+	}
+	return p.origin.Add(elapsed), loops
+}
+
+// elapsed returns the recording time played since the player was created
+func (p *Player) elapsed() time.Duration {
+	return time.Duration(float64(time.Since(p.started)) * p.speed)
+}
+
+// replayReader serves recorded stats pages for one device
+type replayReader struct {
+	player *Player
+	device *Device
+
+	// first and last are the first and last successful samples of the
+	// device, nil if it has none. Their difference is added to the
+	// counters on every loop.
+	first *nvme.EBSNVMEStats
+	last  *nvme.EBSNVMEStats
+}
+
+// ReadStatsPage returns the latest sample at or before the playback
+// position. When playback has looped, the counters are advanced by the
+// growth over the recording for every loop so that they never decrease.
+func (r *replayReader) ReadStatsPage() ([]byte, error) {
+	position, loops := r.player.playback()
+	samples := r.device.Samples
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].Time.After(position)
+	})
+	if i == 0 {
+		return nil, fmt.Errorf("no sample recorded for %s at %s", r.device.Path, position.Format(time.RFC3339))
+	}
+
+	sample := samples[i-1]
+	if sample.Err != "" {
+		return nil, errors.New(sample.Err)
+	}
+	if loops == 0 || r.first == nil {
+		return append([]byte(nil), sample.Page...), nil
+	}
+
+	stats, err := nvme.DecodeStats(sample.Page)
+	if err != nil {
+		return nil, err
+	}
+	advanceCounters(stats, r.first, r.last, loops)
+	return nvme.EncodeStats(stats), nil
+}
+
+// Close implements nvme.PageReader
+func (r *replayReader) Close() error {
+	return nil
+}
+
+// counterRange returns the first and last successful samples of the
+// device, or nil if no sample decodes
+func (d *Device) counterRange() (*nvme.EBSNVMEStats, *nvme.EBSNVMEStats) {
+	var first, last *nvme.EBSNVMEStats
+	for _, sample := range d.Samples {
+		if sample.Err != "" {
+			continue
+		}
+		stats, err := nvme.DecodeStats(sample.Page)
+		if err != nil {
+			continue
+		}
+		if first == nil {
+			first = stats
+		}
+		last = stats
+	}
+	return first, last
+}
+
+// advanceCounters adds loops times the growth from first to last to every
+// counter and histogram bin of stats. Counters that went backwards during
+// the recording, e.g. because the volume was reattached, are left as is.
+func advanceCounters(stats, first, last *nvme.EBSNVMEStats, loops uint64) {
+	counters, firstCounters, lastCounters := statsCounters(stats), statsCounters(first), statsCounters(last)
+	for i, counter := range counters {
+		if *lastCounters[i] >= *firstCounters[i] {
+			*counter += loops * (*lastCounters[i] - *firstCounters[i])
+		}
+	}
+
+	bins, firstBins, lastBins := binCounts(stats), binCounts(first), binCounts(last)
+	for i, bin := range bins {
+		if *lastBins[i] >= *firstBins[i] {
+			*bin += uint32(loops) * (*lastBins[i] - *firstBins[i])
+		}
+	}
+}
+
+// statsCounters returns the cumulative counters of stats
+func statsCounters(stats *nvme.EBSNVMEStats) []*uint64 {
+	return []*uint64{
+		&stats.TotalReadOps,
+		&stats.TotalWriteOps,
+		&stats.TotalReadBytes,
+		&stats.TotalWriteBytes,
+		&stats.TotalReadTime,
+		&stats.TotalWriteTime,
+		&stats.EBSVolumePerformanceExceededIOPS,
+		&stats.EBSVolumePerformanceExceededTP,
+		&stats.EBSInstancePerformanceExceededIOPS,
+		&stats.EBSInstancePerformanceExceededTP,
+	}
+}
+
+// binCounts returns the counts of every latency histogram bin of stats
+func binCounts(stats *nvme.EBSNVMEStats) []*uint32 {
+	read, write := &stats.ReadIOLatencyHistogram.Bins, &stats.WriteIOLatencyHistogram.Bins
+	counts := make([]*uint32, 0, len(read)+len(write))
+	for i := range read {
+		counts = append(counts, &read[i].Count)
+	}
+	for i := range write {
+		counts = append(counts, &write[i].Count)
+	}
+	return counts
+}
@@ -0,0 +1,390 @@
+package scraper
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/nephomaniac/ebs-metrics-exporter/pkg/metrics"
+)
+
+const (
+	// maxConcurrentScrapes bounds the number of pods scraped at once
+	maxConcurrentScrapes = 16
+
+	deviceLabel   = "device"
+	volumeIDLabel = "volume_id"
+	errorLabel    = "error"
+
+	// sampleTimeMetric and queryErrorMetric report the sampling status of
+	// each device of a collector
+	sampleTimeMetric = "ebs_collector_last_sample_timestamp_seconds"
+	queryErrorMetric = "ebs_collector_query_error"
+)
+
+// collectorMetrics maps the metrics served by the collector to the
+// VolumeSample fields they set
+var collectorMetrics = map[string]func(sample *metrics.VolumeSample, value float64){
+	"ebs_volume_performance_exceeded_iops_total":         func(s *metrics.VolumeSample, v float64) { s.Counters.VolumeIOPSExceeded = v },
+	"ebs_volume_performance_exceeded_throughput_total":   func(s *metrics.VolumeSample, v float64) { s.Counters.VolumeThroughputExceeded = v },
+	"ebs_instance_performance_exceeded_iops_total":       func(s *metrics.VolumeSample, v float64) { s.Counters.InstanceIOPSExceeded = v },
+	"ebs_instance_performance_exceeded_throughput_total": func(s *metrics.VolumeSample, v float64) { s.Counters.InstanceThroughputExceeded = v },
+	"ebs_total_read_ops_total":                           func(s *metrics.VolumeSample, v float64) { s.Counters.ReadOps = v },
+	"ebs_total_write_ops_total":                          func(s *metrics.VolumeSample, v float64) { s.Counters.WriteOps = v },
+	"ebs_total_read_bytes_total":                         func(s *metrics.VolumeSample, v float64) { s.Counters.ReadBytes = v },
+	"ebs_total_write_bytes_total":                        func(s *metrics.VolumeSample, v float64) { s.Counters.WriteBytes = v },
+	"ebs_volume_queue_length":                            func(s *metrics.VolumeSample, v float64) { s.Gauges.QueueLength = v },
+}
+
+// collectorHistograms maps the latency histograms served by the collector
+// to the VolumeSample fields they set
+var collectorHistograms = map[string]func(sample *metrics.VolumeSample, histogram *metrics.LatencyHistogram){
+	"ebs_read_io_latency_microseconds":  func(s *metrics.VolumeSample, h *metrics.LatencyHistogram) { s.ReadLatency = h },
+	"ebs_write_io_latency_microseconds": func(s *metrics.VolumeSample, h *metrics.LatencyHistogram) { s.WriteLatency = h },
+}
+
+// Target is a collector pod to scrape
+type Target struct {
+	Pod  string
+	Node string
+	URL  string
+	// ServerName is the name an https target's certificate is verified
+	// against, since pods are scraped by IP
+	ServerName string
+}
+
+// DeviceStatus is the sampling status of a device as reported by its
+// collector
+type DeviceStatus struct {
+	Device   string
+	VolumeID string
+	// LastSampleTime is when the collector last queried the device
+	// successfully, zero if it never has
+	LastSampleTime time.Time
+	// Err is the error of the collector's last query of the device, empty
+	// if it succeeded
+	Err string
+}
+
+// Result is the outcome of the latest scrapes of a collector pod
+type Result struct {
+	Node string
+	// Volumes is the number of volumes accepted by the aggregator from the
+	// last scrape
+	Volumes int
+	// LastSampleTime is when the collector last queried one of its devices
+	// successfully, as of the latest scrape that reported it. It is zero if
+	// the collector never has.
+	LastSampleTime time.Time
+	// QueryErrors holds the errors of the collector's last query of each
+	// failing device, as of the last successful scrape
+	QueryErrors []string
+	// Err is the error of the last scrape, nil if it succeeded
+	Err error
+}
+
+// volumeKey identifies a volume on a node
+type volumeKey struct {
+	device   string
+	volumeID string
+}
+
+// Scraper scrapes collector pods and feeds the results to the aggregator
+type Scraper struct {
+	timeout    time.Duration
+	rootCAs    *x509.CertPool
+	aggregator *metrics.EBSMetricsAggregator
+
+	mutex sync.Mutex
+	// clients holds a client per target server name
+	clients map[string]*http.Client
+	// results holds the latest result per pod
+	results map[string]Result
+}
+
+// NewScraper creates a scraper with the given per-pod timeout. https
+// targets are verified against rootCAs, or the system roots if nil.
+func NewScraper(aggregator *metrics.EBSMetricsAggregator, timeout time.Duration, rootCAs *x509.CertPool) *Scraper {
+	return &Scraper{
+		timeout:    timeout,
+		rootCAs:    rootCAs,
+		aggregator: aggregator,
+		clients:    make(map[string]*http.Client),
+		results:    make(map[string]Result),
+	}
+}
+
+// client returns the client for targets with the given server name
+func (s *Scraper) client(serverName string) *http.Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[serverName]
+	if !ok {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    s.rootCAs,
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		}
+		client = &http.Client{Timeout: s.timeout, Transport: transport}
+		s.clients[serverName] = client
+	}
+	return client
+}
+
+// ScrapeAll scrapes the targets concurrently and updates the aggregator
+// with every volume found. It returns the number of volumes updated and
+// the errors of the targets and samples that could not be scraped.
+func (s *Scraper) ScrapeAll(ctx context.Context, targets []Target) (int, error) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []error
+	volumes := 0
+
+	semaphore := make(chan struct{}, maxConcurrentScrapes)
+	for _, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			samples, devices, err := s.Scrape(ctx, target)
+			s.record(target, len(samples), devices, err)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			volumes += len(samples)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("pod %s on node %s: %w", target.Pod, target.Node, err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return volumes, errors.Join(errs...)
+}
+
+// record stores the result of scraping a target. The device statuses of
+// the previous result are kept if the scrape returned none.
+func (s *Scraper) record(target Target, volumes int, devices []DeviceStatus, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.results[target.Pod]
+	result := Result{
+		Node:           target.Node,
+		Volumes:        volumes,
+		LastSampleTime: previous.LastSampleTime,
+		QueryErrors:    previous.QueryErrors,
+		Err:            err,
+	}
+	if devices != nil {
+		result.QueryErrors = nil
+		for _, device := range devices {
+			if device.LastSampleTime.After(result.LastSampleTime) {
+				result.LastSampleTime = device.LastSampleTime
+			}
+			if device.Err != "" {
+				result.QueryErrors = append(result.QueryErrors, device.Device+": "+device.Err)
+			}
+		}
+	}
+	s.results[target.Pod] = result
+}
+
+// LastResult returns the result of the latest scrape of a pod, and false if
+// the pod has not been scraped
+func (s *Scraper) LastResult(pod string) (Result, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result, ok := s.results[pod]
+	return result, ok
+}
+
+// RemoveResultsExcept forgets the results of the pods not in pods
+func (s *Scraper) RemoveResultsExcept(pods map[string]bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for pod := range s.results {
+		if !pods[pod] {
+			delete(s.results, pod)
+		}
+	}
+}
+
+// Scrape scrapes a single target and updates the aggregator with the
+// volumes found. It returns the samples accepted by the aggregator and the
+// status of every device of the collector, and reports the rejected
+// samples as errors.
+func (s *Scraper) Scrape(ctx context.Context, target Target) ([]metrics.VolumeSample, []DeviceStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+
+	resp, err := s.client(target.ServerName).Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	samples, devices, err := ParseMetrics(target.Node, time.Now(), resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var accepted []metrics.VolumeSample
+	var errs []error
+	for _, sample := range samples {
+		if err := s.aggregator.SetVolumeSample(sample); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		accepted = append(accepted, sample)
+	}
+	return accepted, devices, errors.Join(errs...)
+}
+
+// ParseMetrics parses the Prometheus text exposition served by a collector
+// into per-volume samples taken at sampleTime, and the status of every
+// device the collector samples. Metrics not exported by the collector, such
+// as the Go runtime metrics, are ignored.
+func ParseMetrics(node string, sampleTime time.Time, r io.Reader) ([]metrics.VolumeSample, []DeviceStatus, error) {
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse metrics: %w", err)
+	}
+
+	byVolume := make(map[volumeKey]*metrics.VolumeSample)
+	var samples []*metrics.VolumeSample
+	for name, family := range families {
+		set, isMetric := collectorMetrics[name]
+		setHistogram, isHistogram := collectorHistograms[name]
+		if !isMetric && !isHistogram {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			labels := labelMap(metric)
+			volume := volumeKey{device: labels[deviceLabel], volumeID: labels[volumeIDLabel]}
+			if volume.volumeID == "" {
+				continue
+			}
+
+			sample, ok := byVolume[volume]
+			if !ok {
+				sample = &metrics.VolumeSample{
+					Node:       node,
+					Device:     volume.device,
+					VolumeID:   volume.volumeID,
+					SampleTime: sampleTime,
+				}
+				byVolume[volume] = sample
+				samples = append(samples, sample)
+			}
+
+			switch {
+			case isMetric:
+				set(sample, metricValue(metric))
+			case metric.Histogram != nil:
+				setHistogram(sample, latencyHistogram(metric.GetHistogram()))
+			}
+		}
+	}
+
+	result := make([]metrics.VolumeSample, 0, len(samples))
+	for _, sample := range samples {
+		result = append(result, *sample)
+	}
+	return result, deviceStatuses(families), nil
+}
+
+// deviceStatuses returns the status of every device reported by the
+// collector's sample time and query error series. It is empty, not nil, if
+// the collector has no devices.
+func deviceStatuses(families map[string]*dto.MetricFamily) []DeviceStatus {
+	byVolume := make(map[volumeKey]*DeviceStatus)
+	statuses := []*DeviceStatus{}
+	status := func(labels map[string]string) *DeviceStatus {
+		volume := volumeKey{device: labels[deviceLabel], volumeID: labels[volumeIDLabel]}
+		device, ok := byVolume[volume]
+		if !ok {
+			device = &DeviceStatus{Device: volume.device, VolumeID: volume.volumeID}
+			byVolume[volume] = device
+			statuses = append(statuses, device)
+		}
+		return device
+	}
+
+	for _, metric := range families[sampleTimeMetric].GetMetric() {
+		seconds := metricValue(metric)
+		status(labelMap(metric)).LastSampleTime = time.Unix(0, int64(seconds*1e9))
+	}
+	for _, metric := range families[queryErrorMetric].GetMetric() {
+		if metricValue(metric) == 0 {
+			continue
+		}
+		labels := labelMap(metric)
+		status(labels).Err = labels[errorLabel]
+	}
+
+	result := make([]DeviceStatus, 0, len(statuses))
+	for _, device := range statuses {
+		result = append(result, *device)
+	}
+	return result
+}
+
+// latencyHistogram converts a scraped histogram
+func latencyHistogram(histogram *dto.Histogram) *metrics.LatencyHistogram {
+	buckets := make(map[float64]uint64, len(histogram.GetBucket()))
+	for _, bucket := range histogram.GetBucket() {
+		buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	return &metrics.LatencyHistogram{
+		Buckets: buckets,
+		Count:   histogram.GetSampleCount(),
+		Sum:     histogram.GetSampleSum(),
+	}
+}
+
+// labelMap returns the labels of a metric
+func labelMap(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(metric.GetLabel()))
+	for _, pair := range metric.GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+// metricValue returns the value of a counter, gauge or untyped metric
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Counter != nil:
+		return metric.GetCounter().GetValue()
+	case metric.Gauge != nil:
+		return metric.GetGauge().GetValue()
+	default:
+		return metric.GetUntyped().GetValue()
+	}
+}
@@ -0,0 +1,246 @@
+package volumes
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// ebsCSIDriver is the driver of PersistentVolumes provisioned by the
+	// EBS CSI driver, whose volume handle is the EBS volume ID
+	ebsCSIDriver = "ebs.csi.aws.com"
+
+	// listTimeout bounds the cache reads of a collection
+	listTimeout = 10 * time.Second
+)
+
+var log = logf.Log.WithName("volume-mapper")
+
+// Mapping is an EBS volume backing a PersistentVolume, with its claim and a
+// pod mounting it. Claim and pod are empty if the volume is not bound or
+// not mounted.
+type Mapping struct {
+	VolumeID              string
+	PersistentVolume      string
+	Namespace             string
+	PersistentVolumeClaim string
+	Pod                   string
+}
+
+// Mapper resolves EBS volume IDs to the PersistentVolumes, claims and pods
+// using them. It is a prometheus.Collector emitting the mapping as
+// ebs_volume_kubernetes_info, read from the informers of a cluster-wide
+// cache on every collection.
+type Mapper struct {
+	reader    client.Reader
+	clusterId string
+	infoDesc  *prometheus.Desc
+}
+
+// NewMapper creates a mapper reading PersistentVolumes and pods from reader,
+// usually a cache created by NewCache
+func NewMapper(reader client.Reader, clusterId string) *Mapper {
+	return &Mapper{
+		reader:    reader,
+		clusterId: clusterId,
+		infoDesc: prometheus.NewDesc("ebs_volume_kubernetes_info",
+			"PersistentVolume backed by an EBS volume, with its claim and a pod mounting it, always 1",
+			[]string{"cluster_id", "volume_id", "persistentvolume", "namespace", "persistentvolumeclaim", "pod"},
+			prometheus.Labels{"name": "ebs-metrics-exporter"}),
+	}
+}
+
+// NewCache creates a cache of the PersistentVolumes and pods of every
+// namespace. Pods are trimmed to the fields the mapper uses, so caching every
+// pod of the cluster stays cheap.
+func NewCache(config *rest.Config, scheme *runtime.Scheme) (cache.Cache, error) {
+	volumeCache, err := cache.New(config, cache.Options{
+		Scheme: scheme,
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Pod{}: {Transform: trimPod},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Start the informers with the cache rather than on the first scrape
+	for _, object := range []client.Object{&corev1.PersistentVolume{}, &corev1.Pod{}} {
+		if _, err := volumeCache.GetInformer(context.Background(), object); err != nil {
+			return nil, err
+		}
+	}
+	return volumeCache, nil
+}
+
+// Describe implements the prometheus.Collector interface
+func (m *Mapper) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.infoDesc
+}
+
+// Collect implements the prometheus.Collector interface
+func (m *Mapper) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	defer cancel()
+
+	mappings, err := m.Mappings(ctx)
+	if err != nil {
+		log.Error(err, "Failed to map EBS volumes to PersistentVolumes")
+		return
+	}
+	for _, mapping := range mappings {
+		ch <- prometheus.MustNewConstMetric(m.infoDesc, prometheus.GaugeValue, 1,
+			m.clusterId, mapping.VolumeID, mapping.PersistentVolume, mapping.Namespace,
+			mapping.PersistentVolumeClaim, mapping.Pod)
+	}
+}
+
+// Mappings returns a mapping per pod mounting each EBS-backed
+// PersistentVolume, and one without a pod for volumes no pod mounts
+func (m *Mapper) Mappings(ctx context.Context) ([]Mapping, error) {
+	volumes := &corev1.PersistentVolumeList{}
+	if err := m.reader.List(ctx, volumes); err != nil {
+		return nil, err
+	}
+	pods := &corev1.PodList{}
+	if err := m.reader.List(ctx, pods); err != nil {
+		return nil, err
+	}
+
+	// Pods by the claims they mount
+	claimPods := make(map[client.ObjectKey]map[string]bool)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, claim := range claimNames(pod) {
+			key := client.ObjectKey{Namespace: pod.Namespace, Name: claim}
+			if claimPods[key] == nil {
+				claimPods[key] = make(map[string]bool)
+			}
+			claimPods[key][pod.Name] = true
+		}
+	}
+
+	var mappings []Mapping
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		volumeID := ebsVolumeID(volume)
+		if volumeID == "" {
+			continue
+		}
+
+		mapping := Mapping{VolumeID: volumeID, PersistentVolume: volume.Name}
+		if claim := volume.Spec.ClaimRef; claim != nil && volume.Status.Phase == corev1.VolumeBound {
+			mapping.Namespace, mapping.PersistentVolumeClaim = claim.Namespace, claim.Name
+		}
+
+		podNames := sortedKeys(claimPods[client.ObjectKey{Namespace: mapping.Namespace, Name: mapping.PersistentVolumeClaim}])
+		if mapping.PersistentVolumeClaim == "" || len(podNames) == 0 {
+			mappings = append(mappings, mapping)
+			continue
+		}
+		for _, pod := range podNames {
+			mapping.Pod = pod
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings, nil
+}
+
+// ebsVolumeID returns the EBS volume ID backing a PersistentVolume, or an
+// empty string if it is not an EBS volume
+func ebsVolumeID(volume *corev1.PersistentVolume) string {
+	switch {
+	case volume.Spec.CSI != nil && volume.Spec.CSI.Driver == ebsCSIDriver:
+		return volume.Spec.CSI.VolumeHandle
+	case volume.Spec.AWSElasticBlockStore != nil:
+		// In-tree volume IDs are either vol-xxx or aws://<zone>/vol-xxx
+		volumeID := volume.Spec.AWSElasticBlockStore.VolumeID
+		return volumeID[strings.LastIndex(volumeID, "/")+1:]
+	default:
+		return ""
+	}
+}
+
+// claimNames returns the claims mounted by a pod, including the claims of
+// its generic ephemeral volumes
+func claimNames(pod *corev1.Pod) []string {
+	var claims []string
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.PersistentVolumeClaim != nil:
+			claims = append(claims, volume.PersistentVolumeClaim.ClaimName)
+		case volume.Ephemeral != nil:
+			claims = append(claims, pod.Name+"-"+volume.Name)
+		}
+	}
+	return claims
+}
+
+// trimPod keeps the fields of a pod the mapper uses
+func trimPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		// e.g. a DeletedFinalStateUnknown tombstone
+		return obj, nil
+	}
+
+	var volumes []corev1.Volume
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil || volume.Ephemeral != nil {
+			volumes = append(volumes, corev1.Volume{
+				Name: volume.Name,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: volume.PersistentVolumeClaim,
+					// The claim of an ephemeral volume is named after the
+					// pod and volume, the template is not needed
+					Ephemeral: trimEphemeral(volume.Ephemeral),
+				},
+			})
+		}
+	}
+
+	return &corev1.Pod{
+		TypeMeta: pod.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Spec: corev1.PodSpec{
+			NodeName: pod.Spec.NodeName,
+			Volumes:  volumes,
+		},
+		Status: corev1.PodStatus{Phase: pod.Status.Phase},
+	}, nil
+}
+
+func trimEphemeral(ephemeral *corev1.EphemeralVolumeSource) *corev1.EphemeralVolumeSource {
+	if ephemeral == nil {
+		return nil
+	}
+	return &corev1.EphemeralVolumeSource{}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}